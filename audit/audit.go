@@ -0,0 +1,99 @@
+// Package audit records access to the debug endpoints. Each request
+// produces a Record, which is passed to a Sink; JSONWriter writes
+// records as JSON lines, and Ring keeps the most recent records in
+// memory and can serve them over HTTP.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// A Record describes a single request to a debug endpoint.
+type Record struct {
+	Time      time.Time     `json:"time"`                // When the request arrived.
+	ClientIP  string        `json:"client_ip"`           // The resolved client address.
+	Principal string        `json:"principal,omitempty"` // The authenticated principal, if any.
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Query     string        `json:"query,omitempty"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`       // The size of the response body.
+	Duration  time.Duration `json:"duration_ns"` // How long the request took to serve.
+
+	// Denied is true if the request was refused by an ACL or an
+	// authenticator.
+	Denied bool `json:"denied"`
+}
+
+// A Sink receives audit records. Sinks must be safe for concurrent
+// use, and should not retain the record after Audit returns.
+type Sink interface {
+	Audit(rec *Record)
+}
+
+// SinkFunc allows an ordinary function to be used as a Sink.
+type SinkFunc func(rec *Record)
+
+// Audit calls f(rec).
+func (f SinkFunc) Audit(rec *Record) {
+	f(rec)
+}
+
+type multi []Sink
+
+// Multi returns a Sink that passes each record to every one of sinks.
+func Multi(sinks ...Sink) Sink {
+	return multi(sinks)
+}
+
+func (m multi) Audit(rec *Record) {
+	for _, sink := range m {
+		sink.Audit(rec)
+	}
+}
+
+type contextKey int
+
+const recordKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the record for the
+// request being served, so that handlers may annotate it.
+func NewContext(ctx context.Context, rec *Record) context.Context {
+	return context.WithValue(ctx, recordKey, rec)
+}
+
+// FromContext returns the record carried by ctx, if any.
+func FromContext(ctx context.Context) (rec *Record, ok bool) {
+	rec, ok = ctx.Value(recordKey).(*Record)
+	return
+}
+
+// JSONWriter is a Sink that writes each record to an io.Writer as a
+// line of JSON.
+type JSONWriter struct {
+	lock *sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONWriter returns a JSONWriter writing to w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{
+		lock: new(sync.Mutex),
+		enc:  json.NewEncoder(w),
+	}
+}
+
+// Audit writes the record. Write errors are logged.
+func (jw *JSONWriter) Audit(rec *Record) {
+	jw.lock.Lock()
+	defer jw.lock.Unlock()
+
+	if err := jw.enc.Encode(rec); err != nil {
+		log.Printf("audit: failed to write record: %v", err)
+	}
+}
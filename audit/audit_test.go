@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jw := NewJSONWriter(buf)
+
+	jw.Audit(&Record{Time: time.Now(), ClientIP: "127.0.0.1", Path: "/debug/requests", Status: 200})
+	jw.Audit(&Record{Time: time.Now(), ClientIP: "1.2.3.4", Path: "/debug/pprof/cmdline", Status: 403, Denied: true})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit: expected 2 lines, have %d", len(lines))
+	}
+
+	var rec Record
+	err := json.Unmarshal([]byte(lines[1]), &rec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if rec.ClientIP != "1.2.3.4" || !rec.Denied || rec.Status != 403 {
+		t.Fatalf("audit: record didn't round trip: %+v", rec)
+	}
+}
+
+func TestRing(t *testing.T) {
+	ring := NewRing(3)
+	var count int
+	sink := Multi(ring, SinkFunc(func(*Record) { count++ }))
+
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		sink.Audit(&Record{Path: path})
+	}
+
+	if count != 4 {
+		t.Fatalf("audit: expected 4 records to be passed on, have %d", count)
+	}
+
+	recs := ring.Records()
+	if len(recs) != 3 {
+		t.Fatalf("audit: expected 3 records, have %d", len(recs))
+	}
+
+	for i, path := range []string{"/d", "/c", "/b"} {
+		if recs[i].Path != path {
+			t.Fatalf("audit: expected record %d to be %s, have %s", i, path, recs[i].Path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ring.ServeHTTP(w, httptest.NewRequest("GET", "/debug/audit?format=json", nil))
+
+	var served []Record
+	err := json.Unmarshal(w.Body.Bytes(), &served)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(served) != 3 || served[0].Path != "/d" {
+		t.Fatalf("audit: unexpected records served: %+v", served)
+	}
+
+	w = httptest.NewRecorder()
+	ring.ServeHTTP(w, httptest.NewRequest("GET", "/debug/audit", nil))
+	if !strings.Contains(w.Body.String(), "/c") {
+		t.Fatal("audit: HTML output is missing records")
+	}
+}
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Ring is a Sink that keeps the most recent records in memory. It is
+// also an http.Handler that displays the records, as JSON if the
+// format=json query parameter is set or the request accepts
+// application/json, and as HTML otherwise.
+type Ring struct {
+	lock   *sync.Mutex
+	buf    []Record
+	start  int // < len(buf)
+	length int // <= len(buf)
+}
+
+// NewRing returns a Ring holding up to size records.
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Ring{
+		lock: new(sync.Mutex),
+		buf:  make([]Record, size),
+	}
+}
+
+// Audit stores a copy of the record, discarding the oldest record if
+// the ring is full.
+func (r *Ring) Audit(rec *Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i := (r.start + r.length) % len(r.buf)
+	r.buf[i] = *rec
+	if r.length == len(r.buf) {
+		r.start = (r.start + 1) % len(r.buf)
+	} else {
+		r.length++
+	}
+}
+
+// Records returns the stored records, most recent first.
+func (r *Ring) Records() []Record {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	recs := make([]Record, 0, r.length)
+	for i := r.length - 1; i >= 0; i-- {
+		recs = append(recs, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return recs
+}
+
+// wantsJSON returns true if the request asks for a JSON response.
+func wantsJSON(req *http.Request) bool {
+	if req.FormValue("format") == "json" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// ServeHTTP displays the stored records.
+func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	recs := r.Records()
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(recs); err != nil {
+			log.Printf("audit: failed to write records: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := &struct {
+		Path    string
+		Records []Record
+	}{
+		Path:    req.URL.Path,
+		Records: recs,
+	}
+	if err := ringTmpl.Execute(w, data); err != nil {
+		log.Printf("audit: failed executing template: %v", err)
+	}
+}
+
+var ringTmpl = template.Must(template.New("ring").Parse(`<html>
+<head>
+<title>{{.Path}}</title>
+<style type="text/css">
+	body {
+		font-family: sans-serif;
+	}
+	table#audit td {
+		font-family: monospace;
+		padding: 0 0.5em;
+	}
+	table#audit tr.denied {
+		color: #a00;
+	}
+</style>
+</head>
+<body>
+<h1>{{.Path}}</h1>
+<table id="audit">
+	<tr><th>When</th><th>Client</th><th>Principal</th><th>Request</th><th>Status</th><th>Bytes</th><th>Duration</th></tr>
+	{{range .Records}}
+	<tr{{if .Denied}} class="denied"{{end}}>
+		<td>{{.Time.Format "2006/01/02 15:04:05.000000"}}</td>
+		<td>{{.ClientIP}}</td>
+		<td>{{.Principal}}</td>
+		<td>{{.Method}} {{.Path}}{{if .Query}}?{{.Query}}{{end}}</td>
+		<td>{{.Status}}</td>
+		<td>{{.Bytes}}</td>
+		<td>{{.Duration}}</td>
+	</tr>
+	{{end}}
+</table>
+</body>
+</html>
+`))
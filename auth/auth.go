@@ -0,0 +1,175 @@
+// Package auth implements authenticators for the debug endpoints.
+// Authenticators may check static bearer tokens, HTTP basic auth
+// credentials, TLS client certificates, or the client's IP address,
+// and may be combined with All and Any.
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/kisom/httpdebug/whitelist"
+)
+
+// An Authenticator authenticates HTTP requests.
+type Authenticator interface {
+	// Authenticate returns the name of the principal making the
+	// request, and whether the request was authenticated.
+	Authenticate(req *http.Request) (principal string, ok bool)
+}
+
+// A Challenger is an Authenticator that can describe how a client
+// should authenticate, via the WWW-Authenticate header.
+type Challenger interface {
+	Authenticator
+
+	// Challenge returns the value of the WWW-Authenticate header.
+	Challenge() string
+}
+
+// AuthenticatorFunc allows an ordinary function to be used as an
+// Authenticator.
+type AuthenticatorFunc func(req *http.Request) (principal string, ok bool)
+
+// Authenticate calls f(req).
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (string, bool) {
+	return f(req)
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the authenticated
+// principal.
+func NewContext(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// FromContext returns the authenticated principal carried by ctx, if
+// any.
+func FromContext(ctx context.Context) (principal string, ok bool) {
+	principal, ok = ctx.Value(principalKey).(string)
+	return
+}
+
+// Handler wraps h so that it is only called for requests authenticated
+// by a. The authenticated principal is stored in the request's
+// context; see FromContext. Unauthenticated requests receive a 401,
+// along with a WWW-Authenticate header if a is a Challenger.
+func Handler(a Authenticator, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal, ok := a.Authenticate(req)
+		if !ok {
+			if c, isChallenger := a.(Challenger); isChallenger {
+				if challenge := c.Challenge(); challenge != "" {
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+			}
+			status := http.StatusUnauthorized
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), principal)))
+	})
+}
+
+// aclAuth adapts a whitelist.ACL to an Authenticator.
+type aclAuth struct {
+	acl    whitelist.ACL
+	lookup whitelist.LookupFunc
+}
+
+// ACL returns an Authenticator that permits requests from addresses
+// in the whitelist; the principal is the client address. A nil
+// whitelist permits no requests. If lookup is nil,
+// whitelist.HTTPRequestLookup is used.
+func ACL(acl whitelist.ACL, lookup whitelist.LookupFunc) Authenticator {
+	if lookup == nil {
+		lookup = whitelist.HTTPRequestLookup
+	}
+	return &aclAuth{acl: acl, lookup: lookup}
+}
+
+func (a *aclAuth) Authenticate(req *http.Request) (string, bool) {
+	if a.acl == nil {
+		return "", false
+	}
+
+	ip, err := a.lookup(req)
+	if err != nil || !a.acl.Permitted(ip) {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// all requires every member to authenticate the request.
+type all []Authenticator
+
+// All returns an Authenticator that requires every one of auths to
+// authenticate a request. The principal is the comma-separated list of
+// non-empty principals returned by each.
+func All(auths ...Authenticator) Authenticator {
+	as := all(auths)
+	return &as
+}
+
+func (as all) Authenticate(req *http.Request) (string, bool) {
+	var principals []string
+	for _, a := range as {
+		principal, ok := a.Authenticate(req)
+		if !ok {
+			return "", false
+		}
+
+		if principal != "" {
+			principals = append(principals, principal)
+		}
+	}
+
+	return strings.Join(principals, ","), len(as) > 0
+}
+
+func (as all) Challenge() string {
+	return challenges(as)
+}
+
+// anyOf requires at least one member to authenticate the request.
+type anyOf []Authenticator
+
+// Any returns an Authenticator that requires at least one of auths to
+// authenticate a request. The principal is returned by the first
+// Authenticator to succeed.
+func Any(auths ...Authenticator) Authenticator {
+	as := anyOf(auths)
+	return &as
+}
+
+func (as anyOf) Authenticate(req *http.Request) (string, bool) {
+	for _, a := range as {
+		if principal, ok := a.Authenticate(req); ok {
+			return principal, true
+		}
+	}
+
+	return "", false
+}
+
+func (as anyOf) Challenge() string {
+	return challenges(as)
+}
+
+// challenges joins the challenges from any Challengers in auths.
+func challenges(auths []Authenticator) string {
+	var cs []string
+	for _, a := range auths {
+		if c, ok := a.(Challenger); ok {
+			if challenge := c.Challenge(); challenge != "" {
+				cs = append(cs, challenge)
+			}
+		}
+	}
+	return strings.Join(cs, ", ")
+}
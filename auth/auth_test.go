@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kisom/httpdebug/whitelist"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newRequest() *http.Request {
+	return &http.Request{RemoteAddr: "127.0.0.1:1234", Header: http.Header{}}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := NewTokens()
+	tokens.Add("ops", "secret-ops")
+	tokens.Add("ci", "secret-ci")
+	tokens.Add("empty", "")
+
+	testCases := []struct {
+		header    string
+		principal string
+		ok        bool
+	}{
+		{"", "", false},
+		{"Bearer", "", false},
+		{"Bearer ", "", false},
+		{"Basic secret-ops", "", false},
+		{"Bearer wrong", "", false},
+		{"Bearer secret-ops", "ops", true},
+		{"bearer secret-ci", "ci", true},
+	}
+
+	for _, tc := range testCases {
+		req := newRequest()
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+
+		principal, ok := tokens.Authenticate(req)
+		if principal != tc.principal || ok != tc.ok {
+			t.Fatalf("auth: Authenticate with %q returned %q, %t; want %q, %t",
+				tc.header, principal, ok, tc.principal, tc.ok)
+		}
+	}
+
+	tokens.Remove("ops")
+	req := newRequest()
+	req.Header.Set("Authorization", "Bearer secret-ops")
+	if _, ok := tokens.Authenticate(req); ok {
+		t.Fatal("auth: a removed token should not authenticate")
+	}
+}
+
+func TestBasic(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	basic := NewBasic("debug")
+	err = basic.Add("kyle", hash)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = basic.Add("bad", []byte("not a hash"))
+	if err == nil {
+		t.Fatal("auth: adding an invalid hash should fail")
+	}
+
+	req := newRequest()
+	if _, ok := basic.Authenticate(req); ok {
+		t.Fatal("auth: a request without credentials should not authenticate")
+	}
+
+	req.SetBasicAuth("kyle", "hunter3")
+	if _, ok := basic.Authenticate(req); ok {
+		t.Fatal("auth: a request with the wrong password should not authenticate")
+	}
+
+	req.SetBasicAuth("nobody", "hunter2")
+	if _, ok := basic.Authenticate(req); ok {
+		t.Fatal("auth: a request from an unknown user should not authenticate")
+	}
+
+	// Unknown users are compared against dummyHash.
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("auth: invalid dummy hash (cost %d): %v", cost, err)
+	}
+
+	req.SetBasicAuth("kyle", "hunter2")
+	principal, ok := basic.Authenticate(req)
+	if !ok || principal != "kyle" {
+		t.Fatalf("auth: expected kyle to authenticate, but have %q, %t", principal, ok)
+	}
+
+	basic.Remove("kyle")
+	if _, ok := basic.Authenticate(req); ok {
+		t.Fatal("auth: a removed user should not authenticate")
+	}
+
+	if basic.Challenge() != `Basic realm="debug"` {
+		t.Fatalf("auth: unexpected challenge %s", basic.Challenge())
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	cc := NewClientCert()
+	cc.AddCommonName("ops")
+	cc.AddDNSName("oncall.example.net")
+	cc.AddEmail("sre@example.net")
+
+	certs := []struct {
+		cert      *x509.Certificate
+		principal string
+		ok        bool
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "ops"}}, "ops", true},
+		{&x509.Certificate{DNSNames: []string{"www.example.net", "oncall.example.net"}}, "oncall.example.net", true},
+		{&x509.Certificate{EmailAddresses: []string{"sre@example.net"}}, "sre@example.net", true},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "dev"}}, "", false},
+	}
+
+	for _, tc := range certs {
+		req := newRequest()
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{tc.cert}},
+		}
+
+		principal, ok := cc.Authenticate(req)
+		if principal != tc.principal || ok != tc.ok {
+			t.Fatalf("auth: Authenticate returned %q, %t; want %q, %t",
+				principal, ok, tc.principal, tc.ok)
+		}
+	}
+
+	// Unverified certificates must never be accepted.
+	req := newRequest()
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "ops"}},
+		},
+	}
+	if _, ok := cc.Authenticate(req); ok {
+		t.Fatal("auth: an unverified certificate should not authenticate")
+	}
+
+	if _, ok := cc.Authenticate(newRequest()); ok {
+		t.Fatal("auth: a request without TLS should not authenticate")
+	}
+}
+
+func TestComposition(t *testing.T) {
+	localhost := whitelist.NewBasic()
+	localhost.Add(net.ParseIP("127.0.0.1"))
+	remote := whitelist.NewBasic()
+	remote.Add(net.ParseIP("1.2.3.4"))
+
+	tokens := NewTokens()
+	tokens.Add("ops", "secret")
+
+	req := newRequest()
+	req.Header.Set("Authorization", "Bearer secret")
+
+	principal, ok := All(ACL(localhost, nil), tokens).Authenticate(req)
+	if !ok || principal != "127.0.0.1,ops" {
+		t.Fatalf("auth: All returned %q, %t", principal, ok)
+	}
+
+	if _, ok = All(ACL(remote, nil), tokens).Authenticate(req); ok {
+		t.Fatal("auth: All should require every authenticator to succeed")
+	}
+
+	principal, ok = Any(ACL(remote, nil), tokens).Authenticate(req)
+	if !ok || principal != "ops" {
+		t.Fatalf("auth: Any returned %q, %t", principal, ok)
+	}
+
+	if _, ok = Any(ACL(remote, nil), NewTokens()).Authenticate(req); ok {
+		t.Fatal("auth: Any should require at least one authenticator to succeed")
+	}
+
+	if _, ok = ACL(nil, nil).Authenticate(req); ok {
+		t.Fatal("auth: a nil ACL should not authenticate")
+	}
+
+	if _, ok = All().Authenticate(req); ok {
+		t.Fatal("auth: an empty All should not authenticate")
+	}
+
+	basic := NewBasic("debug")
+	challenge := Any(tokens, basic).(Challenger).Challenge()
+	if challenge != `Bearer realm="debug", Basic realm="debug"` {
+		t.Fatalf("auth: unexpected challenge %s", challenge)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tokens := NewTokens()
+	tokens.Add("ops", "secret")
+
+	h := Handler(tokens, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal, _ := FromContext(req.Context())
+		w.Write([]byte(principal))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("auth: expected %d, have %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if w.Header().Get("WWW-Authenticate") != tokens.Challenge() {
+		t.Fatal("auth: expected a WWW-Authenticate challenge")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "ops" {
+		t.Fatalf("auth: expected the principal ops, have %d %q", w.Code, w.Body.String())
+	}
+}
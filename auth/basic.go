@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against the password of unknown users, so
+// that the time taken to reject a request doesn't reveal whether the
+// user exists. It is a hash at bcrypt.DefaultCost, the cost used by
+// AddPassword.
+var dummyHash = []byte("$2a$10$xdy.xuETZLrw9RwTmlgPjea/.vTwspWiguEEF/nePn3JMA8PZ9SEe")
+
+// Basic authenticates requests using HTTP basic auth, checking
+// passwords against bcrypt hashes. The principal is the username.
+type Basic struct {
+	realm string
+	lock  *sync.RWMutex
+	users map[string][]byte // username -> bcrypt hash
+}
+
+// NewBasic returns an empty set of basic auth credentials for the
+// given realm.
+func NewBasic(realm string) *Basic {
+	return &Basic{
+		realm: realm,
+		lock:  new(sync.RWMutex),
+		users: map[string][]byte{},
+	}
+}
+
+// Add registers a user with the given bcrypt hash, which is validated
+// before it is added.
+func (b *Basic) Add(user string, hash []byte) error {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.users[user] = hash
+	return nil
+}
+
+// AddPassword hashes the password with bcrypt's default cost and
+// registers the user.
+func (b *Basic) AddPassword(user, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return b.Add(user, hash)
+}
+
+// Remove drops the user.
+func (b *Basic) Remove(user string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.users, user)
+}
+
+// Authenticate checks the request's basic auth credentials.
+func (b *Basic) Authenticate(req *http.Request) (string, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	b.lock.RLock()
+	hash, ok := b.users[user]
+	b.lock.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", false
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+
+	return user, true
+}
+
+// Challenge returns the basic auth challenge for the realm.
+func (b *Basic) Challenge() string {
+	return "Basic realm=" + strconv.Quote(b.realm)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sync"
+)
+
+// ClientCert authenticates requests made over TLS with a verified
+// client certificate whose subject common name, DNS SAN, or email SAN
+// has been permitted. The principal is the name that matched.
+//
+// The server must be configured to verify client certificates (e.g.
+// with tls.RequireAndVerifyClientCert or tls.VerifyClientCertIfGiven);
+// unverified certificates are never accepted.
+type ClientCert struct {
+	lock        *sync.RWMutex
+	commonNames map[string]bool
+	dnsNames    map[string]bool
+	emails      map[string]bool
+}
+
+// NewClientCert returns a ClientCert that permits no certificates.
+func NewClientCert() *ClientCert {
+	return &ClientCert{
+		lock:        new(sync.RWMutex),
+		commonNames: map[string]bool{},
+		dnsNames:    map[string]bool{},
+		emails:      map[string]bool{},
+	}
+}
+
+// AddCommonName permits certificates with the given subject common
+// name.
+func (cc *ClientCert) AddCommonName(cn string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.commonNames[cn] = true
+}
+
+// AddDNSName permits certificates with the given DNS SAN.
+func (cc *ClientCert) AddDNSName(name string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.dnsNames[name] = true
+}
+
+// AddEmail permits certificates with the given email SAN.
+func (cc *ClientCert) AddEmail(email string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.emails[email] = true
+}
+
+// match returns the first permitted name in the certificate.
+func (cc *ClientCert) match(cert *x509.Certificate) (string, bool) {
+	cc.lock.RLock()
+	defer cc.lock.RUnlock()
+
+	if cn := cert.Subject.CommonName; cn != "" && cc.commonNames[cn] {
+		return cn, true
+	}
+
+	for _, name := range cert.DNSNames {
+		if cc.dnsNames[name] {
+			return name, true
+		}
+	}
+
+	for _, email := range cert.EmailAddresses {
+		if cc.emails[email] {
+			return email, true
+		}
+	}
+
+	return "", false
+}
+
+// Authenticate checks the leaf certificate of the request's verified
+// client certificate chain.
+func (cc *ClientCert) Authenticate(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	chain := req.TLS.VerifiedChains[0]
+	if len(chain) == 0 {
+		return "", false
+	}
+
+	return cc.match(chain[0])
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Tokens authenticates requests bearing one of a set of named static
+// tokens in an "Authorization: Bearer" header. The principal is the
+// name of the matching token.
+type Tokens struct {
+	lock   *sync.RWMutex
+	tokens map[string][]byte // name -> token
+}
+
+// NewTokens returns an empty set of tokens.
+func NewTokens() *Tokens {
+	return &Tokens{
+		lock:   new(sync.RWMutex),
+		tokens: map[string][]byte{},
+	}
+}
+
+// Add registers a token under the given name, replacing any existing
+// token with that name. Empty tokens are ignored.
+func (ts *Tokens) Add(name, token string) {
+	if token == "" {
+		return
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.tokens[name] = []byte(token)
+}
+
+// Remove revokes the named token.
+func (ts *Tokens) Remove(name string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	delete(ts.tokens, name)
+}
+
+// bearerToken extracts the token from an Authorization header.
+func bearerToken(req *http.Request) (string, bool) {
+	authz := req.Header.Get("Authorization")
+	const scheme = "bearer "
+	if len(authz) <= len(scheme) || !strings.EqualFold(authz[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(authz[len(scheme):]), true
+}
+
+// Authenticate checks the request's bearer token against every
+// registered token using constant-time comparisons.
+func (ts *Tokens) Authenticate(req *http.Request) (string, bool) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", false
+	}
+
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	var principal string
+	var matched bool
+	for name, candidate := range ts.tokens {
+		// Every token is compared so that the time taken doesn't
+		// reveal which token matched.
+		if subtle.ConstantTimeCompare([]byte(token), candidate) == 1 {
+			principal, matched = name, true
+		}
+	}
+
+	return principal, matched
+}
+
+// Challenge returns the bearer challenge.
+func (ts *Tokens) Challenge() string {
+	return `Bearer realm="debug"`
+}
@@ -4,9 +4,15 @@
 // frustration with the default imports from the two named packages,
 // which make it difficult to limit requests only to localhost.
 //
-// One of the New functions must be called before any of the other
-// functions; they may be called only once. This is due to a
-// limitation in the trace package, which operates on a global level.
+// A Debugger is an independent debug handler with its own
+// multiplexer, ACL, admin authenticator, and timeout; any number of
+// them may be created with NewDebugger or NewLocalhostDebugger. This
+// permits, for example, serving one handler on a loopback admin port
+// and another with a different ACL on an internal network port.
+//
+// The package-level functions operate on a default Debugger. One of
+// the New functions must be called before any of the other
+// package-level functions; they may be called only once.
 //
 // Note that using this package should only be done *instead* of using
 // the previously mentioned packages.
@@ -22,9 +28,190 @@ import (
 	"github.com/kisom/httpdebug/whitelist"
 )
 
+// A Debugger provides the debugging endpoints as an http.Handler.
+type Debugger struct {
+	lock *sync.Mutex
+	d    *debug.Debug
+}
+
+// NewDebuggerWithOptions returns a new Debugger configured by the
+// given options. By default, requests are restricted to localhost, no
+// timeouts are applied, and both the pprof and trace endpoints are
+// enabled. The sensitive endpoints stay restricted to localhost when
+// WithACL permits other addresses, unless WithClassPolicy replaces
+// their policy, and at most 4 expensive requests are served at once.
+func NewDebuggerWithOptions(opts ...Option) *Debugger {
+	return &Debugger{
+		lock: new(sync.Mutex),
+		d:    debug.NewWithOptions(debugOptions(opts)...),
+	}
+}
+
+// NewLocalhostDebugger returns a new Debugger restricted to
+// localhost. If timeout is 0, no timeouts will be applied. If
+// pprofDisable is true, the pprof endpoints will not be enabled. If
+// traceDisable is true, the trace endpoints will not be enabled.
+func NewLocalhostDebugger(timeout time.Duration, pprofDisable, traceDisable bool) *Debugger {
+	return &Debugger{
+		lock: new(sync.Mutex),
+		d:    debug.NewLocalhost(timeout, pprofDisable, traceDisable),
+	}
+}
+
+// NewDebugger returns a new Debugger restricted to the given
+// whitelist. If timeout is 0, no timeouts will be applied. If
+// pprofDisable is true, the pprof endpoints will not be enabled. If
+// traceDisable is true, the trace endpoints will not be enabled.
+func NewDebugger(acl whitelist.ACL, admin func(*http.Request) bool, timeout time.Duration, pprofDisable, traceDisable bool) *Debugger {
+	return &Debugger{
+		lock: new(sync.Mutex),
+		d:    debug.New(acl, admin, timeout, pprofDisable, traceDisable),
+	}
+}
+
+// Setup sets up the debug handler. Setup may be called multiple
+// times; after the first call, it will have no effect.
+func (dbg *Debugger) Setup() {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.Register()
+}
+
+// Handler does any initial setup on the debug handler and returns an
+// HTTP handler for the debug endpoints.
+func (dbg *Debugger) Handler() http.Handler {
+	dbg.Setup()
+	return dbg.d
+}
+
+// ServeHTTP serves the debug endpoints. Setup must have been called
+// first, either directly or via Handler or Register.
+func (dbg *Debugger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dbg.d.ServeHTTP(w, r)
+}
+
+// Register does any initial setup on the debug handler and registers
+// it under its prefix with an existing *http.ServeMux. If mux is nil,
+// the http.Handle functions are used.
+func (dbg *Debugger) Register(mux *http.ServeMux) {
+	dbg.Setup()
+
+	if mux == nil {
+		http.Handle(dbg.d.Prefix(), dbg.d)
+	} else {
+		mux.Handle(dbg.d.Prefix(), dbg.d)
+	}
+}
+
+// Prefix returns the path prefix under which the debug endpoints are
+// served.
+func (dbg *Debugger) Prefix() string {
+	return dbg.d.Prefix()
+}
+
+// SetAdminACL allows an ACL to be applied to the debug handler.
+func (dbg *Debugger) SetAdminACL(acl whitelist.ACL) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.SetAdminACL(acl)
+}
+
+// SetAdmin sets the admin authenticator.
+func (dbg *Debugger) SetAdmin(auth func(req *http.Request) bool) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.SetAdmin(auth)
+}
+
+// LocalAdmin permits viewing sensitive traces from localhost.
+func (dbg *Debugger) LocalAdmin() {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.LocalAdmin()
+}
+
+// Handle registers a new handler. It is intended to allow additional
+// debugging tools to be enabled.
+func (dbg *Debugger) Handle(pat string, h http.Handler) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.Handle(pat, h)
+}
+
+// HandleClass registers a new handler as an endpoint of the given
+// class, so that the class's policy applies to it.
+func (dbg *Debugger) HandleClass(pat string, class Class, h http.Handler) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.HandleClass(pat, debug.Class(class), h)
+}
+
+// HandleFunc registers a new handler function. It is intended to
+// allow additional debugging tools to be enabled.
+func (dbg *Debugger) HandleFunc(pat string, f func(http.ResponseWriter, *http.Request)) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.HandleFunc(pat, f)
+}
+
+// AddProfile registers a new profile endpoint for pprof under
+// pprof/name beneath the prefix (e.g. /debug/pprof/name). The profile
+// must already have been created using the runtime/pprof package.
+func (dbg *Debugger) AddProfile(name string) {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	dbg.d.AddProfile(name)
+}
+
+// Replace replaces the handler for an already registered pattern,
+// keeping its class. It returns false if the pattern isn't
+// registered. Endpoints may be replaced while the debugger is
+// serving requests.
+func (dbg *Debugger) Replace(pat string, h http.Handler) bool {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	return dbg.d.Replace(pat, h)
+}
+
+// Describe sets the description of a registered pattern shown in the
+// index served at the prefix. It returns false if the pattern isn't
+// registered.
+func (dbg *Debugger) Describe(pat, description string) bool {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	return dbg.d.Describe(pat, description)
+}
+
+// Unregister removes the endpoint registered for the pattern,
+// returning false if the pattern isn't registered. Endpoints may be
+// removed while the debugger is serving requests.
+func (dbg *Debugger) Unregister(pat string) bool {
+	dbg.lock.Lock()
+	defer dbg.lock.Unlock()
+
+	return dbg.d.Unregister(pat)
+}
+
+// Patterns returns the patterns of the registered endpoints in sorted
+// order. The built-in endpoints are registered by Setup.
+func (dbg *Debugger) Patterns() []string {
+	return dbg.d.Patterns()
+}
+
 var (
-	// debugger contains the internal, global debugger.
-	debugger *debug.Debug
+	// debugger contains the default debugger used by the
+	// package-level functions.
+	debugger *Debugger
 
 	// lock is used to synchronise multiple calls to certain functions.
 	lock = &sync.Mutex{}
@@ -33,10 +220,10 @@ var (
 	errAlreadyInit = errors.New("httpdebug: already initialised")
 )
 
-// NewLocalhost sets up the debug handler restricted to localhost. If
-// timeout is 0, no timeouts will be applied. If pprofDisable is true,
-// the pprof endpoints will not be enabled. If traceDisable is true,
-// the trace endpoints will not be enabled.
+// NewLocalhost sets up the default debug handler restricted to
+// localhost. If timeout is 0, no timeouts will be applied. If
+// pprofDisable is true, the pprof endpoints will not be enabled. If
+// traceDisable is true, the trace endpoints will not be enabled.
 func NewLocalhost(timeout time.Duration, pprofDisable, traceDisable bool) error {
 	lock.Lock()
 	defer lock.Unlock()
@@ -45,14 +232,14 @@ func NewLocalhost(timeout time.Duration, pprofDisable, traceDisable bool) error
 		return errAlreadyInit
 	}
 
-	debugger = debug.NewLocalhost(timeout, pprofDisable, traceDisable)
+	debugger = NewLocalhostDebugger(timeout, pprofDisable, traceDisable)
 	return nil
 }
 
-// New sets up the debug handler restricted with to the given whitelist. If
-// timeout is 0, no timeouts will be applied. If pprofDisable is true,
-// the pprof endpoints will not be enabled. If traceDisable is true,
-// the trace endpoints will not be enabled.
+// New sets up the default debug handler restricted with to the given
+// whitelist. If timeout is 0, no timeouts will be applied. If
+// pprofDisable is true, the pprof endpoints will not be enabled. If
+// traceDisable is true, the trace endpoints will not be enabled.
 func New(acl whitelist.ACL, admin func(*http.Request) bool, timeout time.Duration, pprofDisable, traceDisable bool) error {
 	lock.Lock()
 	defer lock.Unlock()
@@ -61,7 +248,21 @@ func New(acl whitelist.ACL, admin func(*http.Request) bool, timeout time.Duratio
 		return errAlreadyInit
 	}
 
-	debugger = debug.New(acl, admin, timeout, pprofDisable, traceDisable)
+	debugger = NewDebugger(acl, admin, timeout, pprofDisable, traceDisable)
+	return nil
+}
+
+// NewWithOptions sets up the default debug handler using the given
+// options; see NewDebuggerWithOptions.
+func NewWithOptions(opts ...Option) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if debugger != nil {
+		return errAlreadyInit
+	}
+
+	debugger = NewDebuggerWithOptions(opts...)
 	return nil
 }
 
@@ -74,7 +275,7 @@ func setup() (err error) {
 		return errNotSetup
 	}
 
-	debugger.Register()
+	debugger.Setup()
 	return nil
 }
 
@@ -98,7 +299,7 @@ func Handler() (http.Handler, error) {
 		return nil, err
 	}
 
-	return debugger, nil
+	return debugger.Handler(), nil
 }
 
 // HandlerFunc does any initial setup on the debug handler and returns an
@@ -127,12 +328,7 @@ func Register(mux *http.ServeMux) error {
 		return err
 	}
 
-	if mux == nil {
-		http.Handle("/debug/", debugger)
-	} else {
-		mux.Handle("/debug/", debugger)
-	}
-
+	debugger.Register(mux)
 	return nil
 }
 
@@ -181,11 +377,51 @@ func HandleFunc(pat string, f func(http.ResponseWriter, *http.Request)) {
 }
 
 // AddProfile registers a new profile endpoint for pprof under
-// /debug/profile/name. The profile must already have been created
-// using the runtime/pprof package.
+// pprof/name beneath the prefix (e.g. /debug/pprof/name). The profile
+// must already have been created using the runtime/pprof package.
 func AddProfile(name string) {
 	lock.Lock()
 	defer lock.Unlock()
 
 	debugger.AddProfile(name)
 }
+
+// Replace replaces the handler for an already registered pattern,
+// keeping its class. It returns false if the pattern isn't
+// registered. One of the New functions must have been called
+// already.
+func Replace(pat string, h http.Handler) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return debugger.Replace(pat, h)
+}
+
+// Describe sets the description of a registered pattern shown in the
+// index served at the prefix. It returns false if the pattern isn't
+// registered. One of the New functions must have been called already.
+func Describe(pat, description string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return debugger.Describe(pat, description)
+}
+
+// Unregister removes the endpoint registered for the pattern,
+// returning false if the pattern isn't registered. One of the New
+// functions must have been called already.
+func Unregister(pat string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return debugger.Unregister(pat)
+}
+
+// Patterns returns the patterns of the registered endpoints in sorted
+// order. One of the New functions must have been called already.
+func Patterns() []string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return debugger.Patterns()
+}
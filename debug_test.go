@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"runtime/pprof"
 	"testing"
+	"time"
 
 	"github.com/kisom/httpdebug/internal/debug"
 	"github.com/kisom/whitelist"
@@ -183,6 +184,17 @@ func TestRegister(t *testing.T) {
 }
 
 func TestAddProfile(t *testing.T) {
+	// Profiles are subject to the ACL, so make sure the default
+	// debugger isn't the one set up by TestWhitelisting.
+	lock.Lock()
+	debugger = nil
+	lock.Unlock()
+
+	err := NewLocalhost(0, false, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
 	p := pprof.NewProfile("pkg/httpdebug")
 	AddProfile("pkg/httpdebug")
 	p.Add("first dump", 0)
@@ -200,3 +212,95 @@ func TestAddProfile(t *testing.T) {
 		t.Fatalf("%s", err)
 	}
 }
+
+// TestIndependentDebuggers verifies that multiple Debuggers may be
+// created, each with their own ACL, and that they don't interfere
+// with the default debugger.
+func TestIndependentDebuggers(t *testing.T) {
+	local := NewLocalhostDebugger(0, false, false)
+	local.HandleFunc("/debug/ok", okDebugResponse)
+
+	acl := whitelist.NewBasic()
+	acl.Add(net.ParseIP("1.2.3.4"))
+	remote := NewDebugger(acl, nil, 0, false, false)
+	remote.HandleFunc("/debug/ok", okDebugResponse)
+
+	localSrv := httptest.NewServer(local.Handler())
+	defer localSrv.Close()
+
+	remoteSrv := httptest.NewServer(remote.Handler())
+	defer remoteSrv.Close()
+
+	err := testEndpoint(localSrv.URL+"/debug/ok", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(localSrv.URL+"/debug/requests", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(remoteSrv.URL+"/debug/ok", http.StatusForbidden)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(remoteSrv.URL+"/debug/requests", http.StatusForbidden)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestNewDebuggerWithOptions(t *testing.T) {
+	acl := whitelist.NewBasic()
+	acl.Add(net.ParseIP("1.2.3.4"))
+
+	dbg := NewDebuggerWithOptions(WithACL(acl), WithTimeout(time.Second), WithPprof(false))
+	dbg.HandleFunc("/debug/ok", okDebugResponse)
+
+	srv := httptest.NewServer(dbg.Handler())
+	defer srv.Close()
+
+	err := testEndpoint(srv.URL+"/debug/ok", http.StatusForbidden)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	dbg = NewDebuggerWithOptions(WithLocalhost(), WithTrace(false))
+	dbg.HandleFunc("/debug/ok", okDebugResponse)
+
+	srv2 := httptest.NewServer(dbg.Handler())
+	defer srv2.Close()
+
+	err = testEndpoint(srv2.URL+"/debug/ok", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv2.URL+"/debug/requests", http.StatusNotFound)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestRegisterPrefix(t *testing.T) {
+	dbg := NewDebuggerWithOptions(WithPrefix("/_internal/debug/"))
+	dbg.HandleFunc("/_internal/debug/ok", okDebugResponse)
+
+	mux := http.NewServeMux()
+	dbg.Register(mux)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	err := testEndpoint(srv.URL+"/_internal/debug/ok", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv.URL+"/_internal/debug/requests", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
@@ -0,0 +1,236 @@
+package debug
+
+// admission.go contains the admission controller, which limits the
+// concurrency and rate of requests to expensive endpoints.
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxExpensive is the number of expensive requests
+	// served at once, unless WithMaxExpensive is used.
+	DefaultMaxExpensive = 4
+
+	// maxRateBuckets is the number of client token buckets kept
+	// before idle buckets are pruned.
+	maxRateBuckets = 1024
+)
+
+// tooManyRequests returns a 429 - Too Many Requests response, asking
+// the client to retry after the given duration.
+func tooManyRequests(w http.ResponseWriter, retry time.Duration) {
+	sec := int64(math.Ceil(retry.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// A limiter restricts the number of requests served concurrently.
+// Requests over the limit either wait for a slot or are rejected.
+type limiter struct {
+	slots chan struct{}
+	queue bool
+}
+
+func newLimiter(n int, queue bool) *limiter {
+	if n < 1 {
+		n = 1
+	}
+
+	return &limiter{
+		slots: make(chan struct{}, n),
+		queue: queue,
+	}
+}
+
+// acquire returns true if the caller may proceed; it must then call
+// release when it is done. If the limiter queues requests, acquire
+// waits until a slot is free or ctx is done.
+func (l *limiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if !l.queue {
+		return false
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// pathLimiter is a limiter applied to paths with the given prefix.
+type pathLimiter struct {
+	prefix string
+	limit  *limiter
+}
+
+// tokenBucket tracks the tokens available to a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A rateLimiter implements a token bucket per client.
+type rateLimiter struct {
+	lock    *sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // maximum tokens
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		lock:    new(sync.Mutex),
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// refill adds the tokens accumulated since the bucket was last used.
+// L >= rl.lock
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+}
+
+// prune drops buckets that have refilled completely, as they are
+// indistinguishable from new buckets.
+// L >= rl.lock
+func (rl *rateLimiter) prune(now time.Time) {
+	for client, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= rl.burst {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// allow takes a token from the client's bucket, returning false and
+// the time until a token is available if the bucket is empty.
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		if len(rl.buckets) >= maxRateBuckets {
+			rl.prune(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+
+	rl.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if rl.rate <= 0 {
+		return false, time.Minute
+	}
+
+	wait := (1 - b.tokens) / rl.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// clientKey identifies the client for rate limiting.
+func (d *Debug) clientKey(req *http.Request) string {
+	if ip, err := d.lookup(req); err == nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// pathLimit returns the concurrency limiter with the longest prefix
+// matching path, if any.
+func (d *Debug) pathLimit(path string) *limiter {
+	var longest *pathLimiter
+	for i := range d.pathLimits {
+		pl := &d.pathLimits[i]
+		if !strings.HasPrefix(path, pl.prefix) {
+			continue
+		}
+
+		if longest == nil || len(pl.prefix) > len(longest.prefix) {
+			longest = pl
+		}
+	}
+
+	if longest == nil {
+		return nil
+	}
+	return longest.limit
+}
+
+// admissionHandler applies the admission controller to the handler,
+// which serves an endpoint of the given class. Requests to expensive
+// endpoints are subject to the per-client rate limit and the global
+// limit on concurrent expensive requests; any request may be subject
+// to a per-path concurrency limit. If serial isn't nil, requests wait
+// for it before taking any other slot, so that requests waiting their
+// turn don't hold slots other requests could use.
+func (d *Debug) admissionHandler(class Class, serial *limiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if class == Expensive && d.rate != nil {
+			if ok, retry := d.rate.allow(d.clientKey(req), time.Now()); !ok {
+				tooManyRequests(w, retry)
+				return
+			}
+		}
+
+		if serial != nil {
+			if !serial.acquire(req.Context()) {
+				tooManyRequests(w, time.Second)
+				return
+			}
+			defer serial.release()
+		}
+
+		if class == Expensive && d.expensive != nil {
+			if !d.expensive.acquire(req.Context()) {
+				tooManyRequests(w, time.Second)
+				return
+			}
+			defer d.expensive.release()
+		}
+
+		if l := d.pathLimit(req.URL.Path); l != nil {
+			if !l.acquire(req.Context()) {
+				tooManyRequests(w, time.Second)
+				return
+			}
+			defer l.release()
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,58 @@
+package debug
+
+// audit.go contains support for auditing access to the endpoints.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kisom/httpdebug/audit"
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/internal/response"
+)
+
+// auditRequest serves the request with h, passing a record of the
+// request to the Debug's audit sink.
+func (d *Debug) auditRequest(w http.ResponseWriter, req *http.Request, h http.Handler) {
+	rec := &audit.Record{
+		Time:   time.Now(),
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+	}
+
+	if ip, err := d.lookup(req); err == nil {
+		rec.ClientIP = ip.String()
+	}
+
+	resp, w := response.Record(w)
+	h.ServeHTTP(w, req.WithContext(audit.NewContext(req.Context(), rec)))
+
+	rec.Duration = time.Since(rec.Time)
+	rec.Status = resp.Status()
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	rec.Bytes = resp.Bytes()
+	d.audit.Audit(rec)
+}
+
+// auditDenied marks the request's audit record, if any, as denied.
+func auditDenied(req *http.Request) {
+	if rec, ok := audit.FromContext(req.Context()); ok {
+		rec.Denied = true
+	}
+}
+
+// auditPrincipal wraps h so that the authenticated principal is
+// recorded in the request's audit record, clearing the denial
+// recorded before authentication was attempted.
+func auditPrincipal(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rec, ok := audit.FromContext(req.Context()); ok {
+			rec.Denied = false
+			rec.Principal, _ = auth.FromContext(req.Context())
+		}
+		h.ServeHTTP(w, req)
+	})
+}
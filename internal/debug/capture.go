@@ -0,0 +1,62 @@
+package debug
+
+// capture.go contains timeout handling for the endpoints that capture
+// profiles or traces for a requested duration.
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultCaptureGrace is the time allowed for a capture
+	// endpoint to write its output beyond the requested capture
+	// duration, unless WithCaptureGrace is used.
+	DefaultCaptureGrace = 10 * time.Second
+
+	// DefaultMaxCapture is the longest capture that may be
+	// requested, unless WithMaxCapture is used.
+	DefaultMaxCapture = 5 * time.Minute
+)
+
+// wholeSeconds rounds d up to a whole number of seconds, as the CPU
+// profile endpoint only captures for whole seconds.
+func wholeSeconds(d time.Duration) time.Duration {
+	if rem := d % time.Second; rem > 0 {
+		d += time.Second - rem
+	}
+	return d
+}
+
+// limitCapture rewrites the request's seconds parameter so that the
+// capture lasts for max, which is a whole number of seconds,
+// returning the new duration.
+func limitCapture(req *http.Request, max time.Duration) time.Duration {
+	sec := int64(max / time.Second)
+	q := req.URL.Query()
+	q.Set("seconds", strconv.FormatInt(sec, 10))
+	req.URL.RawQuery = q.Encode()
+	req.Form = nil
+	return time.Duration(sec) * time.Second
+}
+
+// captureHandler applies a duration-aware timeout to a capture
+// endpoint, which captures for the duration returned by duration.
+// Rather than buffering the response, as http.TimeoutHandler does,
+// the handler's context is cancelled once the capture duration plus
+// the grace period has elapsed; the output is streamed to the client
+// as it is written.
+func (d *Debug) captureHandler(duration func(*http.Request) time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		capture := duration(req)
+		if d.maxCap > 0 && capture > d.maxCap {
+			capture = limitCapture(req, d.maxCap)
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), capture+d.grace)
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
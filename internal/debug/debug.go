@@ -4,14 +4,31 @@ package debug
 import (
 	"net"
 	"net/http"
-	"net/http/pprof"
+	"strings"
 	"time"
 
+	"github.com/kisom/httpdebug/audit"
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/pprof"
 	"github.com/kisom/httpdebug/whitelist"
 )
 
+// DefaultPrefix is the path prefix under which the debug endpoints
+// are served unless WithPrefix is used.
+const DefaultPrefix = "/debug/"
+
+// cleanPrefix ensures the prefix begins and ends with a slash.
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "/"
+	}
+	return "/" + prefix + "/"
+}
+
 // forbidden returns a standard 403 - Forbidden response.
 func forbidden(w http.ResponseWriter, r *http.Request) {
+	auditDenied(r)
 	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 }
 
@@ -21,16 +38,75 @@ func DefaultAdminAuth(req *http.Request) bool {
 	return AllowSensitiveTrace
 }
 
-// Debug is an http.Handler providing debugging endpoints under /debug.
+// Debug is an http.Handler providing debugging endpoints under a
+// prefix, which defaults to /debug/.
 type Debug struct {
+	prefix    string                   // The path prefix for all endpoints.
 	acl       whitelist.ACL            // A whitelist for any requests.
+	auth      auth.Authenticator       // An authenticator for any requests.
+	lookup    whitelist.LookupFunc     // Resolves the client address for ACLs.
 	admin     func(*http.Request) bool // Authenticator for sensitive trace requests.
+	audit     audit.Sink               // Receives a record of every request.
+	auditRing *audit.Ring              // Serves recent audit records, if set.
 	timeo     time.Duration            // A timeout that should be setup for any requests.
+	grace     time.Duration            // Extra time allowed for capture endpoints.
+	maxCap    time.Duration            // The longest permitted capture.
 	enpprof   bool                     // Enable pprof endpoints.
 	entrace   bool                     // Enable trace endpoints.
 	setup     bool                     // Has the Debug been setup?
-	mux       *http.ServeMux           // mux provides the underlying handler.
-	endpoints map[string]http.Handler  // Endpoints that will be registered.
+	router    *router                  // router provides the underlying handler.
+
+	classPolicies map[Class]Policy // Policies for each class of endpoint.
+	pathPolicies  []pathPolicy     // Policies for paths with a given prefix.
+
+	rate       *rateLimiter  // Per-client rate limit for expensive endpoints.
+	expensive  *limiter      // Limits concurrent expensive requests.
+	pathLimits []pathLimiter // Concurrency limits for paths with a given prefix.
+}
+
+// localhostACL returns a whitelist permitting only localhost.
+func localhostACL() whitelist.ACL {
+	localhost := whitelist.NewBasic()
+	localhost.Add(net.ParseIP("127.0.0.1"))
+	localhost.Add(net.ParseIP("::1"))
+	return localhost
+}
+
+// NewWithOptions returns a new Debug configured by the given
+// options. By default, endpoints are served under DefaultPrefix,
+// requests are restricted to localhost, no timeouts are applied,
+// sensitive traces are controlled by DefaultAdminAuth, and both the
+// pprof and trace endpoints are enabled.
+//
+// Each class of endpoint also has a default policy. The sensitive
+// endpoints are restricted to localhost even if WithACL permits
+// other addresses, until WithClassPolicy replaces their policy; at
+// most DefaultMaxExpensive expensive requests are served at once,
+// unless WithMaxExpensive says otherwise; and the read-only endpoints
+// use the Debug's ACL, authenticator, and timeout.
+func NewWithOptions(opts ...Option) *Debug {
+	d := &Debug{
+		prefix:  DefaultPrefix,
+		acl:     localhostACL(),
+		lookup:  whitelist.HTTPRequestLookup,
+		admin:   DefaultAdminAuth,
+		grace:   DefaultCaptureGrace,
+		maxCap:  DefaultMaxCapture,
+		enpprof: true,
+		entrace: true,
+		router:  newRouter(),
+
+		classPolicies: map[Class]Policy{
+			Sensitive: {ACL: localhostACL()},
+		},
+		expensive: newLimiter(DefaultMaxExpensive, false),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
 }
 
 // NewLocalhost returns a new Debug restricted to localhost. If
@@ -38,73 +114,69 @@ type Debug struct {
 // the pprof endpoints will not be enabled. If traceDisable is true,
 // the trace endpoints will not be enabled.
 func NewLocalhost(timeout time.Duration, pprofDisable, traceDisable bool) *Debug {
-	localhost := whitelist.NewBasic()
-	localhost.Add(net.ParseIP("127.0.0.1"))
-	localhost.Add(net.ParseIP("::1"))
-	return &Debug{
-		acl:       localhost,
-		admin:     DefaultAdminAuth,
-		timeo:     timeout,
-		enpprof:   !pprofDisable,
-		entrace:   !traceDisable,
-		mux:       http.NewServeMux(),
-		endpoints: map[string]http.Handler{},
-	}
+	return NewWithOptions(
+		WithTimeout(timeout),
+		WithPprof(!pprofDisable),
+		WithTrace(!traceDisable),
+	)
 }
 
 // New returns a new Debug restricted with to the given whitelist. If
 // timeout is 0, no timeouts will be applied. If pprofDisable is true,
 // the pprof endpoints will not be enabled. If traceDisable is true,
-// the trace endpoints will not be enabled.
+// the trace endpoints will not be enabled. If admin is nil,
+// DefaultAdminAuth is used.
 func New(acl whitelist.ACL, admin func(*http.Request) bool, timeout time.Duration, pprofDisable, traceDisable bool) *Debug {
-	return &Debug{
-		acl:       acl,
-		admin:     DefaultAdminAuth,
-		timeo:     timeout,
-		enpprof:   !pprofDisable,
-		entrace:   !traceDisable,
-		mux:       http.NewServeMux(),
-		endpoints: map[string]http.Handler{},
-	}
+	return NewWithOptions(
+		WithACL(acl),
+		WithAdmin(admin),
+		WithTimeout(timeout),
+		WithPprof(!pprofDisable),
+		WithTrace(!traceDisable),
+	)
 }
 
 // aclHandler will apply the ACL to the endpoint.
-func (d *Debug) aclHandler(h http.Handler) http.Handler {
-	if d.acl == nil {
+func (d *Debug) aclHandler(acl whitelist.ACL, h http.Handler) http.Handler {
+	if acl == nil {
 		return h
 	}
 
 	var err error
-	h, err = whitelist.NewHandler(h, http.HandlerFunc(forbidden), d.acl)
+	h, err = whitelist.NewHandlerWithLookup(h, http.HandlerFunc(forbidden), acl, d.lookup)
 	if err != nil {
-		// whitelist.NewHandler only returns an error if
+		// whitelist.NewHandlerWithLookup only returns an error if
 		// either the first or third arguments are nil.
-		panic("debug: whitelist.NewHandler should never error")
+		panic("debug: whitelist.NewHandlerWithLookup should never error")
 	}
 	return h
 }
 
-// aclEndpoint will apply the ACL to the endpoint.
-func (d *Debug) aclHandlerFunc(f func(http.ResponseWriter, *http.Request)) http.Handler {
-	return d.aclHandler(http.HandlerFunc(f))
+// authHandler will apply the authenticator to the endpoint.
+func (d *Debug) authHandler(a auth.Authenticator, h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	// The request is marked as denied until the authenticator
+	// permits it.
+	h = auth.Handler(a, auditPrincipal(h))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auditDenied(req)
+		h.ServeHTTP(w, req)
+	})
 }
 
 // timeout applies a timeout handler to the handler.
-func (d *Debug) timeout(h http.Handler) http.Handler {
-	if d.timeo == 0 {
+func (d *Debug) timeout(timeout time.Duration, h http.Handler) http.Handler {
+	if timeout <= 0 {
 		return h
 	}
 
-	return http.TimeoutHandler(h, d.timeo, http.StatusText(http.StatusRequestTimeout))
-}
-
-// setupHandler applies any ACL and timeout handlers to the given http.Handler.
-func (d *Debug) setupHandler(f func(http.ResponseWriter, *http.Request)) http.Handler {
-	handler := d.aclHandlerFunc(f)
-	return d.timeout(handler)
+	return http.TimeoutHandler(h, timeout, http.StatusText(http.StatusRequestTimeout))
 }
 
-// Register sets up the internal multiplexer.
+// Register sets up the built-in endpoints.
 func (d *Debug) Register() {
 	if d.setup {
 		return
@@ -118,10 +190,12 @@ func (d *Debug) Register() {
 		d.traceSetup()
 	}
 
-	for pat, h := range d.endpoints {
-		d.mux.Handle(pat, h)
+	if d.auditRing != nil {
+		d.handle(d.prefix+"audit", Sensitive, "Recent audit records.", d.wrapHandler(Sensitive, d.auditRing))
 	}
 
+	d.handle(d.prefix, ReadOnly, "This index of the debug endpoints.", d.wrapHandler(ReadOnly, http.HandlerFunc(d.index)))
+
 	d.setup = true
 }
 
@@ -132,13 +206,18 @@ func (d *Debug) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	d.mux.ServeHTTP(w, r)
+	if d.audit != nil {
+		d.auditRequest(w, r, d.router)
+		return
+	}
+
+	d.router.ServeHTTP(w, r)
 }
 
 // SetAdminACL allows an ACL to be applied to the Debug.
 func (d *Debug) SetAdminACL(acl whitelist.ACL) {
 	d.admin = func(req *http.Request) bool {
-		reqIP, err := whitelist.HTTPRequestLookup(req)
+		reqIP, err := d.lookup(req)
 		if err != nil {
 			return false
 		}
@@ -153,30 +232,75 @@ func (d *Debug) SetAdmin(auth func(req *http.Request) bool) {
 
 // LocalAdmin permits viewing sensitive traces from localhost.
 func (d *Debug) LocalAdmin() {
-	localhost := whitelist.NewBasic()
-	localhost.Add(net.ParseIP("127.0.0.1"))
-	localhost.Add(net.ParseIP("::1"))
-	d.SetAdminACL(localhost)
+	d.SetAdminACL(localhostACL())
+}
+
+// Prefix returns the path prefix under which the endpoints are served.
+func (d *Debug) Prefix() string {
+	return d.prefix
+}
+
+// handle registers the handler, which already has the class's policy
+// applied, as an endpoint.
+func (d *Debug) handle(pat string, class Class, description string, h http.Handler) {
+	d.router.handle(pat, route{
+		class:       class,
+		description: description,
+		handler:     h,
+	})
 }
 
-// Handle registers a new handler. Note that only patterns under
-// "/debug/" will actually be handled.
+// Handle registers a new handler, replacing any handler already
+// registered for the pattern. Note that only patterns under the
+// Debug's prefix will actually be handled.
 func (d *Debug) Handle(pat string, h http.Handler) {
-	handler := d.aclHandler(h)
-	d.mux.Handle(pat, d.timeout(handler))
+	d.HandleClass(pat, ReadOnly, h)
+}
+
+// HandleClass registers a new handler as an endpoint of the given
+// class, replacing any handler already registered for the pattern.
+// Note that only patterns under the Debug's prefix will actually be
+// handled.
+func (d *Debug) HandleClass(pat string, class Class, h http.Handler) {
+	d.handle(pat, class, "", d.wrapHandler(class, h))
 }
 
 // HandleFunc registers a new handler function. Note that only
-// patterns under "/debug/" will actually be handled.
+// patterns under the Debug's prefix will actually be handled.
 func (d *Debug) HandleFunc(pat string, f func(http.ResponseWriter, *http.Request)) {
-	h := d.setupHandler(f)
-	d.mux.Handle(pat, h)
+	d.HandleClass(pat, ReadOnly, http.HandlerFunc(f))
 }
 
-// AddProfile registers a new profile endpoint for pprof.
+// AddProfile registers a new profile endpoint for pprof under the
+// prefix's pprof/ path.
 func (d *Debug) AddProfile(name string) {
-	d.endpoints[name] = pprof.Handler(name)
-	if d.setup {
-		d.mux.Handle("/debug/pprof/"+name, d.endpoints[name])
-	}
+	pat := d.prefix + "pprof/" + name
+	desc := "The " + name + " profile."
+	d.handle(pat, Expensive, desc, d.wrapHandler(Expensive, pprof.Handler(name)))
+}
+
+// Replace replaces the handler for an already registered pattern,
+// keeping its class; it returns false if the pattern isn't
+// registered.
+func (d *Debug) Replace(pat string, h http.Handler) bool {
+	return d.router.replace(pat, func(class Class) http.Handler {
+		return d.wrapHandler(class, h)
+	})
+}
+
+// Describe sets the description of a registered pattern shown in the
+// index; it returns false if the pattern isn't registered.
+func (d *Debug) Describe(pat, description string) bool {
+	return d.router.describe(pat, description)
+}
+
+// Unregister removes the endpoint registered for the pattern,
+// returning false if the pattern isn't registered.
+func (d *Debug) Unregister(pat string) bool {
+	return d.router.remove(pat)
+}
+
+// Patterns returns the registered patterns in sorted order.
+func (d *Debug) Patterns() []string {
+	return d.router.patterns()
 }
@@ -1,15 +1,22 @@
 package debug
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime/pprof"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/kisom/httpdebug/audit"
+	"github.com/kisom/httpdebug/auth"
+
 	// The use of the other whitelist package is intended: it
 	// verifies compatibility with the other package.
 	"github.com/kisom/whitelist"
@@ -79,7 +86,7 @@ func TestNilHandlerACL(t *testing.T) {
 	debug := NewLocalhost(0, false, false)
 
 	// This should panic.
-	_ = debug.aclHandler(nil)
+	_ = debug.aclHandler(debug.acl, nil)
 }
 
 func testLoggingAuth(req *http.Request) bool {
@@ -202,3 +209,986 @@ func TestAddProfile(t *testing.T) {
 		t.Fatalf("%s", err)
 	}
 }
+
+// TestTraceOpen verifies that the trace endpoints are reachable when
+// no ACL has been set.
+func TestTraceOpen(t *testing.T) {
+	debug := New(nil, DefaultAdminAuth, 0, true, false)
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	err := testEndpoint(srv.URL+"/debug/requests", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv.URL+"/debug/events", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv.URL+"/debug/metrics", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv.URL+"/debug/snapshot", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+// TestOptions verifies that options are applied, and that the admin
+// authenticator passed to New is honoured.
+func TestOptions(t *testing.T) {
+	debug := NewWithOptions(WithPprof(false), WithTrace(false), WithTimeout(time.Second))
+	if debug.enpprof || debug.entrace {
+		t.Fatal("debug: pprof and trace should be disabled")
+	}
+
+	if debug.timeo != time.Second {
+		t.Fatalf("debug: expected a timeout of %s, but have %s", time.Second, debug.timeo)
+	}
+
+	if debug.acl == nil {
+		t.Fatal("debug: the default ACL should be restricted to localhost")
+	}
+
+	debug = NewWithOptions(WithACL(nil), WithAdmin(nil))
+	if debug.acl != nil {
+		t.Fatal("debug: WithACL(nil) should remove the ACL")
+	}
+
+	if debug.admin == nil {
+		t.Fatal("debug: WithAdmin(nil) should use the default authenticator")
+	}
+
+	called := false
+	debug = New(nil, func(*http.Request) bool {
+		called = true
+		return true
+	}, 0, false, false)
+	if !debug.admin(nil) || !called {
+		t.Fatal("debug: the admin authenticator passed to New was ignored")
+	}
+}
+
+// TestPrefix verifies that the endpoints are served under a custom
+// prefix.
+func TestPrefix(t *testing.T) {
+	debug := NewWithOptions(WithPrefix("_internal/debug"))
+	if debug.Prefix() != "/_internal/debug/" {
+		t.Fatalf("debug: expected the prefix /_internal/debug/, but have %s", debug.Prefix())
+	}
+
+	p := pprof.NewProfile("pkg/prefix")
+	p.Add("first dump", 0)
+	debug.AddProfile("pkg/prefix")
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/_internal/debug/pprof/",
+		"/_internal/debug/pprof/heap",
+		"/_internal/debug/pprof/pkg/prefix",
+		"/_internal/debug/requests",
+		"/_internal/debug/events",
+	} {
+		err := testEndpoint(srv.URL+path, http.StatusOK)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	err := testEndpoint(srv.URL+"/debug/pprof/", http.StatusNotFound)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	resp, err := http.Get(srv.URL + "/_internal/debug/pprof/")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(string(body), `href="/_internal/debug/pprof/goroutine?debug=2"`) {
+		t.Fatal("debug: pprof index links don't respect the prefix")
+	}
+}
+
+// TestTrustedProxies verifies that forwarding headers are honoured
+// for requests from trusted proxies.
+func TestTrustedProxies(t *testing.T) {
+	acl := whitelist.NewBasic()
+	acl.Add(net.ParseIP("1.2.3.4"))
+
+	proxies := whitelist.NewBasic()
+	proxies.Add(net.ParseIP("127.0.0.1"))
+	proxies.Add(net.ParseIP("::1"))
+
+	debug := NewWithOptions(WithACL(acl), WithTrustedProxies(proxies, "X-Forwarded-For"))
+	debug.HandleFunc("/debug/ok", okDebugResponse)
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	err := testEndpoint(srv.URL+"/debug/ok", http.StatusForbidden)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, path := range []string{"/debug/ok", "/debug/requests"} {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("X-Real-IP", "127.0.0.1")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("debug: expected a forwarded request to %s to return %d, but got %d",
+				path, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// Only the configured header is trusted.
+	req, err := http.NewRequest("GET", srv.URL+"/debug/ok", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("debug: expected a request with X-Real-IP to return %d, but got %d",
+			http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+// TestAuthenticator verifies that the authenticator is applied to
+// every endpoint.
+func TestAuthenticator(t *testing.T) {
+	tokens := auth.NewTokens()
+	tokens.Add("ops", "secret")
+
+	debug := NewWithOptions(WithAuthenticator(tokens))
+	debug.HandleFunc("/debug/ok", okDebugResponse)
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	for _, path := range []string{"/debug/ok", "/debug/pprof/", "/debug/requests"} {
+		err := testEndpoint(srv.URL+path, http.StatusUnauthorized)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("debug: expected an authenticated request to %s to return %d, but got %d",
+				path, http.StatusOK, resp.StatusCode)
+		}
+	}
+}
+
+// TestPolicies verifies that class and path policies are applied.
+func TestPolicies(t *testing.T) {
+	remote := whitelist.NewBasic()
+	remote.Add(net.ParseIP("1.2.3.4"))
+
+	tokens := auth.NewTokens()
+	tokens.Add("ops", "secret")
+
+	debug := NewWithOptions(
+		WithACL(nil),
+		WithClassPolicy(Sensitive, Policy{ACL: remote}),
+		WithClassPolicy(Expensive, Policy{Authenticator: tokens}),
+		WithPathPolicy("/debug/pprof/goroutine", Policy{ACL: localhostACL()}),
+		WithPathPolicy("/debug/pprof/go", Policy{ACL: remote}),
+	)
+	debug.HandleClass("/debug/secret", Sensitive, http.HandlerFunc(okDebugResponse))
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/debug/requests", http.StatusOK},
+		{"/debug/pprof/", http.StatusOK},
+		{"/debug/pprof/symbol", http.StatusOK},
+		{"/debug/pprof/cmdline", http.StatusForbidden},
+		{"/debug/secret", http.StatusForbidden},
+		{"/debug/pprof/heap", http.StatusUnauthorized},
+		{"/debug/pprof/profile?seconds=1", http.StatusUnauthorized},
+		// The longest path policy wins, and inherits the
+		// authenticator from the class policy.
+		{"/debug/pprof/goroutine", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		err := testEndpoint(srv.URL+tc.path, tc.status)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/debug/pprof/goroutine", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("debug: expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+// TestPolicyHandler verifies that the handler for each policy is
+// built once, rather than for every request.
+func TestPolicyHandler(t *testing.T) {
+	debug := NewWithOptions(
+		WithACL(nil),
+		WithTimeout(time.Second),
+		WithPathPolicy("/debug/slow", Policy{Timeout: time.Minute}),
+	)
+
+	var built int
+	h := debug.policyHandler(ReadOnly, nil, func(p Policy) http.Handler {
+		built++
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(p.Timeout.String()))
+		})
+	})
+
+	testCases := []struct {
+		path    string
+		timeout string
+	}{
+		{"/debug/fast", "1s"},
+		{"/debug/slow", "1m0s"},
+		{"/debug/fast", "1s"},
+		{"/debug/slow/leaf", "1m0s"},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Body.String() != tc.timeout {
+			t.Fatalf("debug: expected %s to have a timeout of %s, but have %s",
+				tc.path, tc.timeout, w.Body.String())
+		}
+	}
+
+	if built != 2 {
+		t.Fatalf("debug: expected 2 handlers to be built, but %d were", built)
+	}
+}
+
+// remoteLookup reports that every request comes from 1.2.3.4.
+func remoteLookup(*http.Request) (net.IP, error) {
+	return net.ParseIP("1.2.3.4"), nil
+}
+
+// TestDefaultPolicies verifies that the sensitive endpoints stay
+// restricted to localhost when the ACL is widened, and that the
+// number of expensive requests is limited by default.
+func TestDefaultPolicies(t *testing.T) {
+	debug := NewWithOptions(WithACL(nil), WithLookup(remoteLookup))
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/debug/requests", http.StatusOK},
+		{"/debug/pprof/heap", http.StatusOK},
+		{"/debug/pprof/cmdline", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		err := testEndpoint(srv.URL+tc.path, tc.status)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if debug.expensive == nil || cap(debug.expensive.slots) != DefaultMaxExpensive {
+		t.Fatalf("debug: expected at most %d expensive requests by default", DefaultMaxExpensive)
+	}
+
+	// Replacing the class policy opens the sensitive endpoints to
+	// the Debug's ACL.
+	debug = NewWithOptions(
+		WithACL(nil),
+		WithLookup(remoteLookup),
+		WithClassPolicy(Sensitive, Policy{}),
+		WithMaxExpensive(0),
+	)
+	debug.Register()
+
+	srv2 := httptest.NewServer(debug)
+	defer srv2.Close()
+
+	err := testEndpoint(srv2.URL+"/debug/pprof/cmdline", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if debug.expensive != nil {
+		t.Fatal("debug: expected WithMaxExpensive(0) to remove the limit on expensive requests")
+	}
+}
+
+// TestAudit verifies that requests are audited.
+func TestAudit(t *testing.T) {
+	tokens := auth.NewTokens()
+	tokens.Add("ops", "secret")
+
+	ring := audit.NewRing(10)
+	debug := NewWithOptions(
+		WithAuditRing(ring),
+		WithClassPolicy(Sensitive, Policy{Authenticator: tokens}),
+	)
+	debug.HandleFunc("/debug/ok", okDebugResponse)
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	err := testEndpoint(srv.URL+"/debug/ok?x=1", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = testEndpoint(srv.URL+"/debug/audit", http.StatusUnauthorized)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/debug/audit", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+
+	recs := ring.Records()
+	if len(recs) != 3 {
+		t.Fatalf("debug: expected 3 audit records, have %d", len(recs))
+	}
+
+	ok, denied, authed := recs[2], recs[1], recs[0]
+	if ok.Path != "/debug/ok" || ok.Query != "x=1" || ok.Status != http.StatusOK || ok.Bytes != 3 || ok.Denied {
+		t.Fatalf("debug: unexpected audit record %+v", ok)
+	}
+
+	if ok.ClientIP != "127.0.0.1" && ok.ClientIP != "::1" {
+		t.Fatalf("debug: unexpected client address %s", ok.ClientIP)
+	}
+
+	if !denied.Denied || denied.Status != http.StatusUnauthorized || denied.Principal != "" {
+		t.Fatalf("debug: unexpected audit record %+v", denied)
+	}
+
+	if authed.Denied || authed.Status != http.StatusOK || authed.Principal != "ops" {
+		t.Fatalf("debug: unexpected audit record %+v", authed)
+	}
+
+	acl := whitelist.NewBasic()
+	acl.Add(net.ParseIP("1.2.3.4"))
+	ring = audit.NewRing(1)
+	debug = NewWithOptions(WithACL(acl), WithAudit(ring))
+	debug.Register()
+
+	srv2 := httptest.NewServer(debug)
+	defer srv2.Close()
+
+	err = testEndpoint(srv2.URL+"/debug/requests", http.StatusForbidden)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	recs = ring.Records()
+	if len(recs) != 1 || !recs[0].Denied || recs[0].Status != http.StatusForbidden {
+		t.Fatalf("debug: unexpected audit records %+v", recs)
+	}
+}
+
+func timedGet(t *testing.T, url string) (*http.Response, []byte, time.Duration) {
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return resp, body, time.Since(start)
+}
+
+// TestCaptureTimeout verifies that the capture endpoints aren't
+// subject to the ordinary timeout, and that capture durations are
+// limited.
+func TestCaptureTimeout(t *testing.T) {
+	debug := NewWithOptions(
+		WithTimeout(100*time.Millisecond),
+		WithMaxCapture(time.Second),
+		WithCaptureGrace(time.Second),
+	)
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	resp, body, elapsed := timedGet(t, srv.URL+"/debug/pprof/trace?seconds=0.5")
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Fatalf("debug: expected an execution trace, but got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	if elapsed < 500*time.Millisecond {
+		t.Fatalf("debug: the execution trace finished early, after %s", elapsed)
+	}
+
+	resp, body, elapsed = timedGet(t, srv.URL+"/debug/pprof/profile?seconds=30")
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Fatalf("debug: expected a CPU profile, but got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	if elapsed > 10*time.Second {
+		t.Fatalf("debug: the CPU profile wasn't limited to the maximum capture duration (took %s)", elapsed)
+	}
+}
+
+// TestCaptureDuration verifies that capture timeouts use the
+// duration the capture endpoint will actually capture for, and that
+// the maximum capture is rounded up to whole seconds.
+func TestCaptureDuration(t *testing.T) {
+	debug := NewWithOptions(WithMaxCapture(500 * time.Millisecond))
+	if debug.maxCap != time.Second {
+		t.Fatalf("debug: expected the maximum capture to be rounded up to 1s, but have %s", debug.maxCap)
+	}
+
+	debug = NewWithOptions(WithCaptureGrace(time.Second), WithMaxCapture(time.Minute))
+	testCases := []struct {
+		endpoint string
+		query    string
+		timeout  time.Duration
+	}{
+		// The CPU profile only captures for whole seconds,
+		// falling back to 30 seconds.
+		{"pprof/profile", "seconds=2", 3 * time.Second},
+		{"pprof/profile", "seconds=0.5", 31 * time.Second},
+		{"pprof/profile", "seconds=garbage", 31 * time.Second},
+		{"pprof/profile", "seconds=300", 61 * time.Second},
+		// The execution trace may capture for fractions of a
+		// second, falling back to 1 second.
+		{"pprof/trace", "seconds=0.5", 1500 * time.Millisecond},
+		{"pprof/trace", "seconds=garbage", 2 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		var timeout time.Duration
+		h := debug.captureHandler(pprofEndpoints[tc.endpoint].capture,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ := r.Context().Deadline()
+				timeout = time.Until(deadline)
+			}))
+
+		req := httptest.NewRequest("GET", "/debug/"+tc.endpoint+"?"+tc.query, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if timeout > tc.timeout || timeout < tc.timeout-time.Second {
+			t.Fatalf("debug: expected a timeout of %s for %s?%s, but have %s",
+				tc.timeout, tc.endpoint, tc.query, timeout)
+		}
+	}
+}
+
+// blockingHandler returns a handler that signals on started and
+// blocks until release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		okDebugResponse(w, r)
+	})
+}
+
+// TestAdmission verifies that the admission controller limits
+// requests.
+func TestAdmission(t *testing.T) {
+	debug := NewWithOptions(WithRateLimit(0.001, 2))
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/debug/pprof/heap", http.StatusOK},
+		{"/debug/pprof/symbol", http.StatusOK},
+		{"/debug/pprof/goroutine", http.StatusOK},
+		{"/debug/pprof/heap", http.StatusTooManyRequests},
+		// Only expensive endpoints are rate limited.
+		{"/debug/pprof/symbol", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		err := testEndpoint(srv.URL+tc.path, tc.status)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/debug/pprof/heap")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("debug: expected a Retry-After header on a rate limited request")
+	}
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	debug = NewWithOptions(
+		WithConcurrencyLimit("/debug/block", 1, false),
+		WithMaxExpensive(1),
+	)
+	debug.HandleClass("/debug/block", ReadOnly, blockingHandler(started, release))
+	debug.HandleClass("/debug/capture", Expensive, blockingHandler(started, release))
+	debug.Register()
+
+	srv2 := httptest.NewServer(debug)
+	defer srv2.Close()
+
+	for _, path := range []string{"/debug/block", "/debug/capture"} {
+		done := make(chan error, 1)
+		go func(path string) {
+			done <- testEndpoint(srv2.URL+path, http.StatusOK)
+		}(path)
+		<-started
+
+		err = testEndpoint(srv2.URL+path, http.StatusTooManyRequests)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if path == "/debug/capture" {
+			// The global limit applies to every expensive
+			// endpoint.
+			err = testEndpoint(srv2.URL+"/debug/pprof/heap", http.StatusTooManyRequests)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+
+		release <- struct{}{}
+		if err = <-done; err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+// TestConcurrentCaptures verifies that concurrent captures of the
+// same kind are serialised rather than failing, within a Debug and
+// across Debugs.
+func TestConcurrentCaptures(t *testing.T) {
+	var urls []string
+	for i := 0; i < 2; i++ {
+		debug := NewWithOptions()
+		debug.Register()
+
+		srv := httptest.NewServer(debug)
+		defer srv.Close()
+		urls = append(urls, srv.URL, srv.URL)
+	}
+
+	done := make(chan error, len(urls))
+	for _, url := range urls {
+		go func(url string) {
+			done <- testEndpoint(url+"/debug/pprof/trace?seconds=0.2", http.StatusOK)
+		}(url)
+	}
+
+	for range urls {
+		if err := <-done; err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+// TestQueuedCaptures verifies that captures waiting their turn don't
+// hold the slots for expensive requests.
+func TestQueuedCaptures(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	serial := newLimiter(1, true)
+
+	debug := NewWithOptions(WithMaxExpensive(2))
+	capture := func(*http.Request) time.Duration { return time.Second }
+	debug.handle("/debug/capture", Expensive, "",
+		debug.wrapCapture(Expensive, capture, serial, blockingHandler(started, release)))
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- testEndpoint(srv.URL+"/debug/capture", http.StatusOK)
+		}()
+	}
+	<-started
+
+	// Give the second capture time to start waiting.
+	time.Sleep(100 * time.Millisecond)
+	err := testEndpoint(srv.URL+"/debug/pprof/heap", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+// textHandler returns a handler that writes the given text.
+func textHandler(text string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(text))
+	})
+}
+
+// testBody verifies that the URL returns the expected body.
+func testBody(url, expected string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if string(body) != expected {
+		return fmt.Errorf("debug: expected %s to return '%s', but got '%s'",
+			resp.Request.URL.Path, expected, body)
+	}
+	return nil
+}
+
+// TestRouter verifies that endpoints may be replaced and removed.
+func TestRouter(t *testing.T) {
+	debug := NewWithOptions(WithTrace(false))
+	debug.Register()
+
+	// Registering a pattern twice replaces the first handler
+	// rather than panicking.
+	debug.Handle("/debug/plugin", textHandler("first"))
+	debug.Handle("/debug/plugin", textHandler("second"))
+	debug.Handle("/debug/tree/", textHandler("tree"))
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	if err := testBody(srv.URL+"/debug/plugin", "second"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !debug.Replace("/debug/plugin", textHandler("third")) {
+		t.Fatal("debug: failed to replace a registered endpoint")
+	}
+
+	if err := testBody(srv.URL+"/debug/plugin", "third"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if debug.Replace("/debug/missing", textHandler("missing")) {
+		t.Fatal("debug: replaced an endpoint that wasn't registered")
+	}
+
+	// The subtree is matched, and its root is redirected to.
+	testCases := []string{"/debug/tree/leaf", "/debug/tree", "/debug/./tree/"}
+	for _, path := range testCases {
+		if err := testBody(srv.URL+path, "tree"); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// Unclean paths are redirected to their canonical form.
+	err := testEndpoint(srv.URL+"/debug/tree/../pprof/cmdline", http.StatusOK)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, pat := range []string{"/debug/plugin", "/debug/pprof/symbol"} {
+		if !debug.Unregister(pat) {
+			t.Fatalf("debug: failed to unregister %s", pat)
+		}
+
+		if err = testEndpoint(srv.URL+pat, http.StatusNotFound); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if debug.Unregister("/debug/plugin") {
+		t.Fatal("debug: unregistered an endpoint twice")
+	}
+
+	patterns := debug.Patterns()
+	expected := []string{
+		"/debug/",
+		"/debug/pprof",
+		"/debug/pprof/",
+		"/debug/pprof/cmdline",
+		"/debug/pprof/profile",
+		"/debug/pprof/trace",
+		"/debug/tree/",
+	}
+	if strings.Join(patterns, " ") != strings.Join(expected, " ") {
+		t.Fatalf("debug: expected patterns %v, but have %v", expected, patterns)
+	}
+}
+
+// TestConcurrentRegistration verifies that endpoints may be
+// registered and removed while requests are being served.
+func TestConcurrentRegistration(t *testing.T) {
+	debug := NewWithOptions()
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			debug.Handle("/debug/plugin", textHandler("plugin"))
+			debug.Unregister("/debug/plugin")
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		resp, err := http.Get(srv.URL + "/debug/plugin")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("debug: unexpected status %d", resp.StatusCode)
+		}
+	}
+	<-done
+}
+
+// TestIndex verifies that the index lists the registered endpoints.
+func TestIndex(t *testing.T) {
+	tokens := auth.NewTokens()
+	tokens.Add("ops", "secret")
+
+	debug := NewWithOptions(
+		WithClassPolicy(Expensive, Policy{Authenticator: tokens}),
+	)
+	debug.Handle("/debug/plugin", http.HandlerFunc(okDebugResponse))
+	debug.Register()
+
+	if !debug.Describe("/debug/plugin", "A plugin.") {
+		t.Fatal("debug: failed to describe a registered endpoint")
+	}
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	for _, path := range []string{"/debug/missing", "/debug/missing/leaf"} {
+		if err := testEndpoint(srv.URL+path, http.StatusNotFound); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/debug/")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(string(body), "/debug/pprof/profile") {
+		t.Fatalf("debug: the index doesn't list the CPU profile:\n%s", body)
+	}
+
+	resp, err = http.Get(srv.URL + "/debug/?format=json")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var entries []indexEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	index := map[string]indexEntry{}
+	for _, entry := range entries {
+		index[entry.Path] = entry
+	}
+
+	testCases := []indexEntry{
+		{"/debug/plugin", "A plugin.", "read-only", true},
+		{"/debug/pprof/symbol", pprofEndpoints["pprof/symbol"].description, "read-only", true},
+		{"/debug/pprof/profile", pprofEndpoints["pprof/profile"].description, "expensive", false},
+		{"/debug/pprof/cmdline", pprofEndpoints["pprof/cmdline"].description, "sensitive", true},
+	}
+
+	for _, tc := range testCases {
+		if index[tc.Path] != tc {
+			t.Fatalf("debug: expected %+v in the index, but have %+v", tc, index[tc.Path])
+		}
+	}
+}
+
+// countingAuth accepts every request, counting them.
+type countingAuth struct {
+	calls int32
+}
+
+func (ca *countingAuth) Authenticate(req *http.Request) (string, bool) {
+	atomic.AddInt32(&ca.calls, 1)
+	return "ops", true
+}
+
+// TestIndexAuthentication verifies that the index authenticates a
+// request once per authenticator, rather than once per endpoint.
+func TestIndexAuthentication(t *testing.T) {
+	ca := &countingAuth{}
+	debug := NewWithOptions(WithAuthenticator(ca))
+	debug.Register()
+
+	srv := httptest.NewServer(debug)
+	defer srv.Close()
+
+	if err := testEndpoint(srv.URL+"/debug/", http.StatusOK); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Once to serve the index, and once for its endpoints.
+	if calls := atomic.LoadInt32(&ca.calls); calls != 2 {
+		t.Fatalf("debug: expected the index to authenticate twice, but it authenticated %d times", calls)
+	}
+
+	ar := authResults{}
+	req := httptest.NewRequest("GET", "/debug/", nil)
+	all := auth.All(ca)
+	f := auth.AuthenticatorFunc(ca.Authenticate)
+	for i := 0; i < 2; i++ {
+		ar.authenticate(all, req)
+		ar.authenticate(f, req)
+	}
+
+	// Functions can't be compared, so they're always called.
+	if calls := atomic.LoadInt32(&ca.calls); calls != 5 {
+		t.Fatalf("debug: expected 5 calls to the authenticator, but have %d", calls)
+	}
+
+	// Nor can maps, which mustn't be used as keys.
+	ma := mapAuth{"secret": "ops"}
+	debug = NewWithOptions(WithAuthenticator(ma))
+	debug.Register()
+
+	srv2 := httptest.NewServer(debug)
+	defer srv2.Close()
+
+	req, err := http.NewRequest("GET", srv2.URL+"/debug/", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("debug: expected the index to return %d with a map authenticator, but got %d",
+			http.StatusOK, resp.StatusCode)
+	}
+}
+
+// mapAuth maps bearer tokens to principals.
+type mapAuth map[string]string
+
+func (ma mapAuth) Authenticate(req *http.Request) (string, bool) {
+	principal, ok := ma[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+	return principal, ok
+}
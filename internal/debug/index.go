@@ -0,0 +1,156 @@
+package debug
+
+// index.go contains the index of the registered endpoints, served at
+// the Debug's prefix.
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kisom/httpdebug/auth"
+)
+
+// indexEntry describes an endpoint in the index.
+type indexEntry struct {
+	Path        string `json:"path"`
+	Description string `json:"description,omitempty"`
+	Class       string `json:"class"`
+	Permitted   bool   `json:"permitted"`
+}
+
+// authResults remembers whether each authenticator accepted a
+// request, so that the index authenticates the request once per
+// authenticator rather than once per endpoint; authenticators such
+// as auth.Basic are deliberately slow.
+type authResults map[auth.Authenticator]bool
+
+// authenticate returns true if a accepts the request. Only
+// authenticators of comparable types, such as the pointers returned
+// by the auth package, can be remembered; others, such as
+// auth.AuthenticatorFunc closures, are called every time.
+func (ar authResults) authenticate(a auth.Authenticator, req *http.Request) bool {
+	cacheable := reflect.TypeOf(a).Comparable()
+	if cacheable {
+		if ok, seen := ar[a]; seen {
+			return ok
+		}
+	}
+
+	_, ok := a.Authenticate(req)
+	if cacheable {
+		ar[a] = ok
+	}
+	return ok
+}
+
+// permitted returns true if the request would pass the ACL and
+// authenticator in the policy for an endpoint. The admission
+// controller isn't consulted.
+func (d *Debug) permitted(req *http.Request, pat string, class Class, ar authResults) bool {
+	p := d.policy(pat, class)
+	if p.ACL != nil {
+		ip, err := d.lookup(req)
+		if err != nil || !p.ACL.Permitted(ip) {
+			return false
+		}
+	}
+
+	if p.Authenticator != nil && !ar.authenticate(p.Authenticator, req) {
+		return false
+	}
+
+	return true
+}
+
+// wantsJSON returns true if the client asked for JSON, either with
+// the format parameter or the Accept header.
+func wantsJSON(req *http.Request) bool {
+	if req.FormValue("format") == "json" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// index lists the registered endpoints and whether the client may
+// access them. It is registered at the prefix, which also matches
+// any path that isn't otherwise handled, so those paths are not
+// found.
+func (d *Debug) index(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != d.prefix {
+		http.NotFound(w, req)
+		return
+	}
+
+	routes := d.router.entries()
+	entries := make([]indexEntry, 0, len(routes))
+	ar := authResults{}
+	for pat, r := range routes {
+		entries = append(entries, indexEntry{
+			Path:        pat,
+			Description: r.description,
+			Class:       r.class.String(),
+			Permitted:   d.permitted(req, pat, r.class, ar),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Printf("debug: failed to write the index: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := &struct {
+		Path      string
+		Endpoints []indexEntry
+	}{
+		Path:      req.URL.Path,
+		Endpoints: entries,
+	}
+	if err := indexTmpl.Execute(w, data); err != nil {
+		log.Printf("debug: failed executing template: %v", err)
+	}
+}
+
+var indexTmpl = template.Must(template.New("index").Parse(`<html>
+<head>
+<title>{{.Path}}</title>
+<style type="text/css">
+	body {
+		font-family: sans-serif;
+	}
+	table#endpoints td {
+		padding: 0 0.5em;
+	}
+	table#endpoints tr.denied {
+		color: #888;
+	}
+</style>
+</head>
+<body>
+<h1>{{.Path}}</h1>
+<table id="endpoints">
+	<tr><th>Endpoint</th><th>Class</th><th>Permitted</th><th>Description</th></tr>
+	{{range .Endpoints}}
+	<tr{{if not .Permitted}} class="denied"{{end}}>
+		<td><a href="{{.Path}}">{{.Path}}</a></td>
+		<td>{{.Class}}</td>
+		<td>{{if .Permitted}}yes{{else}}no{{end}}</td>
+		<td>{{.Description}}</td>
+	</tr>
+	{{end}}
+</table>
+</body>
+</html>
+`))
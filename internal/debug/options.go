@@ -0,0 +1,228 @@
+package debug
+
+// options.go contains the functional options used to configure a
+// Debug.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kisom/httpdebug/audit"
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/whitelist"
+)
+
+// An Option configures a Debug during construction.
+type Option func(*Debug)
+
+// WithACL restricts all requests to the given whitelist. A nil ACL
+// permits requests from any address.
+func WithACL(acl whitelist.ACL) Option {
+	return func(d *Debug) {
+		d.acl = acl
+	}
+}
+
+// WithLocalhost restricts all requests to localhost. This is the
+// default.
+func WithLocalhost() Option {
+	return WithACL(localhostACL())
+}
+
+// WithAuthenticator requires every request to be authenticated by a,
+// in addition to being permitted by the ACL. To permit requests that
+// satisfy either the ACL or a, use WithACL(nil) with an authenticator
+// built with auth.Any and auth.ACL.
+func WithAuthenticator(a auth.Authenticator) Option {
+	return func(d *Debug) {
+		d.auth = a
+	}
+}
+
+// WithLookup sets the function used to determine a request's client
+// address for the ACL, the admin ACL, and the trace endpoints. If
+// lookup is nil, whitelist.HTTPRequestLookup is used; this is the
+// default.
+func WithLookup(lookup whitelist.LookupFunc) Option {
+	return func(d *Debug) {
+		if lookup == nil {
+			lookup = whitelist.HTTPRequestLookup
+		}
+		d.lookup = lookup
+	}
+}
+
+// WithTrustedProxies honours the given forwarding header (e.g.
+// whitelist.HeaderXForwardedFor) on requests arriving from the
+// proxies in the given whitelist when determining the client
+// address. Only the header the proxies set should be given; see
+// whitelist.ProxyLookup.
+func WithTrustedProxies(proxies whitelist.ACL, header string) Option {
+	return WithLookup(whitelist.NewProxyLookup(proxies, header).Lookup)
+}
+
+// WithAdmin sets the admin authenticator, which controls access to
+// sensitive traces. If admin is nil, DefaultAdminAuth is used.
+func WithAdmin(admin func(*http.Request) bool) Option {
+	return func(d *Debug) {
+		if admin == nil {
+			admin = DefaultAdminAuth
+		}
+		d.admin = admin
+	}
+}
+
+// WithAdminACL permits viewing sensitive traces from addresses in
+// the given whitelist.
+func WithAdminACL(acl whitelist.ACL) Option {
+	return func(d *Debug) {
+		d.SetAdminACL(acl)
+	}
+}
+
+// WithTimeout applies a timeout to each request. If timeout is 0,
+// no timeouts will be applied; this is the default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Debug) {
+		d.timeo = timeout
+	}
+}
+
+// WithCaptureGrace sets the time allowed for the CPU profile and
+// execution trace endpoints to finish writing beyond the capture
+// duration requested with their seconds parameter. These endpoints
+// are not subject to the ordinary timeout. The default is
+// DefaultCaptureGrace.
+func WithCaptureGrace(grace time.Duration) Option {
+	return func(d *Debug) {
+		d.grace = grace
+	}
+}
+
+// WithMaxCapture limits the capture duration that may be requested
+// from the CPU profile and execution trace endpoints; longer requests
+// are shortened to max. As the CPU profile endpoint only captures for
+// whole seconds, max is rounded up to a whole number of seconds. If
+// max is 0, captures are not limited. The default is
+// DefaultMaxCapture.
+func WithMaxCapture(max time.Duration) Option {
+	return func(d *Debug) {
+		d.maxCap = wholeSeconds(max)
+	}
+}
+
+// WithPprof controls whether the pprof endpoints are enabled. They
+// are enabled by default.
+func WithPprof(enabled bool) Option {
+	return func(d *Debug) {
+		d.enpprof = enabled
+	}
+}
+
+// WithTrace controls whether the trace endpoints are enabled. They
+// are enabled by default.
+func WithTrace(enabled bool) Option {
+	return func(d *Debug) {
+		d.entrace = enabled
+	}
+}
+
+// WithPrefix sets the path prefix under which the debug endpoints
+// are served; the default is DefaultPrefix. Leading and trailing
+// slashes are added as needed, so "_internal/debug" becomes
+// "/_internal/debug/".
+func WithPrefix(prefix string) Option {
+	return func(d *Debug) {
+		d.prefix = cleanPrefix(prefix)
+	}
+}
+
+// WithClassPolicy applies a policy to every endpoint in the given
+// class, replacing the class's default policy. For example, the
+// expensive endpoints may be restricted to localhost while the
+// read-only endpoints are opened to an internal network. The
+// sensitive endpoints are restricted to localhost by default; a
+// policy without an ACL, such as Policy{}, opens them to the Debug's
+// ACL instead.
+func WithClassPolicy(class Class, p Policy) Option {
+	return func(d *Debug) {
+		d.classPolicies[class] = p
+	}
+}
+
+// WithPathPolicy applies a policy to every request whose path begins
+// with prefix (e.g. "/debug/pprof/heap"). If several path policies
+// match a request, the one with the longest prefix is used; it
+// inherits any unset fields from the policy for the endpoint's class.
+func WithPathPolicy(prefix string, p Policy) Option {
+	return func(d *Debug) {
+		d.pathPolicies = append(d.pathPolicies, pathPolicy{prefix: prefix, policy: p})
+	}
+}
+
+// WithAudit passes a record of every request to the given sinks, in
+// addition to any added previously.
+func WithAudit(sinks ...audit.Sink) Option {
+	return func(d *Debug) {
+		if d.audit != nil {
+			sinks = append([]audit.Sink{d.audit}, sinks...)
+		}
+
+		if len(sinks) == 1 {
+			d.audit = sinks[0]
+		} else {
+			d.audit = audit.Multi(sinks...)
+		}
+	}
+}
+
+// WithAuditRing records every request in the ring, and serves the
+// recorded requests under the prefix's audit path as a sensitive
+// endpoint.
+func WithAuditRing(ring *audit.Ring) Option {
+	return func(d *Debug) {
+		WithAudit(ring)(d)
+		d.auditRing = ring
+	}
+}
+
+// WithConcurrencyLimit permits at most n concurrent requests to paths
+// beginning with prefix (e.g. "/debug/pprof/goroutine"). If queue is
+// true, requests over the limit wait for an earlier request to
+// finish; otherwise, they are rejected with a 429 (Too Many Requests)
+// response. If several limits match a request, the one with the
+// longest prefix is used.
+func WithConcurrencyLimit(prefix string, n int, queue bool) Option {
+	return func(d *Debug) {
+		d.pathLimits = append(d.pathLimits, pathLimiter{
+			prefix: prefix,
+			limit:  newLimiter(n, queue),
+		})
+	}
+}
+
+// WithRateLimit limits each client to rate requests per second to the
+// expensive endpoints, with bursts of up to burst requests, using a
+// token bucket per client address. Requests over the limit are
+// rejected with a 429 (Too Many Requests) response whose Retry-After
+// header indicates when a request will next be permitted.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(d *Debug) {
+		d.rate = newRateLimiter(rate, burst)
+	}
+}
+
+// WithMaxExpensive permits at most n concurrent requests to the
+// expensive endpoints across all clients; requests over the limit are
+// rejected with a 429 (Too Many Requests) response. If n is 0, the
+// number of expensive requests isn't limited. The default is
+// DefaultMaxExpensive.
+func WithMaxExpensive(n int) Option {
+	return func(d *Debug) {
+		if n <= 0 {
+			d.expensive = nil
+			return
+		}
+		d.expensive = newLimiter(n, false)
+	}
+}
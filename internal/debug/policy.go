@@ -0,0 +1,177 @@
+package debug
+
+// policy.go contains support for per-endpoint access policies.
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/whitelist"
+)
+
+// A Class groups endpoints with similar access requirements, so that
+// a single policy may be applied to all of them.
+type Class int
+
+const (
+	// ReadOnly endpoints are cheap to serve and reveal little
+	// about the process: the pprof index and symbol lookup, the
+	// trace pages, and handlers added with Handle or HandleFunc.
+	ReadOnly Class = iota
+
+	// Expensive endpoints capture profiles or execution traces,
+	// which may be costly or slow: the CPU profile, the execution
+	// trace, and every named profile (including those added with
+	// AddProfile).
+	Expensive
+
+	// Sensitive endpoints may leak secrets, such as the command
+	// line served by pprof/cmdline.
+	Sensitive
+)
+
+// String returns the name of the class.
+func (c Class) String() string {
+	switch c {
+	case ReadOnly:
+		return "read-only"
+	case Expensive:
+		return "expensive"
+	case Sensitive:
+		return "sensitive"
+	default:
+		return "unknown"
+	}
+}
+
+// A Policy controls access to a set of endpoints. Any field that is
+// not set is inherited: path policies inherit from the policy for the
+// endpoint's class, which inherits from the Debug's ACL,
+// authenticator, and timeout.
+type Policy struct {
+	// ACL restricts requests to the given whitelist.
+	ACL whitelist.ACL
+
+	// Authenticator, if set, must authenticate every request.
+	Authenticator auth.Authenticator
+
+	// Timeout is applied to each request; a negative timeout
+	// disables the timeout. The CPU profile and execution trace
+	// endpoints instead time out after their capture duration.
+	Timeout time.Duration
+}
+
+// inherit fills in any fields in p that aren't set from parent.
+func (p Policy) inherit(parent Policy) Policy {
+	if p.ACL == nil {
+		p.ACL = parent.ACL
+	}
+
+	if p.Authenticator == nil {
+		p.Authenticator = parent.Authenticator
+	}
+
+	if p.Timeout == 0 {
+		p.Timeout = parent.Timeout
+	}
+
+	return p
+}
+
+// pathPolicy is a policy applied to paths with the given prefix.
+type pathPolicy struct {
+	prefix string
+	policy Policy
+}
+
+// pathPolicy returns the index of the path policy with the longest
+// prefix matching path, or -1 if none match.
+func (d *Debug) pathPolicy(path string) int {
+	longest := -1
+	for i, pp := range d.pathPolicies {
+		if !strings.HasPrefix(path, pp.prefix) {
+			continue
+		}
+
+		if longest == -1 || len(pp.prefix) > len(d.pathPolicies[longest].prefix) {
+			longest = i
+		}
+	}
+	return longest
+}
+
+// resolvePolicy returns the fully resolved policy for an endpoint of
+// the given class under the path policy with index i, or under no
+// path policy if i is -1.
+func (d *Debug) resolvePolicy(class Class, i int) Policy {
+	p := d.classPolicies[class].inherit(Policy{
+		ACL:           d.acl,
+		Authenticator: d.auth,
+		Timeout:       d.timeo,
+	})
+
+	if i >= 0 {
+		p = d.pathPolicies[i].policy.inherit(p)
+	}
+	return p
+}
+
+// policy returns the fully resolved policy for a request to path
+// served by an endpoint of the given class.
+func (d *Debug) policy(path string, class Class) Policy {
+	return d.resolvePolicy(class, d.pathPolicy(path))
+}
+
+// policyHandler applies the policy for each request to the handler
+// returned by inner, which is registered as an endpoint of the given
+// class. The ACL is checked first, so requests from forbidden
+// addresses never reach the authenticator, and only authorised
+// requests are subject to the admission controller, which serialises
+// them with serial if it isn't nil.
+//
+// Policies can't change once the Debug is constructed, so a handler
+// is built up front for each path policy, and for requests matching
+// none; each request is served by the one for its path.
+func (d *Debug) policyHandler(class Class, serial *limiter, inner func(Policy) http.Handler) http.Handler {
+	handlers := make([]http.Handler, len(d.pathPolicies)+1)
+	for i := range handlers {
+		p := d.resolvePolicy(class, i-1)
+
+		handler := d.admissionHandler(class, serial, inner(p))
+		handler = d.authHandler(p.Authenticator, handler)
+		handlers[i] = d.aclHandler(p.ACL, handler)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlers[d.pathPolicy(req.URL.Path)+1].ServeHTTP(w, req)
+	})
+}
+
+// wrapHandler applies the policy for each request, including its
+// timeout, to the given http.Handler.
+func (d *Debug) wrapHandler(class Class, h http.Handler) http.Handler {
+	return d.policyHandler(class, nil, func(p Policy) http.Handler {
+		return d.timeout(p.Timeout, h)
+	})
+}
+
+// wrapCapture applies the policy for each request to the given
+// capture endpoint, which captures for the duration returned by
+// duration. The policy's timeout is replaced by one based on the
+// requested capture duration; see captureHandler. The runtime only
+// supports one capture of each kind at a time, so concurrent requests
+// wait their turn for serial, which is shared by every Debug.
+func (d *Debug) wrapCapture(class Class, duration func(*http.Request) time.Duration, serial *limiter, h http.Handler) http.Handler {
+	capture := d.captureHandler(duration, h)
+	return d.policyHandler(class, serial, func(Policy) http.Handler {
+		return capture
+	})
+}
+
+// setupHandler applies the policy for each request to the given
+// handler function.
+func (d *Debug) setupHandler(class Class, f func(http.ResponseWriter, *http.Request)) http.Handler {
+	return d.wrapHandler(class, http.HandlerFunc(f))
+}
@@ -4,28 +4,71 @@ package debug
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/kisom/httpdebug/pprof"
 )
 
-var pprofEndpoints = map[string]func(http.ResponseWriter, *http.Request){
-	"/debug/pprof":         pprof.Index,
-	"/debug/pprof/":        pprof.Index,
-	"/debug/pprof/*":       pprof.Index,
-	"/debug/pprof/cmdline": pprof.Cmdline,
-	"/debug/pprof/profile": pprof.Profile,
-	"/debug/pprof/symbol":  pprof.Symbol,
-	"/debug/pprof/trace":   pprof.Trace,
+// pprofEndpoint is a pprof endpoint, its access class, and its
+// description. Endpoints that capture for a requested duration have a
+// function returning the duration, parsed exactly as the handler
+// parses it, and the limiter serialising their captures.
+type pprofEndpoint struct {
+	handler     func(http.ResponseWriter, *http.Request)
+	class       Class
+	capture     func(*http.Request) time.Duration
+	serial      *limiter
+	description string
+}
+
+// The runtime supports one CPU profile and one execution trace at a
+// time in the process, so captures of each kind are serialised across
+// every Debug.
+var (
+	cpuProfiles     = newLimiter(1, true)
+	executionTraces = newLimiter(1, true)
+)
+
+// pprofEndpoints contains the pprof endpoints, relative to the
+// Debug's prefix.
+var pprofEndpoints = map[string]pprofEndpoint{
+	"pprof/cmdline": {pprof.Cmdline, Sensitive, nil, nil, "The program's command line."},
+	"pprof/profile": {pprof.Profile, Expensive, pprof.ProfileDuration, cpuProfiles, "A CPU profile for the requested number of seconds."},
+	"pprof/symbol":  {pprof.Symbol, ReadOnly, nil, nil, "Looks up the program counters listed in the request."},
+	"pprof/trace":   {pprof.Trace, Expensive, pprof.TraceDuration, executionTraces, "An execution trace for the requested number of seconds."},
 }
 
 // pprofSetup applies any ACL and timeout constraints on the pprof
-// endpoints, and adds them to list of endpoints to be registered.
+// endpoints, and registers them.
 func (d *Debug) pprofSetup() {
 	if d.setup {
 		return
 	}
 
-	for pat, h := range pprofEndpoints {
-		d.endpoints[pat] = d.setupHandler(h)
+	index := pprof.IndexAt(d.prefix + "pprof/")
+	d.handle(d.prefix+"pprof", ReadOnly, "The pprof index.", d.setupHandler(ReadOnly, index))
+	d.handle(d.prefix+"pprof/", ReadOnly, "The pprof index and the named profiles, such as the heap.", d.pprofIndexHandler(index))
+
+	for pat, ep := range pprofEndpoints {
+		if ep.capture != nil {
+			d.handle(d.prefix+pat, ep.class, ep.description, d.wrapCapture(ep.class, ep.capture, ep.serial, http.HandlerFunc(ep.handler)))
+			continue
+		}
+		d.handle(d.prefix+pat, ep.class, ep.description, d.setupHandler(ep.class, ep.handler))
 	}
 }
+
+// pprofIndexHandler applies policies to the pprof index, which also
+// serves the named profiles: the index itself is read-only, while
+// the profiles are expensive.
+func (d *Debug) pprofIndexHandler(index func(http.ResponseWriter, *http.Request)) http.Handler {
+	profiles := d.setupHandler(Expensive, index)
+	listing := d.setupHandler(ReadOnly, index)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == d.prefix+"pprof/" {
+			listing.ServeHTTP(w, req)
+			return
+		}
+		profiles.ServeHTTP(w, req)
+	})
+}
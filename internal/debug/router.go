@@ -0,0 +1,220 @@
+package debug
+
+// router.go contains the multiplexer for the debug endpoints.
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A route is a registered endpoint: its access class, a description
+// for the index, and the handler serving it, with the class's policy
+// already applied.
+type route struct {
+	class       Class
+	description string
+	handler     http.Handler
+}
+
+// A router multiplexes requests to the registered endpoints. Like an
+// http.ServeMux, a pattern ending in a slash matches any path under
+// it, other patterns match only themselves, and the longest matching
+// pattern wins. Unlike an http.ServeMux, endpoints may be replaced or
+// removed while the router is serving requests, and registering a
+// pattern twice replaces the first registration rather than
+// panicking.
+type router struct {
+	lock    *sync.RWMutex
+	routes  map[string]route
+	subtree []string // Patterns ending in a slash, longest first.
+}
+
+func newRouter() *router {
+	return &router{
+		lock:   new(sync.RWMutex),
+		routes: map[string]route{},
+	}
+}
+
+// sortSubtree rebuilds the list of subtree patterns.
+// L >= rt.lock
+func (rt *router) sortSubtree() {
+	rt.subtree = rt.subtree[:0]
+	for pat := range rt.routes {
+		if strings.HasSuffix(pat, "/") {
+			rt.subtree = append(rt.subtree, pat)
+		}
+	}
+
+	sort.Slice(rt.subtree, func(i, j int) bool {
+		return len(rt.subtree[i]) > len(rt.subtree[j])
+	})
+}
+
+// handle registers the route for the pattern, replacing any existing
+// route.
+func (rt *router) handle(pat string, r route) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	_, exists := rt.routes[pat]
+	rt.routes[pat] = r
+	if !exists && strings.HasSuffix(pat, "/") {
+		rt.sortSubtree()
+	}
+}
+
+// replace replaces the handler for an existing pattern with the one
+// returned by wrap, which is given the route's class. It returns
+// false if the pattern isn't registered.
+func (rt *router) replace(pat string, wrap func(Class) http.Handler) bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	r, ok := rt.routes[pat]
+	if !ok {
+		return false
+	}
+
+	r.handler = wrap(r.class)
+	rt.routes[pat] = r
+	return true
+}
+
+// describe sets the description of an existing pattern, returning
+// false if the pattern isn't registered.
+func (rt *router) describe(pat, description string) bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	r, ok := rt.routes[pat]
+	if !ok {
+		return false
+	}
+
+	r.description = description
+	rt.routes[pat] = r
+	return true
+}
+
+// remove unregisters the pattern, returning false if it wasn't
+// registered.
+func (rt *router) remove(pat string) bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if _, ok := rt.routes[pat]; !ok {
+		return false
+	}
+
+	delete(rt.routes, pat)
+	if strings.HasSuffix(pat, "/") {
+		rt.sortSubtree()
+	}
+	return true
+}
+
+// patterns returns the registered patterns in sorted order.
+func (rt *router) patterns() []string {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	pats := make([]string, 0, len(rt.routes))
+	for pat := range rt.routes {
+		pats = append(pats, pat)
+	}
+	sort.Strings(pats)
+	return pats
+}
+
+// entries returns the registered routes, keyed by pattern.
+func (rt *router) entries() map[string]route {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	routes := make(map[string]route, len(rt.routes))
+	for pat, r := range rt.routes {
+		routes[pat] = r
+	}
+	return routes
+}
+
+// match returns the route for the path and the pattern it was
+// registered under.
+func (rt *router) match(path string) (route, string, bool) {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	if r, ok := rt.routes[path]; ok {
+		return r, path, true
+	}
+
+	for _, pat := range rt.subtree {
+		if strings.HasPrefix(path, pat) {
+			return rt.routes[pat], pat, true
+		}
+	}
+
+	return route{}, "", false
+}
+
+// registered returns true if the pattern is registered.
+func (rt *router) registered(pat string) bool {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	_, ok := rt.routes[pat]
+	return ok
+}
+
+// cleanPath returns the canonical path for p, eliminating . and ..
+// elements while preserving any trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// redirect sends the client to the given path, keeping the query.
+func redirect(w http.ResponseWriter, req *http.Request, path string) {
+	u := *req.URL
+	u.Path = path
+	http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+}
+
+// ServeHTTP dispatches the request to the longest matching pattern.
+// As with an http.ServeMux, unclean paths are redirected to their
+// canonical form, so that policies applied by path can't be evaded,
+// and a path matching only a subtree pattern without its trailing
+// slash is redirected to the subtree.
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if p := cleanPath(req.URL.Path); p != req.URL.Path {
+		redirect(w, req, p)
+		return
+	}
+
+	if !rt.registered(req.URL.Path) && rt.registered(req.URL.Path+"/") {
+		redirect(w, req, req.URL.Path+"/")
+		return
+	}
+
+	r, _, ok := rt.match(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 
 	"github.com/kisom/httpdebug/trace"
-	"github.com/kisom/httpdebug/whitelist"
 )
 
 // AllowSensitiveTrace controls whether sensitive traces are permitted
@@ -14,39 +13,47 @@ import (
 // up with no ACLs, no sensitive traces are permitted.
 var AllowSensitiveTrace bool
 
-// aclAuthRequest sets up the trace package to use the Debug's ACL.
-func (d *Debug) aclAuthRequest() {
-	if d.acl == nil {
-		trace.AuthRequest = func(req *http.Request) (any, sensitive bool) {
-			return true, d.admin(req)
-		}
+// authRequest authenticates trace requests using the ACL from the
+// endpoint's policy and the Debug's admin authenticator. It is used
+// in place of the trace package's global AuthRequest so that multiple
+// Debug values may coexist.
+func (d *Debug) authRequest(req *http.Request) (any, sensitive bool) {
+	acl := d.policy(req.URL.Path, ReadOnly).ACL
+	if acl == nil {
+		return true, d.admin(req)
 	}
 
-	trace.AuthRequest = func(req *http.Request) (any, sensitive bool) {
-		reqIP, err := whitelist.HTTPRequestLookup(req)
-		if err != nil {
-			return false, false
-		}
-
-		return d.acl.Permitted(reqIP), d.admin(req)
+	reqIP, err := d.lookup(req)
+	if err != nil {
+		return false, false
 	}
+
+	return acl.Permitted(reqIP), d.admin(req)
 }
 
-var traceEndpoints = map[string]func(http.ResponseWriter, *http.Request){
-	"/debug/requests": trace.TraceRequest,
-	"/debug/events":   trace.EventRequest,
+// traceEndpoint is a trace endpoint and its description.
+type traceEndpoint struct {
+	handler     func(trace.Authenticator) http.Handler
+	description string
+}
+
+// traceEndpoints contains the trace endpoints, relative to the
+// Debug's prefix.
+var traceEndpoints = map[string]traceEndpoint{
+	"requests": {trace.TraceHandler, "Active and recently completed request traces."},
+	"events":   {trace.EventHandler, "Long-lived event logs."},
+	"metrics":  {trace.MetricsHandler, "Trace and event log metrics in the Prometheus text format."},
+	"snapshot": {trace.SnapshotHandler, "A download of the requests and events pages for offline viewing."},
 }
 
 // traceSetup applies any ACL and timeout constraints to the trace
-// handlers, and adds them to list of endpoints to be registered.
+// handlers, and registers them.
 func (d *Debug) traceSetup() {
 	if d.setup {
 		return
 	}
 
-	d.aclAuthRequest()
-
-	for pat, h := range traceEndpoints {
-		d.endpoints[pat] = d.setupHandler(h)
+	for pat, ep := range traceEndpoints {
+		d.handle(d.prefix+pat, ReadOnly, ep.description, d.wrapHandler(ReadOnly, ep.handler(d.authRequest)))
 	}
 }
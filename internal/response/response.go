@@ -0,0 +1,151 @@
+// Package response implements an http.ResponseWriter that records the
+// status and size of a response, shared by the trace middleware and
+// the debug endpoints' audit log.
+package response
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// A Recorder records the status and size of a response written
+// through it to an underlying http.ResponseWriter.
+type Recorder struct {
+	w      http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// Header returns the underlying writer's header map.
+func (rec *Recorder) Header() http.Header {
+	return rec.w.Header()
+}
+
+// WriteHeader records the status and passes it to the underlying
+// writer.
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.w.WriteHeader(status)
+}
+
+// Write records the size of the response and passes p to the
+// underlying writer.
+func (rec *Recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.w.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying writer, for the benefit of
+// http.ResponseController.
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
+
+// Status returns the status of the response, or 0 if nothing has
+// been written.
+func (rec *Recorder) Status() int {
+	return rec.status
+}
+
+// Bytes returns the number of bytes written in the response body.
+func (rec *Recorder) Bytes() int64 {
+	return rec.bytes
+}
+
+// flusher passes flushes through to the underlying writer, so that
+// streaming handlers aren't buffered.
+type flusher struct{ rec *Recorder }
+
+func (f flusher) Flush() {
+	if f.rec.status == 0 {
+		f.rec.status = http.StatusOK
+	}
+	f.rec.w.(http.Flusher).Flush()
+}
+
+// closeNotifier passes close notifications through from the
+// underlying writer.
+type closeNotifier struct{ rec *Recorder }
+
+func (cn closeNotifier) CloseNotify() <-chan bool {
+	return cn.rec.w.(http.CloseNotifier).CloseNotify()
+}
+
+// hijacker passes hijacking through to the underlying writer, so that
+// handlers may upgrade connections.
+type hijacker struct{ rec *Recorder }
+
+func (hj hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj.rec.status == 0 {
+		hj.rec.status = http.StatusSwitchingProtocols
+	}
+	return hj.rec.w.(http.Hijacker).Hijack()
+}
+
+// Record returns a Recorder for the response written to w, and the
+// writer that handlers should be given. The writer implements
+// http.Flusher, http.CloseNotifier, and http.Hijacker only if w does,
+// so that handlers checking for them aren't misled; other optional
+// features are reached through http.ResponseController.
+func Record(w http.ResponseWriter) (*Recorder, http.ResponseWriter) {
+	rec := &Recorder{w: w}
+	f := flusher{rec}
+	cn := closeNotifier{rec}
+	hj := hijacker{rec}
+
+	_, canFlush := w.(http.Flusher)
+	_, canNotify := w.(http.CloseNotifier)
+	_, canHijack := w.(http.Hijacker)
+
+	switch {
+	case canFlush && canNotify && canHijack:
+		return rec, struct {
+			*Recorder
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+		}{rec, f, cn, hj}
+	case canFlush && canNotify:
+		return rec, struct {
+			*Recorder
+			http.Flusher
+			http.CloseNotifier
+		}{rec, f, cn}
+	case canFlush && canHijack:
+		return rec, struct {
+			*Recorder
+			http.Flusher
+			http.Hijacker
+		}{rec, f, hj}
+	case canNotify && canHijack:
+		return rec, struct {
+			*Recorder
+			http.CloseNotifier
+			http.Hijacker
+		}{rec, cn, hj}
+	case canFlush:
+		return rec, struct {
+			*Recorder
+			http.Flusher
+		}{rec, f}
+	case canNotify:
+		return rec, struct {
+			*Recorder
+			http.CloseNotifier
+		}{rec, cn}
+	case canHijack:
+		return rec, struct {
+			*Recorder
+			http.Hijacker
+		}{rec, hj}
+	default:
+		return rec, rec
+	}
+}
@@ -0,0 +1,71 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// bareWriter implements only http.ResponseWriter.
+type bareWriter struct {
+	header http.Header
+}
+
+func (bw *bareWriter) Header() http.Header         { return bw.header }
+func (bw *bareWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (bw *bareWriter) WriteHeader(int)             {}
+
+// features returns which optional interfaces w implements.
+func features(w http.ResponseWriter) (flush, notify, hijack bool) {
+	_, flush = w.(http.Flusher)
+	_, notify = w.(http.CloseNotifier)
+	_, hijack = w.(http.Hijacker)
+	return flush, notify, hijack
+}
+
+// TestRecord verifies that the status and size are recorded, and
+// that the optional interfaces are only implemented if the
+// underlying writer implements them.
+func TestRecord(t *testing.T) {
+	rec, w := Record(&bareWriter{header: http.Header{}})
+	if flush, notify, hijack := features(w); flush || notify || hijack {
+		t.Fatalf("response: a bare writer was given optional features (flush=%v, notify=%v, hijack=%v)",
+			flush, notify, hijack)
+	}
+
+	w.Write([]byte("hello"))
+	w.WriteHeader(http.StatusInternalServerError)
+	if rec.Status() != http.StatusOK || rec.Bytes() != 5 {
+		t.Fatalf("response: expected status %d and 5 bytes, but have %d and %d",
+			http.StatusOK, rec.Status(), rec.Bytes())
+	}
+
+	hr := httptest.NewRecorder()
+	rec, w = Record(hr)
+	if flush, notify, hijack := features(w); !flush || notify || hijack {
+		t.Fatalf("response: expected only Flush (flush=%v, notify=%v, hijack=%v)",
+			flush, notify, hijack)
+	}
+
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !hr.Flushed || rec.Status() != http.StatusOK {
+		t.Fatal("response: the flush wasn't passed through")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, w = Record(w)
+		if flush, notify, hijack := features(w); !flush || !notify || !hijack {
+			t.Errorf("response: expected every feature of a server's writer (flush=%v, notify=%v, hijack=%v)",
+				flush, notify, hijack)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,149 @@
+package httpdebug
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kisom/httpdebug/audit"
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/internal/debug"
+	"github.com/kisom/httpdebug/whitelist"
+)
+
+// An Option configures a Debugger; see NewDebuggerWithOptions.
+type Option debug.Option
+
+// debugOptions converts opts for use with the internal debug package.
+func debugOptions(opts []Option) []debug.Option {
+	dopts := make([]debug.Option, 0, len(opts))
+	for _, opt := range opts {
+		dopts = append(dopts, debug.Option(opt))
+	}
+	return dopts
+}
+
+// WithACL restricts all requests to the given whitelist. A nil ACL
+// permits requests from any address.
+func WithACL(acl whitelist.ACL) Option {
+	return Option(debug.WithACL(acl))
+}
+
+// WithLocalhost restricts all requests to localhost. This is the
+// default.
+func WithLocalhost() Option {
+	return Option(debug.WithLocalhost())
+}
+
+// WithAuthenticator requires every request to be authenticated by a,
+// in addition to being permitted by the ACL. To permit requests that
+// satisfy either the ACL or a, use WithACL(nil) with an authenticator
+// built with auth.Any and auth.ACL.
+func WithAuthenticator(a auth.Authenticator) Option {
+	return Option(debug.WithAuthenticator(a))
+}
+
+// WithLookup sets the function used to determine a request's client
+// address. The default is whitelist.HTTPRequestLookup.
+func WithLookup(lookup whitelist.LookupFunc) Option {
+	return Option(debug.WithLookup(lookup))
+}
+
+// WithTrustedProxies honours the given forwarding header (e.g.
+// whitelist.HeaderXForwardedFor) on requests arriving from the
+// proxies in the given whitelist when determining the client
+// address. Only the header the proxies set should be given; see
+// whitelist.ProxyLookup.
+func WithTrustedProxies(proxies whitelist.ACL, header string) Option {
+	return Option(debug.WithTrustedProxies(proxies, header))
+}
+
+// WithAdmin sets the admin authenticator, which controls access to
+// sensitive traces.
+func WithAdmin(admin func(*http.Request) bool) Option {
+	return Option(debug.WithAdmin(admin))
+}
+
+// WithAdminACL permits viewing sensitive traces from addresses in
+// the given whitelist.
+func WithAdminACL(acl whitelist.ACL) Option {
+	return Option(debug.WithAdminACL(acl))
+}
+
+// WithTimeout applies a timeout to each request. If timeout is 0,
+// no timeouts will be applied; this is the default.
+func WithTimeout(timeout time.Duration) Option {
+	return Option(debug.WithTimeout(timeout))
+}
+
+// WithCaptureGrace sets the time allowed for the CPU profile and
+// execution trace endpoints to finish writing beyond the capture
+// duration requested with their seconds parameter. These endpoints
+// are not subject to the ordinary timeout. The default is 10 seconds.
+func WithCaptureGrace(grace time.Duration) Option {
+	return Option(debug.WithCaptureGrace(grace))
+}
+
+// WithMaxCapture limits the capture duration that may be requested
+// from the CPU profile and execution trace endpoints; longer requests
+// are shortened to max. As the CPU profile endpoint only captures for
+// whole seconds, max is rounded up to a whole number of seconds. If
+// max is 0, captures are not limited. The default is 5 minutes.
+func WithMaxCapture(max time.Duration) Option {
+	return Option(debug.WithMaxCapture(max))
+}
+
+// WithPprof controls whether the pprof endpoints are enabled. They
+// are enabled by default.
+func WithPprof(enabled bool) Option {
+	return Option(debug.WithPprof(enabled))
+}
+
+// WithTrace controls whether the trace endpoints are enabled. They
+// are enabled by default.
+func WithTrace(enabled bool) Option {
+	return Option(debug.WithTrace(enabled))
+}
+
+// WithPrefix sets the path prefix under which the debug endpoints
+// are served. The default is "/debug/".
+func WithPrefix(prefix string) Option {
+	return Option(debug.WithPrefix(prefix))
+}
+
+// WithAudit passes a record of every request to the given sinks, in
+// addition to any added previously.
+func WithAudit(sinks ...audit.Sink) Option {
+	return Option(debug.WithAudit(sinks...))
+}
+
+// WithAuditRing records every request in the ring, and serves the
+// recorded requests under the prefix's audit path (e.g.
+// /debug/audit) as a sensitive endpoint.
+func WithAuditRing(ring *audit.Ring) Option {
+	return Option(debug.WithAuditRing(ring))
+}
+
+// WithConcurrencyLimit permits at most n concurrent requests to paths
+// beginning with prefix (e.g. "/debug/pprof/goroutine"). If queue is
+// true, requests over the limit wait for an earlier request to
+// finish; otherwise, they are rejected with a 429 (Too Many Requests)
+// response.
+func WithConcurrencyLimit(prefix string, n int, queue bool) Option {
+	return Option(debug.WithConcurrencyLimit(prefix, n, queue))
+}
+
+// WithRateLimit limits each client to rate requests per second to the
+// expensive endpoints, with bursts of up to burst requests. Requests
+// over the limit are rejected with a 429 (Too Many Requests) response.
+func WithRateLimit(rate float64, burst int) Option {
+	return Option(debug.WithRateLimit(rate, burst))
+}
+
+// WithMaxExpensive permits at most n concurrent requests to the
+// expensive endpoints across all clients; requests over the limit are
+// rejected with a 429 (Too Many Requests) response. If n is 0, the
+// number of expensive requests isn't limited. By default, at most 4
+// expensive requests are served at once.
+func WithMaxExpensive(n int) Option {
+	return Option(debug.WithMaxExpensive(n))
+}
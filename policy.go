@@ -0,0 +1,70 @@
+package httpdebug
+
+import (
+	"time"
+
+	"github.com/kisom/httpdebug/auth"
+	"github.com/kisom/httpdebug/internal/debug"
+	"github.com/kisom/httpdebug/whitelist"
+)
+
+// A Class groups endpoints with similar access requirements, so that
+// a single policy may be applied to all of them.
+type Class debug.Class
+
+const (
+	// ReadOnly endpoints are cheap to serve and reveal little
+	// about the process: the pprof index and symbol lookup, the
+	// trace pages, and handlers added with Handle or HandleFunc.
+	ReadOnly = Class(debug.ReadOnly)
+
+	// Expensive endpoints capture profiles or execution traces,
+	// which may be costly or slow: the CPU profile, the execution
+	// trace, and every named profile (including those added with
+	// AddProfile).
+	Expensive = Class(debug.Expensive)
+
+	// Sensitive endpoints may leak secrets, such as the command
+	// line served by pprof/cmdline.
+	Sensitive = Class(debug.Sensitive)
+)
+
+// String returns the name of the class.
+func (c Class) String() string {
+	return debug.Class(c).String()
+}
+
+// A Policy controls access to a set of endpoints. Any field that is
+// not set is inherited: path policies inherit from the policy for the
+// endpoint's class, which inherits from the Debugger's ACL,
+// authenticator, and timeout.
+type Policy struct {
+	// ACL restricts requests to the given whitelist.
+	ACL whitelist.ACL
+
+	// Authenticator, if set, must authenticate every request.
+	Authenticator auth.Authenticator
+
+	// Timeout is applied to each request; a negative timeout
+	// disables the timeout. The CPU profile and execution trace
+	// endpoints instead time out after their capture duration.
+	Timeout time.Duration
+}
+
+// WithClassPolicy applies a policy to every endpoint in the given
+// class, replacing the class's default policy. For example, the
+// expensive endpoints may be restricted to localhost while the
+// read-only endpoints are opened to an internal network. The
+// sensitive endpoints are restricted to localhost by default; a
+// policy without an ACL, such as Policy{}, opens them to the
+// Debugger's ACL instead.
+func WithClassPolicy(class Class, p Policy) Option {
+	return Option(debug.WithClassPolicy(debug.Class(class), debug.Policy(p)))
+}
+
+// WithPathPolicy applies a policy to every request whose path begins
+// with prefix (e.g. "/debug/pprof/heap"). If several path policies
+// match a request, the one with the longest prefix is used.
+func WithPathPolicy(prefix string, p Policy) Option {
+	return Option(debug.WithPathPolicy(prefix, debug.Policy(p)))
+}
@@ -68,10 +68,12 @@ import (
 // The package initialization registers it as /debug/pprof/cmdline.
 func Cmdline(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprintf(w, strings.Join(os.Args, "\x00"))
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
 }
 
-func sleep(w http.ResponseWriter, d time.Duration) {
+// sleep waits for d, returning early if the client goes away or the
+// request's context is done.
+func sleep(w http.ResponseWriter, r *http.Request, d time.Duration) {
 	var clientGone <-chan bool
 	if cn, ok := w.(http.CloseNotifier); ok {
 		clientGone = cn.CloseNotify()
@@ -79,16 +81,25 @@ func sleep(w http.ResponseWriter, d time.Duration) {
 	select {
 	case <-time.After(d):
 	case <-clientGone:
+	case <-r.Context().Done():
 	}
 }
 
-// Profile responds with the pprof-formatted cpu profile.
-// The package initialization registers it as /debug/pprof/profile.
-func Profile(w http.ResponseWriter, r *http.Request) {
+// ProfileDuration returns the duration of the CPU profile requested
+// by r: the whole number of seconds in the seconds GET parameter, or
+// 30 seconds if not specified.
+func ProfileDuration(r *http.Request) time.Duration {
 	sec, _ := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
 	if sec == 0 {
 		sec = 30
 	}
+	return time.Duration(sec) * time.Second
+}
+
+// Profile responds with the pprof-formatted cpu profile.
+// The package initialization registers it as /debug/pprof/profile.
+func Profile(w http.ResponseWriter, r *http.Request) {
+	d := ProfileDuration(r)
 
 	// Set Content Type assuming StartCPUProfile will work,
 	// because if it does it starts writing.
@@ -102,18 +113,26 @@ func Profile(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not enable CPU profiling: %s\n", err)
 		return
 	}
-	sleep(w, time.Duration(sec)*time.Second)
+	sleep(w, r, d)
 	pprof.StopCPUProfile()
 }
 
-// Trace responds with the execution trace in binary form.
-// Tracing lasts for duration specified in seconds GET parameter, or for 1 second if not specified.
-// The package initialization registers it as /debug/pprof/trace.
-func Trace(w http.ResponseWriter, r *http.Request) {
+// TraceDuration returns the duration of the execution trace
+// requested by r: the seconds GET parameter, which may be fractional,
+// or 1 second if not specified.
+func TraceDuration(r *http.Request) time.Duration {
 	sec, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
 	if sec <= 0 || err != nil {
 		sec = 1
 	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// Trace responds with the execution trace in binary form.
+// Tracing lasts for duration specified in seconds GET parameter, or for 1 second if not specified.
+// The package initialization registers it as /debug/pprof/trace.
+func Trace(w http.ResponseWriter, r *http.Request) {
+	d := TraceDuration(r)
 
 	// Set Content Type assuming trace.Start will work,
 	// because if it does it starts writing.
@@ -126,7 +145,7 @@ func Trace(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not enable tracing: %s\n", err)
 		return
 	}
-	sleep(w, time.Duration(sec*float64(time.Second)))
+	sleep(w, r, d)
 	trace.Stop()
 }
 
@@ -207,35 +226,51 @@ func (name handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Index responds to a request for "/debug/pprof/" with an HTML page
 // listing the available profiles.
 func Index(w http.ResponseWriter, r *http.Request) {
-	if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
-		name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
-		if name != "" {
-			handler(name).ServeHTTP(w, r)
-			return
+	IndexAt("/debug/pprof/")(w, r)
+}
+
+// IndexAt returns an Index handler for profiles served under the
+// given path prefix, which should end with a slash. For example,
+// IndexAt("/_internal/debug/pprof/") serves the "heap" profile at
+// "/_internal/debug/pprof/heap".
+func IndexAt(prefix string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			name := strings.TrimPrefix(r.URL.Path, prefix)
+			if name != "" {
+				handler(name).ServeHTTP(w, r)
+				return
+			}
 		}
-	}
 
-	profiles := pprof.Profiles()
-	if err := indexTmpl.Execute(w, profiles); err != nil {
-		log.Print(err)
+		data := &struct {
+			Prefix   string
+			Profiles []*pprof.Profile
+		}{
+			Prefix:   prefix,
+			Profiles: pprof.Profiles(),
+		}
+		if err := indexTmpl.Execute(w, data); err != nil {
+			log.Print(err)
+		}
 	}
 }
 
 var indexTmpl = template.Must(template.New("index").Parse(`<html>
 <head>
-<title>/debug/pprof/</title>
+<title>{{.Prefix}}</title>
 </head>
 <body>
-/debug/pprof/<br>
+{{.Prefix}}<br>
 <br>
 profiles:<br>
 <table>
-{{range .}}
-<tr><td align=right>{{.Count}}<td><a href="{{.Name}}?debug=1">{{.Name}}</a>
+{{range .Profiles}}
+<tr><td align=right>{{.Count}}<td><a href="{{$.Prefix}}{{.Name}}?debug=1">{{.Name}}</a>
 {{end}}
 </table>
 <br>
-<a href="goroutine?debug=2">full goroutine stack dump</a><br>
+<a href="{{.Prefix}}goroutine?debug=2">full goroutine stack dump</a><br>
 </body>
 </html>
 `))
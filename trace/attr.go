@@ -0,0 +1,183 @@
+package trace
+
+// This file implements structured attributes on traces and their
+// events.
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// An Attr is a key/value attribute of a trace or of an event in a
+// trace. Sensitive attributes are redacted, and not searched, unless
+// the viewer may see sensitive events.
+type Attr struct {
+	Key       string
+	Value     interface{}
+	Sensitive bool
+}
+
+// String returns an attribute with a string value.
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Int returns an attribute with an integer value.
+func Int(key string, value int64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Float returns an attribute with a floating point value.
+func Float(key string, value float64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Bool returns an attribute with a boolean value.
+func Bool(key string, value bool) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Duration returns an attribute with a duration value.
+func Duration(key string, value time.Duration) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Sensitive returns the attribute marked as sensitive.
+func Sensitive(a Attr) Attr {
+	a.Sensitive = true
+	return a
+}
+
+// jsonValue returns the attribute's value in a form suitable for
+// JSON: strings, numbers and booleans are kept, durations become
+// nanoseconds, and anything else is formatted as a string.
+func (a Attr) jsonValue() interface{} {
+	switch v := a.Value.(type) {
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return int64(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ValueString returns the attribute's value formatted as a string.
+func (a Attr) ValueString() string {
+	switch v := a.Value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// String returns the attribute as key=value.
+func (a Attr) String() string {
+	return a.Key + "=" + a.ValueString()
+}
+
+// setAttrs sets the attributes in attrs, replacing those with the
+// same key.
+// L >= tr.mu
+func (tr *trace) setAttrs(attrs []Attr) {
+	for _, a := range attrs {
+		replaced := false
+		for i := range tr.attrs {
+			if tr.attrs[i].Key == a.Key {
+				tr.attrs[i] = a
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			tr.attrs = append(tr.attrs, a)
+		}
+	}
+}
+
+func (tr *trace) SetAttr(key string, value interface{}) {
+	tr.SetAttrs(Attr{Key: key, Value: value})
+}
+
+func (tr *trace) SetAttrs(attrs ...Attr) {
+	tr.mu.Lock()
+	tr.setAttrs(attrs)
+	tr.mu.Unlock()
+}
+
+func (tr *trace) LazyLogAttrs(x fmt.Stringer, sensitive bool, attrs ...Attr) {
+	tr.addEvent(x, true, sensitive, attrs...)
+}
+
+// Attrs returns a copy of the trace's attributes.
+func (tr *trace) Attrs() []Attr {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return append([]Attr(nil), tr.attrs...)
+}
+
+// AttrRecord is the JSON representation of an attribute. The value of
+// a sensitive attribute is omitted unless the request is permitted to
+// see it.
+type AttrRecord struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value,omitempty"`
+	Sensitive bool        `json:"sensitive,omitempty"`
+	Redacted  bool        `json:"redacted,omitempty"`
+}
+
+// newAttrRecords returns the JSON representation of the attributes.
+func newAttrRecords(attrs []Attr, sensitive bool) []*AttrRecord {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	recs := make([]*AttrRecord, 0, len(attrs))
+	for _, a := range attrs {
+		rec := &AttrRecord{Key: a.Key, Sensitive: a.Sensitive}
+		if a.Sensitive && !sensitive {
+			rec.Redacted = true
+		} else {
+			rec.Value = a.jsonValue()
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// matchAttr returns true if one of the attributes has the key and,
+// unless value is empty, the value. Sensitive attributes are only
+// matched if sensitive is true.
+func matchAttr(attrs []Attr, key, value string, sensitive bool) bool {
+	for _, a := range attrs {
+		if a.Key != key || (a.Sensitive && !sensitive) {
+			continue
+		}
+		if value == "" || a.ValueString() == value {
+			return true
+		}
+	}
+	return false
+}
+
+// formatAttrs formats the attributes as space-separated key=value
+// pairs, redacting the values of sensitive attributes unless sensitive
+// is true.
+func formatAttrs(attrs []Attr, sensitive bool) string {
+	var buf []byte
+	for i, a := range attrs {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		if a.Sensitive && !sensitive {
+			buf = append(buf, a.Key+"=[redacted]"...)
+		} else {
+			buf = append(buf, a.String()...)
+		}
+	}
+	return string(buf)
+}
@@ -16,7 +16,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"text/tabwriter"
 	"time"
 )
@@ -50,6 +49,7 @@ var buckets = []bucket{
 func RenderEvents(w http.ResponseWriter, req *http.Request, sensitive bool) {
 	now := time.Now()
 	data := &struct {
+		Path     string   // the path at which the page is served
 		Families []string // family names
 		Buckets  []bucket
 		Counts   [][]int // eventLog count per family/bucket
@@ -59,7 +59,11 @@ func RenderEvents(w http.ResponseWriter, req *http.Request, sensitive bool) {
 		Bucket    int
 		EventLogs eventLogs
 		Expanded  bool
+
+		// Set when rendering a snapshot.
+		Snapshot time.Time
 	}{
+		Path:    "/debug/events",
 		Buckets: buckets,
 	}
 
@@ -83,6 +87,10 @@ func RenderEvents(w http.ResponseWriter, req *http.Request, sensitive bool) {
 	}
 
 	if req != nil {
+		if req.URL != nil && req.URL.Path != "" {
+			data.Path = req.URL.Path
+		}
+
 		var ok bool
 		data.Family, data.Bucket, ok = parseEventsArgs(req)
 		if !ok {
@@ -91,7 +99,6 @@ func RenderEvents(w http.ResponseWriter, req *http.Request, sensitive bool) {
 			data.EventLogs = getEventFamily(data.Family).Copy(now, buckets[data.Bucket].MaxErrAge)
 		}
 		if data.EventLogs != nil {
-			defer data.EventLogs.Free()
 			sort.Sort(data.EventLogs)
 		}
 		if exp, err := strconv.ParseBool(req.FormValue("exp")); err == nil {
@@ -136,7 +143,6 @@ type EventLog interface {
 // and title.
 func NewEventLog(family, title string) EventLog {
 	el := newEventLog()
-	el.ref()
 	el.Family, el.Title = family, title
 	el.Start = time.Now()
 	el.events = make([]logEntry, 0, maxEventsPerLog)
@@ -149,8 +155,10 @@ func NewEventLog(family, title string) EventLog {
 }
 
 func (el *eventLog) Finish() {
+	// Pages only read copies of the logs in the family, so el may be
+	// reused once it has been removed.
 	getEventFamily(el.Family).remove(el)
-	el.unref() // matches ref in New
+	freeEventLog(el)
 }
 
 var (
@@ -203,14 +211,15 @@ func (f *eventFamily) Count(now time.Time, maxErrAge time.Duration) (n int) {
 	return
 }
 
+// Copy returns copies of the event logs with errors in the last
+// maxErrAge, or of every log if maxErrAge is zero.
 func (f *eventFamily) Copy(now time.Time, maxErrAge time.Duration) (els eventLogs) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	els = make(eventLogs, 0, len(f.eventLogs))
 	for _, el := range f.eventLogs {
 		if el.hasRecentError(now, maxErrAge) {
-			el.ref()
-			els = append(els, el)
+			els = append(els, el.clone())
 		}
 	}
 	return
@@ -218,13 +227,6 @@ func (f *eventFamily) Copy(now time.Time, maxErrAge time.Duration) (els eventLog
 
 type eventLogs []*eventLog
 
-// Free calls unref on each element of the list.
-func (els eventLogs) Free() {
-	for _, el := range els {
-		el.unref()
-	}
-}
-
 // eventLogs may be sorted in reverse chronological order.
 func (els eventLogs) Len() int           { return len(els) }
 func (els eventLogs) Less(i, j int) bool { return els[i].Start.After(els[j].Start) }
@@ -270,8 +272,6 @@ type eventLog struct {
 	events        []logEntry
 	LastErrorTime time.Time
 	discarded     int
-
-	refs int32 // how many buckets this is in
 }
 
 func (el *eventLog) reset() {
@@ -283,7 +283,6 @@ func (el *eventLog) reset() {
 	el.events = nil
 	el.LastErrorTime = time.Time{}
 	el.discarded = 0
-	el.refs = 0
 }
 
 func (el *eventLog) hasRecentError(now time.Time, maxErrAge time.Duration) bool {
@@ -346,13 +345,19 @@ func (el *eventLog) printf(isErr bool, format string, a ...interface{}) {
 	el.mu.Unlock()
 }
 
-func (el *eventLog) ref() {
-	atomic.AddInt32(&el.refs, 1)
-}
-
-func (el *eventLog) unref() {
-	if atomic.AddInt32(&el.refs, -1) == 0 {
-		freeEventLog(el)
+// clone returns a copy of el for a page to read. The stack is shared,
+// as it isn't changed after the log is created.
+func (el *eventLog) clone() *eventLog {
+	el.mu.RLock()
+	defer el.mu.RUnlock()
+	return &eventLog{
+		Family:        el.Family,
+		Title:         el.Title,
+		Start:         el.Start,
+		stack:         el.stack,
+		events:        append([]logEntry(nil), el.events...),
+		LastErrorTime: el.LastErrorTime,
+		discarded:     el.discarded,
 	}
 }
 
@@ -398,27 +403,20 @@ func (el *eventLog) Events() []logEntry {
 	return el.events
 }
 
-// freeEventLogs is a freelist of *eventLog
-var freeEventLogs = make(chan *eventLog, 1000)
+// eventLogPool holds freed event logs for reuse.
+var eventLogPool = sync.Pool{
+	New: func() interface{} { return new(eventLog) },
+}
 
 // newEventLog returns a event log ready to use.
 func newEventLog() *eventLog {
-	select {
-	case el := <-freeEventLogs:
-		return el
-	default:
-		return new(eventLog)
-	}
+	return eventLogPool.Get().(*eventLog)
 }
 
-// freeEventLog adds el to freeEventLogs if there's room.
-// This is non-blocking.
+// freeEventLog returns el to eventLogPool once it has finished.
 func freeEventLog(el *eventLog) {
 	el.reset()
-	select {
-	case freeEventLogs <- el:
-	default:
-	}
+	eventLogPool.Put(el)
 }
 
 const eventsHTML = `
@@ -465,7 +463,8 @@ const eventsHTML = `
 	</style>
 	<body>
 
-<h1>/debug/events</h1>
+<h1>{{$.Path}}</h1>
+{{if not $.Snapshot.IsZero}}<p><em>Snapshot taken at {{$.Snapshot}}.</em></p>{{end}}
 
 <table id="req-status">
 	{{range $i, $fam := .Families}}
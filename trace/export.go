@@ -0,0 +1,292 @@
+package trace
+
+// This file implements exporting completed traces.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// An Exporter exports completed traces, such as to a tracing backend.
+// ExportSpans is called from a single goroutine per registration, with
+// batches of traces; it must not modify or retain them.
+type Exporter interface {
+	ExportSpans(spans []*TraceRecord) error
+}
+
+// ExportConfig configures the export of completed traces to an
+// exporter. Zero fields take their defaults.
+type ExportConfig struct {
+	// Name identifies the exporter in the metrics. It defaults to
+	// the exporter's type.
+	Name string
+
+	// QueueSize is the number of traces that may wait to be
+	// exported; once it is full, newly completed traces are
+	// dropped. It defaults to 1024.
+	QueueSize int
+
+	// BatchSize is the most traces passed to each ExportSpans
+	// call. It defaults to 64.
+	BatchSize int
+
+	// Sensitive exports sensitive events and attributes, which
+	// are otherwise redacted.
+	Sensitive bool
+}
+
+const (
+	defaultExportQueueSize = 1024
+	defaultExportBatchSize = 64
+)
+
+// ExportStats counts the traces passed to an exporter.
+type ExportStats struct {
+	Exported int64 // exported successfully
+	Failed   int64 // in batches for which ExportSpans failed
+	Dropped  int64 // dropped because the queue was full
+}
+
+// An exportItem is a completed trace waiting to be exported, with the
+// span context it is exported with. The trace is the queue's own copy,
+// returned to tracePool once its record has been built.
+type exportItem struct {
+	tr *trace
+	sc SpanContext
+}
+
+// An ExportQueue passes completed traces to an exporter
+// asynchronously; see RegisterExporter.
+type ExportQueue struct {
+	name      string
+	e         Exporter
+	batchSize int
+	sensitive bool
+	ch        chan exportItem
+	done      chan struct{}
+	closing   sync.Once
+
+	exported, failed, dropped int64 // accessed atomically
+	abandoned                 int32 // set once Close gives up; accessed atomically
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending int // traces queued or being exported; guarded by mu
+}
+
+var (
+	exportMu     sync.RWMutex
+	exportQueues []*ExportQueue
+	numExporters int32 // len(exportQueues), for the fast path in Finish
+)
+
+// RegisterExporter starts passing each completed trace to e, in the
+// background, until the returned queue is closed. Traces continuing a
+// distributed trace that wasn't sampled aren't exported, and traces
+// without trace information are given new, random IDs.
+func RegisterExporter(e Exporter, cfg ExportConfig) *ExportQueue {
+	if cfg.Name == "" {
+		cfg.Name = fmt.Sprintf("%T", e)
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultExportQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultExportBatchSize
+	}
+
+	q := &ExportQueue{
+		name:      cfg.Name,
+		e:         e,
+		batchSize: cfg.BatchSize,
+		sensitive: cfg.Sensitive,
+		ch:        make(chan exportItem, cfg.QueueSize),
+		done:      make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+
+	exportMu.Lock()
+	exportQueues = append(exportQueues, q)
+	atomic.StoreInt32(&numExporters, int32(len(exportQueues)))
+	exportMu.Unlock()
+	return q
+}
+
+// Stats returns the number of traces exported, failed, and dropped.
+func (q *ExportQueue) Stats() ExportStats {
+	return ExportStats{
+		Exported: atomic.LoadInt64(&q.exported),
+		Failed:   atomic.LoadInt64(&q.failed),
+		Dropped:  atomic.LoadInt64(&q.dropped),
+	}
+}
+
+// Flush waits until the traces queued so far have been exported.
+func (q *ExportQueue) Flush() {
+	q.mu.Lock()
+	for q.pending > 0 {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
+
+// Close stops passing completed traces to the exporter, and waits
+// until those already queued have been exported or ctx is done. In
+// the latter case, it returns ctx's error, and the traces still
+// queued once the current export returns are dropped.
+func (q *ExportQueue) Close(ctx context.Context) error {
+	q.closing.Do(func() {
+		exportMu.Lock()
+		for i, eq := range exportQueues {
+			if eq == q {
+				exportQueues = append(exportQueues[:i], exportQueues[i+1:]...)
+				break
+			}
+		}
+		atomic.StoreInt32(&numExporters, int32(len(exportQueues)))
+		exportMu.Unlock()
+
+		// Traces are only queued with exportMu held, so none
+		// can be sent after the queue is removed.
+		close(q.ch)
+	})
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		atomic.StoreInt32(&q.abandoned, 1)
+		return ctx.Err()
+	}
+}
+
+// finished marks n traces as no longer pending.
+func (q *ExportQueue) finished(n int) {
+	q.mu.Lock()
+	q.pending -= n
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+// enqueue queues tr for export with the span context sc, or drops it
+// if the queue is full. The queue keeps a copy of tr.
+// L >= exportMu (read)
+func (q *ExportQueue) enqueue(tr *trace, sc SpanContext) {
+	q.mu.Lock()
+	q.pending++
+	q.mu.Unlock()
+
+	c := newTrace()
+	tr.copyTo(c)
+	select {
+	case q.ch <- exportItem{c, sc}:
+	default:
+		freeTrace(c)
+		atomic.AddInt64(&q.dropped, 1)
+		q.finished(1)
+	}
+}
+
+// records returns the records of the batch of traces, and frees them.
+// The records are built here rather than in Finish, so that lazy
+// events are only evaluated for export in the background.
+func (q *ExportQueue) records(batch []exportItem) []*TraceRecord {
+	recs := make([]*TraceRecord, 0, len(batch))
+	for _, it := range batch {
+		rec := newTraceRecord(it.tr, q.sensitive)
+		rec.TraceID, rec.SpanID = it.sc.TraceID.String(), it.sc.SpanID.String()
+		recs = append(recs, rec)
+		freeTrace(it.tr)
+	}
+	return recs
+}
+
+// run exports the queued traces in batches until the queue is closed.
+func (q *ExportQueue) run() {
+	defer close(q.done)
+	for it := range q.ch {
+		items := []exportItem{it}
+	fill:
+		for len(items) < q.batchSize {
+			select {
+			case it, ok := <-q.ch:
+				if !ok {
+					break fill
+				}
+				items = append(items, it)
+			default:
+				break fill
+			}
+		}
+
+		if atomic.LoadInt32(&q.abandoned) != 0 {
+			for _, it := range items {
+				freeTrace(it.tr)
+			}
+			atomic.AddInt64(&q.dropped, int64(len(items)))
+			q.finished(len(items))
+			continue
+		}
+
+		batch := q.records(items)
+		if err := q.e.ExportSpans(batch); err != nil {
+			atomic.AddInt64(&q.failed, int64(len(batch)))
+			log.Printf("net/trace: failed to export %d traces to %s: %v", len(batch), q.name, err)
+		} else {
+			atomic.AddInt64(&q.exported, int64(len(batch)))
+		}
+		q.finished(len(batch))
+	}
+}
+
+// exportTrace queues a completed trace for each registered exporter.
+// It must be called before the trace is freed by Finish.
+func exportTrace(tr *trace) {
+	if atomic.LoadInt32(&numExporters) == 0 {
+		return
+	}
+
+	sc := tr.SpanContext()
+	switch {
+	case sc.IsValid() && !sc.Sampled:
+		return
+	case !sc.IsValid():
+		sc = newSpanContext(SpanContext{})
+	}
+
+	exportMu.RLock()
+	defer exportMu.RUnlock()
+	for _, q := range exportQueues {
+		q.enqueue(tr, sc)
+	}
+}
+
+// exportStats returns the statistics of each registered exporter by
+// name, and the names in order.
+func exportStats() ([]string, map[string]ExportStats) {
+	exportMu.RLock()
+	defer exportMu.RUnlock()
+
+	var names []string
+	stats := map[string]ExportStats{}
+	for _, q := range exportQueues {
+		if _, ok := stats[q.name]; !ok {
+			names = append(names, q.name)
+		}
+		s, qs := stats[q.name], q.Stats()
+		s.Exported += qs.Exported
+		s.Failed += qs.Failed
+		s.Dropped += qs.Dropped
+		stats[q.name] = s
+	}
+	sort.Strings(names)
+	return names, stats
+}
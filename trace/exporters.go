@@ -0,0 +1,322 @@
+package trace
+
+// This file implements exporters that write completed traces as
+// OTLP JSON (https://opentelemetry.io/docs/specs/otlp/) or Zipkin v2
+// JSON spans, to an io.Writer or an HTTP collector.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exportScope is the instrumentation scope of the exported spans.
+const exportScope = "github.com/kisom/httpdebug/trace"
+
+// spanEncoder encodes a batch of spans.
+type spanEncoder func(spans []*TraceRecord) ([]byte, error)
+
+// writerExporter writes each encoded batch on a line of its own.
+type writerExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	encode spanEncoder
+}
+
+func (we *writerExporter) ExportSpans(spans []*TraceRecord) error {
+	b, err := we.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	_, err = we.w.Write(append(b, '\n'))
+	return err
+}
+
+// httpExporter posts each encoded batch to a collector.
+type httpExporter struct {
+	url    string
+	client *http.Client
+	encode spanEncoder
+}
+
+func (he *httpExporter) ExportSpans(spans []*TraceRecord) error {
+	b, err := he.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := he.client.Post(he.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trace: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// defaultExportTimeout bounds the requests of the HTTP exporters when
+// no client is given, so that a collector that doesn't respond can't
+// hold up the export queue indefinitely.
+const defaultExportTimeout = 10 * time.Second
+
+func newHTTPExporter(url string, client *http.Client, encode spanEncoder) Exporter {
+	if client == nil {
+		client = &http.Client{Timeout: defaultExportTimeout}
+	}
+	return &httpExporter{url: url, client: client, encode: encode}
+}
+
+// NewOTLPExporter returns an exporter that writes each batch of traces
+// to w as an OTLP JSON ExportTraceServiceRequest, one per line, from
+// the named service.
+func NewOTLPExporter(w io.Writer, service string) Exporter {
+	return &writerExporter{w: w, encode: encodeOTLP(service)}
+}
+
+// NewOTLPHTTPExporter returns an exporter that posts each batch of
+// traces to an OTLP/HTTP collector's traces endpoint (e.g.
+// http://localhost:4318/v1/traces) as JSON, from the named service. If
+// client is nil, a client with a 10 second timeout is used.
+func NewOTLPHTTPExporter(url, service string, client *http.Client) Exporter {
+	return newHTTPExporter(url, client, encodeOTLP(service))
+}
+
+// NewZipkinExporter returns an exporter that writes each batch of
+// traces to w as a JSON array of Zipkin v2 spans, one per line, from
+// the named service.
+func NewZipkinExporter(w io.Writer, service string) Exporter {
+	return &writerExporter{w: w, encode: encodeZipkin(service)}
+}
+
+// NewZipkinHTTPExporter returns an exporter that posts each batch of
+// traces to a Zipkin collector's spans endpoint (e.g.
+// http://localhost:9411/api/v2/spans), from the named service. If
+// client is nil, a client with a 10 second timeout is used.
+func NewZipkinHTTPExporter(url, service string, client *http.Client) Exporter {
+	return newHTTPExporter(url, client, encodeZipkin(service))
+}
+
+// The OTLP JSON encoding of the ExportTraceServiceRequest message.
+// 64-bit integers are encoded as strings, and IDs in hex.
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	Events            []*otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []*otlpKeyValue `json:"attributes,omitempty"`
+}
+
+// otlpStatusError is the STATUS_CODE_ERROR status code.
+const otlpStatusError = 2
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpString(key, s string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &s}}
+}
+
+// otlpAttr converts an attribute with a JSON value, as in an
+// AttrRecord, to OTLP.
+func otlpAttr(key string, v interface{}) *otlpKeyValue {
+	kv := &otlpKeyValue{Key: key}
+	switch v := v.(type) {
+	case bool:
+		kv.Value.BoolValue = &v
+	case float32:
+		f := float64(v)
+		kv.Value.DoubleValue = &f
+	case float64:
+		kv.Value.DoubleValue = &v
+	case int, int32, int64, uint, uint32, uint64:
+		s := fmt.Sprint(v)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// otlpAttrs converts the attributes that aren't redacted to OTLP.
+func otlpAttrs(attrs []*AttrRecord) []*otlpKeyValue {
+	var kvs []*otlpKeyValue
+	for _, a := range attrs {
+		if !a.Redacted {
+			kvs = append(kvs, otlpAttr(a.Key, a.Value))
+		}
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeOTLP(service string) spanEncoder {
+	return func(spans []*TraceRecord) ([]byte, error) {
+		ss := &otlpScopeSpans{Scope: otlpScope{Name: exportScope}}
+		for _, rec := range spans {
+			span := &otlpSpan{
+				TraceID:           rec.TraceID,
+				SpanID:            rec.SpanID,
+				ParentSpanID:      rec.ParentID,
+				Name:              rec.Title,
+				StartTimeUnixNano: unixNano(rec.Start),
+				EndTimeUnixNano:   unixNano(rec.Start.Add(rec.Elapsed)),
+				Attributes:        append([]*otlpKeyValue{otlpString("trace.family", rec.Family)}, otlpAttrs(rec.Attrs)...),
+			}
+			if rec.IsError {
+				span.Status.Code = otlpStatusError
+			}
+			for _, e := range rec.Events {
+				if e.Redacted {
+					continue
+				}
+				span.Events = append(span.Events, &otlpEvent{
+					TimeUnixNano: unixNano(e.When),
+					Name:         e.What,
+					Attributes:   otlpAttrs(e.Attrs),
+				})
+			}
+			ss.Spans = append(ss.Spans, span)
+		}
+
+		return json.Marshal(&otlpRequest{
+			ResourceSpans: []*otlpResourceSpans{{
+				Resource:   otlpResource{Attributes: []*otlpKeyValue{otlpString("service.name", service)}},
+				ScopeSpans: []*otlpScopeSpans{ss},
+			}},
+		})
+	}
+}
+
+// The Zipkin v2 JSON span. Times are in microseconds since the epoch.
+type zipkinSpan struct {
+	TraceID       string              `json:"traceId"`
+	ID            string              `json:"id"`
+	ParentID      string              `json:"parentId,omitempty"`
+	Name          string              `json:"name"`
+	Timestamp     int64               `json:"timestamp"`
+	Duration      int64               `json:"duration"`
+	LocalEndpoint zipkinEndpoint      `json:"localEndpoint"`
+	Annotations   []*zipkinAnnotation `json:"annotations,omitempty"`
+	Tags          map[string]string   `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+func unixMicro(t time.Time) int64 {
+	return t.UnixNano() / 1e3
+}
+
+func encodeZipkin(service string) spanEncoder {
+	return func(spans []*TraceRecord) ([]byte, error) {
+		zspans := make([]*zipkinSpan, 0, len(spans))
+		for _, rec := range spans {
+			span := &zipkinSpan{
+				TraceID:       rec.TraceID,
+				ID:            rec.SpanID,
+				ParentID:      rec.ParentID,
+				Name:          rec.Title,
+				Timestamp:     unixMicro(rec.Start),
+				Duration:      rec.Elapsed.Nanoseconds() / 1e3,
+				LocalEndpoint: zipkinEndpoint{ServiceName: service},
+				Tags:          map[string]string{"trace.family": rec.Family},
+			}
+			if span.Duration < 1 {
+				span.Duration = 1 // Zipkin requires a positive duration.
+			}
+			if rec.IsError {
+				span.Tags["error"] = "true"
+			}
+			for _, a := range rec.Attrs {
+				if !a.Redacted {
+					span.Tags[a.Key] = fmt.Sprint(a.Value)
+				}
+			}
+			for _, e := range rec.Events {
+				if e.Redacted {
+					continue
+				}
+				value := e.What
+				for _, a := range e.Attrs {
+					if !a.Redacted {
+						value += fmt.Sprintf(" %s=%v", a.Key, a.Value)
+					}
+				}
+				span.Annotations = append(span.Annotations, &zipkinAnnotation{
+					Timestamp: unixMicro(e.When),
+					Value:     value,
+				})
+			}
+			zspans = append(zspans, span)
+		}
+		return json.Marshal(zspans)
+	}
+}
@@ -1,23 +1,149 @@
 package trace
 
-import "net/http"
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
 
+// An Authenticator determines whether a request is permitted to view
+// the trace pages; it has the same semantics as AuthRequest.
+type Authenticator func(req *http.Request) (any, sensitive bool)
+
+// TraceRequest serves the /debug/requests page, using AuthRequest to
+// authenticate the request. The traces are served as JSON if the
+// request has a format=json parameter or accepts application/json.
 func TraceRequest(w http.ResponseWriter, req *http.Request) {
-	any, sensitive := AuthRequest(req)
+	traceRequest(AuthRequest, w, req)
+}
+
+// EventRequest serves the /debug/events page, using AuthRequest to
+// authenticate the request. As with TraceRequest, the event logs may
+// be served as JSON.
+func EventRequest(w http.ResponseWriter, req *http.Request) {
+	eventRequest(AuthRequest, w, req)
+}
+
+// MetricsRequest serves the /debug/metrics page, using AuthRequest to
+// authenticate the request. The metrics are served in the OpenMetrics
+// text format if the request has a format=openmetrics parameter or
+// accepts application/openmetrics-text, and in the Prometheus text
+// format otherwise.
+func MetricsRequest(w http.ResponseWriter, req *http.Request) {
+	metricsRequest(AuthRequest, w, req)
+}
+
+// SnapshotRequest serves a download of a snapshot of the trace pages,
+// using AuthRequest to authenticate the request. The snapshot is
+// gzipped JSON, or plain JSON if the request has a format=json
+// parameter; see WriteSnapshot and RenderSnapshot.
+func SnapshotRequest(w http.ResponseWriter, req *http.Request) {
+	snapshotRequest(AuthRequest, w, req)
+}
+
+// TraceHandler returns an http.Handler serving the /debug/requests
+// page that uses auth instead of AuthRequest. This allows multiple
+// handlers with different access controls to coexist.
+func TraceHandler(auth Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceRequest(auth, w, req)
+	})
+}
+
+// EventHandler returns an http.Handler serving the /debug/events page
+// that uses auth instead of AuthRequest.
+func EventHandler(auth Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		eventRequest(auth, w, req)
+	})
+}
+
+// MetricsHandler returns an http.Handler serving the /debug/metrics
+// page that uses auth instead of AuthRequest.
+func MetricsHandler(auth Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		metricsRequest(auth, w, req)
+	})
+}
+
+// SnapshotHandler returns an http.Handler serving snapshot downloads
+// that uses auth instead of AuthRequest.
+func SnapshotHandler(auth Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		snapshotRequest(auth, w, req)
+	})
+}
+
+func traceRequest(auth Authenticator, w http.ResponseWriter, req *http.Request) {
+	any, sensitive := auth(req)
 	if !any {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		RenderJSON(w, req, sensitive)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	Render(w, req, sensitive)
 }
 
-func EventRequest(w http.ResponseWriter, req *http.Request) {
-	any, sensitive := AuthRequest(req)
+func eventRequest(auth Authenticator, w http.ResponseWriter, req *http.Request) {
+	any, sensitive := auth(req)
 	if !any {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		RenderEventsJSON(w, req)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	RenderEvents(w, req, sensitive)
 }
+
+func metricsRequest(auth Authenticator, w http.ResponseWriter, req *http.Request) {
+	if any, _ := auth(req); !any {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	openMetrics := req.FormValue("format") == "openmetrics" ||
+		strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusContentType)
+	}
+
+	if err := RenderMetrics(w, openMetrics); err != nil {
+		log.Printf("net/trace: failed to write metrics: %v", err)
+	}
+}
+
+func snapshotRequest(auth Authenticator, w http.ResponseWriter, req *http.Request) {
+	any, sensitive := auth(req)
+	if !any {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	sensitive = showSensitive(req, sensitive)
+
+	if req.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(TakeSnapshot(sensitive)); err != nil {
+			log.Printf("net/trace: failed to write snapshot: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+snapshotFilename(time.Now())+`"`)
+	if err := WriteSnapshot(w, sensitive); err != nil {
+		log.Printf("net/trace: failed to write snapshot: %v", err)
+	}
+}
@@ -20,6 +20,26 @@ const (
 	bucketCount = 38
 )
 
+// latencyHistogram is implemented by the histograms recording the
+// latency of a family's traces, in microseconds.
+type latencyHistogram interface {
+	timeseries.Observable
+	histogramSummary
+
+	addMeasurement(value int64)
+	sumValue() int64
+
+	// log2Counts returns the observations in each of the log2
+	// buckets used by histogram.
+	log2Counts() []int64
+
+	html() template.HTML
+}
+
+func newLog2Histogram() latencyHistogram {
+	return new(histogram)
+}
+
 // histogram keeps counts of values in buckets that are spaced
 // out in powers of 2: 0-1, 2-3, 4-7...
 // histogram implements timeseries.Observable
@@ -160,6 +180,77 @@ func (h *histogram) percentileBoundary(percentile float64) int64 {
 	return bucketBoundary(bucketCount - 1)
 }
 
+// bucketCounts returns the number of observations in each bucket.
+// Unlike allocateBuckets, it doesn't modify h.
+func (h *histogram) bucketCounts() []int64 {
+	if h.buckets != nil {
+		return h.buckets
+	}
+
+	counts := make([]int64, bucketCount)
+	if h.valueCount > 0 {
+		counts[h.value] = h.valueCount
+	}
+	return counts
+}
+
+// percentile estimates the value that the given fraction of recorded
+// observations are less than, without allocating h's buckets.
+func (h *histogram) percentile(fraction float64) int64 {
+	c := *h
+	if c.buckets == nil {
+		c.buckets = h.bucketCounts()
+		c.value = 0
+		c.valueCount = -1
+	}
+	return c.percentileBoundary(fraction)
+}
+
+// maxValue estimates the largest observation as the upper boundary of
+// the highest non-empty bucket; the log2 buckets don't record it.
+func (h *histogram) maxValue() int64 {
+	counts := h.bucketCounts()
+	for i := len(counts) - 1; i >= 0; i-- {
+		if counts[i] == 0 {
+			continue
+		}
+		if i == bucketCount-1 {
+			return math.MaxInt64
+		}
+		return bucketBoundary(uint8(i+1)) - 1
+	}
+	return 0
+}
+
+func (h *histogram) sumValue() int64 {
+	return h.sum
+}
+
+func (h *histogram) nonEmptyBuckets() []*HistogramBucket {
+	var buckets []*HistogramBucket
+	for i, n := range h.bucketCounts() {
+		if n == 0 {
+			continue
+		}
+
+		upper := int64(math.MaxInt64)
+		if i < bucketCount-1 {
+			upper = bucketBoundary(uint8(i + 1))
+		}
+
+		buckets = append(buckets, &HistogramBucket{
+			Lower: bucketBoundary(uint8(i)),
+			Upper: upper,
+			N:     n,
+		})
+	}
+	return buckets
+}
+
+func (h *histogram) log2Counts() []int64 {
+	return append([]int64(nil), h.bucketCounts()...)
+}
+
 // Median returns the estimated median of the observed values.
 func (h *histogram) median() int64 {
 	return h.percentileBoundary(0.5)
@@ -256,26 +347,65 @@ type bucketData struct {
 	GraphWidth         int
 }
 
+// percentileData holds an estimated percentile for use in distTmpl.
+type percentileData struct {
+	Label string
+	Value int64
+}
+
+// percentiles lists the percentiles shown for each histogram.
+var percentiles = []struct {
+	label    string
+	fraction float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p95", 0.95},
+	{"p99", 0.99},
+	{"p999", 0.999},
+}
+
 // data holds data about a Distribution for use in distTmpl.
 type data struct {
 	Buckets                 []*bucketData
-	Count, Median           int64
+	Count, Median, Max      int64
 	Mean, StandardDeviation float64
+	Percentiles             []percentileData
 }
 
 // maxHTMLBarWidth is the maximum width of the HTML bar for visualizing buckets.
 const maxHTMLBarWidth = 350.0
 
-// newData returns data representing h for use in distTmpl.
-func (h *histogram) newData() *data {
-	// Force the allocation of buckets to simplify the rendering implementation
-	h.allocateBuckets()
+// histogramSummary is the part of a histogram that is rendered as
+// HTML; a LatencyHistogram from a snapshot implements it too.
+type histogramSummary interface {
+	total() int64
+	average() float64
+	standardDeviation() float64
+
+	// percentile estimates the value that the given fraction of
+	// observations are less than. Unlike percentileBoundary, it
+	// doesn't modify the histogram.
+	percentile(fraction float64) int64
+
+	// maxValue returns the largest observation, or an estimate
+	// of it.
+	maxValue() int64
+
+	nonEmptyBuckets() []*HistogramBucket
+}
+
+// newHistogramData returns data representing h for use in distTmpl.
+// It doesn't modify h.
+func newHistogramData(h histogramSummary) *data {
+	buckets := h.nonEmptyBuckets()
+
 	// We scale the bars on the right so that the largest bar is
 	// maxHTMLBarWidth pixels in width.
 	maxBucket := int64(0)
-	for _, n := range h.buckets {
-		if n > maxBucket {
-			maxBucket = n
+	for _, b := range buckets {
+		if b.N > maxBucket {
+			maxBucket = b.N
 		}
 	}
 	total := h.total()
@@ -287,40 +417,42 @@ func (h *histogram) newData() *data {
 		pctMult = 100.0 / float64(total)
 	}
 
-	buckets := make([]*bucketData, len(h.buckets))
-	runningTotal := int64(0)
-	for i, n := range h.buckets {
-		if n == 0 {
-			continue
-		}
-		runningTotal += n
-		var upperBound int64
-		if i < bucketCount-1 {
-			upperBound = bucketBoundary(uint8(i + 1))
-		} else {
-			upperBound = math.MaxInt64
-		}
-		buckets[i] = &bucketData{
-			Lower:         bucketBoundary(uint8(i)),
-			Upper:         upperBound,
-			N:             n,
-			Pct:           float64(n) * pctMult,
-			CumulativePct: float64(runningTotal) * pctMult,
-			GraphWidth:    int(float64(n) * barsizeMult),
-		}
-	}
-	return &data{
-		Buckets:           buckets,
+	d := &data{
+		Buckets:           make([]*bucketData, 0, len(buckets)),
 		Count:             total,
-		Median:            h.median(),
+		Median:            h.percentile(0.5),
+		Max:               h.maxValue(),
 		Mean:              h.average(),
 		StandardDeviation: h.standardDeviation(),
 	}
+
+	runningTotal := int64(0)
+	for _, b := range buckets {
+		runningTotal += b.N
+		d.Buckets = append(d.Buckets, &bucketData{
+			Lower:         b.Lower,
+			Upper:         b.Upper,
+			N:             b.N,
+			Pct:           float64(b.N) * pctMult,
+			CumulativePct: float64(runningTotal) * pctMult,
+			GraphWidth:    int(float64(b.N) * barsizeMult),
+		})
+	}
+
+	for _, p := range percentiles {
+		d.Percentiles = append(d.Percentiles, percentileData{p.label, h.percentile(p.fraction)})
+	}
+	return d
 }
 
 func (h *histogram) html() template.HTML {
+	return histogramHTML(h)
+}
+
+// histogramHTML renders the histogram as an HTML table.
+func histogramHTML(h histogramSummary) template.HTML {
 	buf := new(bytes.Buffer)
-	if err := distTmpl.Execute(buf, h.newData()); err != nil {
+	if err := distTmpl.Execute(buf, newHistogramData(h)); err != nil {
 		buf.Reset()
 		log.Printf("net/trace: couldn't execute template: %v", err)
 	}
@@ -336,6 +468,12 @@ var distTmpl = template.Must(template.New("distTmpl").Parse(`
     <td style="padding:0.25em">StdDev: {{printf "%.0f" .StandardDeviation}}</td>
     <td style="padding:0.25em">Median: {{.Median}}</td>
 </tr>
+<tr>
+{{range .Percentiles}}
+    <td style="padding:0.25em">{{.Label}}: {{.Value}}</td>
+{{end}}
+    <td style="padding:0.25em">Max: {{.Max}}</td>
+</tr>
 </table>
 <hr>
 <table>
@@ -323,3 +323,91 @@ func add(h *histogram, times int, val int64) {
 func isApproximate(x, y float64) bool {
 	return math.Abs(x-y) < 1e-2
 }
+
+func TestLogLinearBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 31, 32, 33, 63, 64, 65, 1000, 3000, 1 << 20, 1<<40 + 12345} {
+		i := logLinearIndex(v)
+		lower, upper := logLinearBounds(i)
+		if v < lower || v >= upper {
+			t.Errorf("value %d is outside its bucket [%d, %d)", v, lower, upper)
+		}
+
+		if v >= subBucketCount && float64(upper-lower)/float64(lower) > 1.0/subBucketCount {
+			t.Errorf("bucket [%d, %d) is too wide", lower, upper)
+		}
+
+		if next, _ := logLinearBounds(i + 1); next != upper {
+			t.Errorf("bucket %d ends at %d, but the next begins at %d", i, upper, next)
+		}
+	}
+}
+
+func TestLogLinearPercentiles(t *testing.T) {
+	h := new(logLinearHistogram)
+	for i := int64(1); i <= 1000; i++ {
+		// A 3ms handler with a tail.
+		h.addMeasurement(2900 + i/5)
+	}
+	h.addMeasurement(45000)
+
+	// The log2 histogram would only place these in [2048, 4096).
+	for _, test := range []struct {
+		fraction float64
+		expected int64
+	}{
+		{0.5, 3000},
+		{0.99, 3098},
+	} {
+		p := h.percentile(test.fraction)
+		if math.Abs(float64(p-test.expected))/float64(test.expected) > 0.03 {
+			t.Errorf("percentile(%v) = %d WANT: %d within 3%%", test.fraction, p, test.expected)
+		}
+	}
+
+	if h.maxValue() != 45000 || h.percentile(1) != 45000 {
+		t.Errorf("max = %d, percentile(1) = %d WANT: 45000", h.maxValue(), h.percentile(1))
+	}
+}
+
+func TestLogLinearObservable(t *testing.T) {
+	a := new(logLinearHistogram)
+	b := new(logLinearHistogram)
+	c := new(logLinearHistogram)
+	for _, v := range []int64{4, 12, 100} {
+		a.addMeasurement(v)
+		c.addMeasurement(v)
+	}
+	for _, v := range []int64{18, 36, 255} {
+		b.addMeasurement(v)
+		c.addMeasurement(v)
+	}
+
+	a.Add(b)
+	if a.String() != c.String() {
+		t.Errorf("a.String = %q WANT: %q", a.String(), c.String())
+	}
+
+	d := new(logLinearHistogram)
+	d.CopyFrom(a)
+	if d.String() != a.String() {
+		t.Errorf("d.String = %q WANT: %q", d.String(), a.String())
+	}
+
+	d.Multiply(2)
+	if d.total() != 12 || d.sum != 2*a.sum {
+		t.Errorf("multiplied total = %d, sum = %d WANT: 12, %d", d.total(), d.sum, 2*a.sum)
+	}
+
+	d.Clear()
+	if d.String() != new(logLinearHistogram).String() {
+		t.Errorf("d.String = %q WANT: empty", d.String())
+	}
+
+	var total int64
+	for _, n := range a.log2Counts() {
+		total += n
+	}
+	if total != a.total() {
+		t.Errorf("log2 projection has %d observations WANT: %d", total, a.total())
+	}
+}
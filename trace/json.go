@@ -0,0 +1,494 @@
+package trace
+
+// This file implements the JSON representations of /debug/requests
+// and /debug/events.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kisom/httpdebug/trace/timeseries"
+)
+
+// Requests is the JSON representation of the traces served at
+// /debug/requests. If a search was requested, its results are
+// returned instead of the families.
+type Requests struct {
+	Families    []*RequestFamily `json:"families"`
+	Search      []*TraceRecord   `json:"search,omitempty"`
+	SearchError string           `json:"search_error,omitempty"`
+	Waterfall   *Waterfall       `json:"waterfall,omitempty"`
+}
+
+// RequestFamily contains the traces and latency statistics for a
+// family of traces.
+type RequestFamily struct {
+	Family       string                       `json:"family"`
+	Active       int                          `json:"active"`
+	ActiveTraces []*TraceRecord               `json:"active_traces,omitempty"`
+	Buckets      []*RequestBucket             `json:"buckets"`
+	Latency      map[string]*LatencyHistogram `json:"latency"`
+}
+
+// RequestBucket contains the completed traces in one of a family's
+// buckets, such as those taking longer than 100ms, or those that
+// resulted in an error.
+type RequestBucket struct {
+	Cond   string         `json:"cond"`
+	Traces []*TraceRecord `json:"traces"`
+}
+
+// TraceRecord is the JSON representation of a trace.
+type TraceRecord struct {
+	Family   string        `json:"family"`
+	Title    string        `json:"title"`
+	Start    time.Time     `json:"start"`
+	Elapsed  time.Duration `json:"elapsed_ns"`
+	Active   bool          `json:"active,omitempty"`
+	IsError  bool          `json:"error"`
+	TraceID  string        `json:"trace_id,omitempty"`
+	SpanID   string        `json:"span_id,omitempty"`
+	ParentID string        `json:"parent_id,omitempty"`
+	Attrs    []*AttrRecord `json:"attrs,omitempty"`
+	Events   []*TraceEvent `json:"events"`
+}
+
+// TraceEvent is the JSON representation of an event in a trace. The
+// text of sensitive events is omitted unless the request is permitted
+// to see them.
+type TraceEvent struct {
+	When      time.Time     `json:"when"`
+	Elapsed   time.Duration `json:"elapsed_ns"` // since the previous event
+	Sensitive bool          `json:"sensitive,omitempty"`
+	Redacted  bool          `json:"redacted,omitempty"`
+	What      string        `json:"what,omitempty"`
+	Attrs     []*AttrRecord `json:"attrs,omitempty"`
+}
+
+// LatencyHistogram summarises the latency of a family's traces over
+// a window. Latencies are in microseconds. Unless the family uses
+// high-resolution histograms (see HighResolutionLatency), Max is the
+// upper bound of the highest non-empty bucket.
+type LatencyHistogram struct {
+	Count             int64              `json:"count"`
+	Mean              float64            `json:"mean"`
+	StandardDeviation float64            `json:"stddev"`
+	Median            int64              `json:"median"`
+	P50               int64              `json:"p50"`
+	P90               int64              `json:"p90"`
+	P95               int64              `json:"p95"`
+	P99               int64              `json:"p99"`
+	P999              int64              `json:"p999"`
+	Max               int64              `json:"max"`
+	Buckets           []*HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket is a non-empty histogram bucket, counting the
+// observations in [Lower, Upper).
+type HistogramBucket struct {
+	Lower int64 `json:"lower"`
+	Upper int64 `json:"upper"`
+	N     int64 `json:"n"`
+}
+
+// wantsJSON returns true if the client asked for JSON, either with
+// the format parameter or the Accept header.
+func wantsJSON(req *http.Request) bool {
+	if req.FormValue("format") == "json" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// showSensitive applies the show_sensitive parameter to the result of
+// the authenticator.
+func showSensitive(req *http.Request, sensitive bool) bool {
+	// As with the HTML page, show_sensitive=0 hides sensitive data
+	// but show_sensitive=1 can't reveal it.
+	if req != nil && req.FormValue("show_sensitive") == "0" {
+		return false
+	}
+	return sensitive
+}
+
+// newTraceEvent returns the JSON representation of an event.
+func newTraceEvent(e event, sensitive bool) *TraceEvent {
+	te := &TraceEvent{
+		When:      e.When,
+		Elapsed:   e.Elapsed,
+		Sensitive: e.Sensitive,
+	}
+
+	if e.Sensitive && !sensitive {
+		te.Redacted = true
+	} else {
+		te.What = fmt.Sprint(e.What)
+		te.Attrs = newAttrRecords(e.Attrs, sensitive)
+	}
+	return te
+}
+
+// newTraceRecord returns the JSON representation of a trace.
+func newTraceRecord(tr *trace, sensitive bool) *TraceRecord {
+	rec := &TraceRecord{
+		Family:  tr.Family,
+		Title:   tr.Title,
+		Start:   tr.Start,
+		Elapsed: tr.Elapsed,
+		IsError: tr.IsError,
+	}
+
+	if tr.traceID.IsValid() {
+		rec.TraceID = tr.traceID.String()
+	}
+	if tr.spanID.IsValid() {
+		rec.SpanID = tr.spanID.String()
+	}
+	if tr.parentID.IsValid() {
+		rec.ParentID = tr.parentID.String()
+	}
+
+	if rec.Elapsed == 0 {
+		rec.Active = true
+		rec.Elapsed = time.Since(tr.Start)
+	}
+
+	rec.Attrs = newAttrRecords(tr.Attrs(), sensitive)
+	events := tr.Events()
+	rec.Events = make([]*TraceEvent, 0, len(events))
+	for _, e := range events {
+		rec.Events = append(rec.Events, newTraceEvent(e, sensitive))
+	}
+	return rec
+}
+
+// newTraceRecords returns the JSON representation of the traces.
+func newTraceRecords(trl traceList, sensitive bool) []*TraceRecord {
+	recs := make([]*TraceRecord, 0, len(trl))
+	for _, tr := range trl {
+		recs = append(recs, newTraceRecord(tr, sensitive))
+	}
+	return recs
+}
+
+// newLatencyHistogram returns the JSON representation of a
+// histogram. It doesn't modify h, so it is safe to call with a read
+// lock held.
+func newLatencyHistogram(h latencyHistogram) *LatencyHistogram {
+	lh := &LatencyHistogram{
+		Count:             h.total(),
+		Mean:              h.average(),
+		StandardDeviation: h.standardDeviation(),
+		Median:            h.percentile(0.5),
+		P50:               h.percentile(0.5),
+		P90:               h.percentile(0.9),
+		P95:               h.percentile(0.95),
+		P99:               h.percentile(0.99),
+		P999:              h.percentile(0.999),
+		Max:               h.maxValue(),
+		Buckets:           h.nonEmptyBuckets(),
+	}
+
+	if lh.Buckets == nil {
+		lh.Buckets = []*HistogramBucket{}
+	}
+	return lh
+}
+
+// latencyWindows returns the JSON representation of the family's
+// latency histograms over the last minute, the last hour, and all
+// time. Reading the time series merges its pending updates, so the
+// write lock is required.
+func (f *family) latencyWindows() map[string]*LatencyHistogram {
+	f.LatencyMu.Lock()
+	defer f.LatencyMu.Unlock()
+
+	windows := map[string]timeseries.Observable{
+		"minute": f.Latency.Minute(),
+		"hour":   f.Latency.Hour(),
+		"total":  f.Latency.Total(),
+	}
+
+	latency := make(map[string]*LatencyHistogram, len(windows))
+	for window, obs := range windows {
+		latency[window] = newLatencyHistogram(obs.(latencyHistogram))
+	}
+	return latency
+}
+
+// CollectRequests returns the traces typically served at
+// /debug/requests. If fam is not empty, only that family is
+// included. Sensitive events are redacted unless sensitive is true.
+func CollectRequests(fam string, sensitive bool) *Requests {
+	completedMu.RLock()
+	families := make([]string, 0, len(completedTraces))
+	for name := range completedTraces {
+		if fam == "" || name == fam {
+			families = append(families, name)
+		}
+	}
+	completedMu.RUnlock()
+	sort.Strings(families)
+
+	reqs := &Requests{Families: make([]*RequestFamily, 0, len(families))}
+	for _, name := range families {
+		f := getFamily(name, false)
+		if f == nil {
+			continue
+		}
+
+		rf := &RequestFamily{
+			Family:  name,
+			Buckets: make([]*RequestBucket, 0, len(f.Buckets)),
+			Latency: f.latencyWindows(),
+		}
+
+		if s := getActiveSet(name); s != nil {
+			rf.Active = s.Len()
+		}
+
+		active := getActiveTraces(name)
+		sort.Sort(active)
+		rf.ActiveTraces = newTraceRecords(active, sensitive)
+
+		for _, b := range f.Buckets {
+			trl := b.Copy(false)
+			sort.Sort(trl)
+			rf.Buckets = append(rf.Buckets, &RequestBucket{
+				Cond:   b.Cond.String(),
+				Traces: newTraceRecords(trl, sensitive),
+			})
+		}
+
+		reqs.Families = append(reqs.Families, rf)
+	}
+
+	return reqs
+}
+
+// RenderJSON writes the JSON representation of the traces typically
+// served at /debug/requests. Like Render, it does not do any auth
+// checking. If req is not nil, its fam parameter restricts the output
+// to one family, show_sensitive=0 hides sensitive events, and the
+// search parameters described in ParseFilter select traces.
+func RenderJSON(w io.Writer, req *http.Request, sensitive bool) {
+	var fam string
+	if req != nil {
+		fam = req.FormValue("fam")
+	}
+
+	sensitive = showSensitive(req, sensitive)
+	var reqs *Requests
+	filter, ok, err := ParseFilter(req)
+	switch {
+	case err != nil:
+		reqs = &Requests{Families: []*RequestFamily{}, SearchError: err.Error()}
+	case ok:
+		reqs = &Requests{Families: []*RequestFamily{}, Search: Search(filter, sensitive)}
+	case req != nil && req.FormValue("trace") != "":
+		reqs = &Requests{Families: []*RequestFamily{}}
+		if id, err := ParseTraceID(req.FormValue("trace")); err != nil {
+			reqs.SearchError = err.Error()
+		} else {
+			reqs.Waterfall = CollectWaterfall(id, sensitive)
+		}
+	default:
+		reqs = CollectRequests(fam, sensitive)
+	}
+
+	if err := json.NewEncoder(w).Encode(reqs); err != nil {
+		log.Printf("net/trace: failed to write JSON: %v", err)
+	}
+}
+
+// Events is the JSON representation of the event logs served at
+// /debug/events.
+type Events struct {
+	Families []*EventFamily `json:"families"`
+}
+
+// EventFamily contains the number of event logs in a family by the
+// age of their last error, and the event logs themselves.
+type EventFamily struct {
+	Family    string            `json:"family"`
+	Counts    []*EventCount     `json:"counts"`
+	EventLogs []*EventLogRecord `json:"event_logs"`
+}
+
+// EventCount is the number of event logs in a family with an error
+// more recent than MaxErrAge; a zero MaxErrAge counts every event log.
+type EventCount struct {
+	Bucket    string        `json:"bucket"`
+	MaxErrAge time.Duration `json:"max_err_age_ns"`
+	Count     int           `json:"count"`
+}
+
+// EventLogRecord is the JSON representation of an event log.
+type EventLogRecord struct {
+	Family        string        `json:"family"`
+	Title         string        `json:"title"`
+	Start         time.Time     `json:"start"`
+	LastErrorTime *time.Time    `json:"last_error_time,omitempty"`
+	Events        []*LogEvent   `json:"events"`
+	Discarded     int           `json:"discarded"`
+	Stack         []*StackFrame `json:"stack"`
+}
+
+// LogEvent is the JSON representation of an event in an event log.
+type LogEvent struct {
+	When    time.Time     `json:"when"`
+	Elapsed time.Duration `json:"elapsed_ns"` // since the previous event
+	IsError bool          `json:"error,omitempty"`
+	What    string        `json:"what"`
+}
+
+// StackFrame is a frame in the call stack where an event log was
+// created.
+type StackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// stackFrames returns the frames in the stack, omitting the runtime
+// functions as printStackRecord does.
+func stackFrames(stk []uintptr) []*StackFrame {
+	frames := make([]*StackFrame, 0, len(stk))
+	for _, pc := range stk {
+		f := runtime.FuncForPC(pc)
+		if f == nil {
+			continue
+		}
+
+		name := f.Name()
+		if strings.HasPrefix(name, "runtime.") {
+			continue
+		}
+
+		file, line := f.FileLine(pc)
+		frames = append(frames, &StackFrame{
+			Function: name,
+			File:     file,
+			Line:     line,
+		})
+	}
+	return frames
+}
+
+// counts returns the number of event logs in the family for each
+// error age bucket.
+func (f *eventFamily) counts(now time.Time) []*EventCount {
+	counts := make([]*EventCount, 0, len(buckets))
+	for _, b := range buckets {
+		counts = append(counts, &EventCount{
+			Bucket:    b.String,
+			MaxErrAge: b.MaxErrAge,
+			Count:     f.Count(now, b.MaxErrAge),
+		})
+	}
+	return counts
+}
+
+// eventFamilyNames returns the names of the event families, sorted.
+// If fam is not empty, only that family is returned.
+func eventFamilyNames(fam string) []string {
+	famMu.RLock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		if fam == "" || name == fam {
+			names = append(names, name)
+		}
+	}
+	famMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// newEventLogRecord returns the JSON representation of an event log.
+func newEventLogRecord(el *eventLog) *EventLogRecord {
+	rec := &EventLogRecord{
+		Family: el.Family,
+		Title:  el.Title,
+		Start:  el.Start,
+		Stack:  stackFrames(el.stack),
+	}
+
+	el.mu.RLock()
+	if !el.LastErrorTime.IsZero() {
+		last := el.LastErrorTime
+		rec.LastErrorTime = &last
+	}
+	rec.Discarded = el.discarded
+	rec.Events = make([]*LogEvent, 0, len(el.events))
+	for _, e := range el.events {
+		rec.Events = append(rec.Events, &LogEvent{
+			When:    e.When,
+			Elapsed: e.Elapsed,
+			IsError: e.IsErr,
+			What:    e.What,
+		})
+	}
+	el.mu.RUnlock()
+
+	return rec
+}
+
+// CollectEvents returns the event logs typically served at
+// /debug/events. If fam is not empty, only that family is included.
+// Only event logs with an error more recent than maxErrAge are
+// included, unless maxErrAge is zero.
+func CollectEvents(fam string, maxErrAge time.Duration) *Events {
+	now := time.Now()
+	names := eventFamilyNames(fam)
+
+	evs := &Events{Families: make([]*EventFamily, 0, len(names))}
+	for _, name := range names {
+		f := getEventFamily(name)
+		ef := &EventFamily{Family: name}
+
+		ef.Counts = f.counts(now)
+
+		els := f.Copy(now, maxErrAge)
+		sort.Sort(els)
+		ef.EventLogs = make([]*EventLogRecord, 0, len(els))
+		for _, el := range els {
+			ef.EventLogs = append(ef.EventLogs, newEventLogRecord(el))
+		}
+
+		evs.Families = append(evs.Families, ef)
+	}
+
+	return evs
+}
+
+// RenderEventsJSON writes the JSON representation of the event logs
+// typically served at /debug/events. Like RenderEvents, it does not
+// do any auth checking. If req is not nil, its fam parameter
+// restricts the output to one family, and its b parameter to the
+// event logs in one of the error age buckets.
+func RenderEventsJSON(w io.Writer, req *http.Request) {
+	var (
+		fam       string
+		maxErrAge time.Duration
+	)
+
+	if req != nil {
+		fam = req.FormValue("fam")
+		if b, err := strconv.Atoi(req.FormValue("b")); err == nil && b >= 0 && b < len(buckets) {
+			maxErrAge = buckets[b].MaxErrAge
+		}
+	}
+
+	evs := CollectEvents(fam, maxErrAge)
+	if err := json.NewEncoder(w).Encode(evs); err != nil {
+		log.Printf("net/trace: failed to write JSON: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package trace
+
+// This file implements a higher-resolution histogram for latency
+// statistics.
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+
+	"github.com/kisom/httpdebug/trace/timeseries"
+)
+
+// HighResolutionLatency controls whether trace families record their
+// latency in log-linear histograms, which estimate percentiles to
+// within about 3%, rather than in the default log2 histograms, which
+// only place them within a power of two. The log-linear histograms
+// use more memory. It only affects families created after it is set.
+var HighResolutionLatency = false
+
+const (
+	// subBucketBits sets the number of linear sub-buckets each
+	// power of two is divided into.
+	subBucketBits  = 5
+	subBucketCount = 1 << subBucketBits
+)
+
+// logLinearIndex returns the index of the bucket holding v. Values
+// below subBucketCount have a bucket each; above that, each power of
+// two is divided into subBucketCount equal buckets.
+func logLinearIndex(v int64) int {
+	if v < subBucketCount {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+
+	exp := log2(v) - 1 // v is in [2^exp, 2^(exp+1))
+	shift := uint(exp - subBucketBits)
+	sub := int(v>>shift) - subBucketCount
+	return subBucketCount + (exp-subBucketBits)*subBucketCount + sub
+}
+
+// logLinearBounds returns the range [lower, upper) of values in the
+// bucket with the given index.
+func logLinearBounds(i int) (lower, upper int64) {
+	if i < subBucketCount {
+		return int64(i), int64(i + 1)
+	}
+
+	shift := uint((i - subBucketCount) / subBucketCount)
+	sub := int64((i - subBucketCount) % subBucketCount)
+	return (subBucketCount + sub) << shift, (subBucketCount + sub + 1) << shift
+}
+
+// logLinearHistogram keeps counts of values in log-linear buckets. As
+// most histograms in a time series hold few distinct values, the
+// buckets are stored sparsely, and a single bucket is kept without
+// allocating as histogram does.
+// logLinearHistogram implements timeseries.Observable
+type logLinearHistogram struct {
+	sum          int64         // running total of measurements
+	sumOfSquares float64       // square of running total
+	max          int64         // largest measurement
+	counts       map[int]int64 // bucketed values, if more than one bucket is used
+	value        int           // holds a single bucket index as an optimization
+	valueCount   int64         // number of values recorded for the single bucket
+}
+
+func newLogLinearHistogram() latencyHistogram {
+	return new(logLinearHistogram)
+}
+
+// allocateCounts moves the single bucket into the counts map.
+func (h *logLinearHistogram) allocateCounts() {
+	if h.counts == nil {
+		h.counts = map[int]int64{}
+		if h.valueCount > 0 {
+			h.counts[h.value] = h.valueCount
+		}
+		h.value = 0
+		h.valueCount = 0
+	}
+}
+
+func (h *logLinearHistogram) addMeasurement(value int64) {
+	h.sum += value
+	h.sumOfSquares += float64(value) * float64(value)
+	if value > h.max {
+		h.max = value
+	}
+
+	i := logLinearIndex(value)
+	if h.counts == nil && (h.valueCount == 0 || h.value == i) {
+		h.value = i
+		h.valueCount++
+		return
+	}
+
+	h.allocateCounts()
+	h.counts[i]++
+}
+
+// sortedCounts returns the non-empty bucket indices in order, and the
+// count for each. It doesn't modify h.
+func (h *logLinearHistogram) sortedCounts() ([]int, []int64) {
+	if h.counts == nil {
+		if h.valueCount <= 0 {
+			return nil, nil
+		}
+		return []int{h.value}, []int64{h.valueCount}
+	}
+
+	indices := make([]int, 0, len(h.counts))
+	for i, n := range h.counts {
+		if n > 0 {
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+
+	counts := make([]int64, len(indices))
+	for j, i := range indices {
+		counts[j] = h.counts[i]
+	}
+	return indices, counts
+}
+
+func (h *logLinearHistogram) total() (total int64) {
+	if h.counts == nil {
+		return h.valueCount
+	}
+	for _, n := range h.counts {
+		total += n
+	}
+	return
+}
+
+func (h *logLinearHistogram) average() float64 {
+	t := h.total()
+	if t == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(t)
+}
+
+func (h *logLinearHistogram) variance() float64 {
+	t := float64(h.total())
+	if t == 0 {
+		return 0
+	}
+	s := float64(h.sum) / t
+	return h.sumOfSquares/t - s*s
+}
+
+func (h *logLinearHistogram) standardDeviation() float64 {
+	return math.Sqrt(h.variance())
+}
+
+// percentile estimates the value that the given fraction of recorded
+// observations are less than, interpolating within its bucket.
+func (h *logLinearHistogram) percentile(fraction float64) int64 {
+	indices, counts := h.sortedCounts()
+	total := int64(0)
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := fraction * float64(total)
+	var running int64
+	for j, i := range indices {
+		n := counts[j]
+		if float64(running+n) >= rank {
+			lower, upper := logLinearBounds(i)
+			within := (rank - float64(running)) / float64(n)
+			v := lower + round(within*float64(upper-lower))
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+		running += n
+	}
+	return h.max
+}
+
+func (h *logLinearHistogram) maxValue() int64 {
+	return h.max
+}
+
+func (h *logLinearHistogram) sumValue() int64 {
+	return h.sum
+}
+
+func (h *logLinearHistogram) nonEmptyBuckets() []*HistogramBucket {
+	indices, counts := h.sortedCounts()
+	buckets := make([]*HistogramBucket, 0, len(indices))
+	for j, i := range indices {
+		lower, upper := logLinearBounds(i)
+		buckets = append(buckets, &HistogramBucket{Lower: lower, Upper: upper, N: counts[j]})
+	}
+	return buckets
+}
+
+// log2Counts projects the buckets onto the log2 buckets used by
+// histogram, each of which contains whole log-linear buckets.
+func (h *logLinearHistogram) log2Counts() []int64 {
+	counts := make([]int64, bucketCount)
+	indices, n := h.sortedCounts()
+	for j, i := range indices {
+		lower, _ := logLinearBounds(i)
+		counts[getBucket(lower)] += n[j]
+	}
+	return counts
+}
+
+// Add adds other to h.
+func (h *logLinearHistogram) Add(other timeseries.Observable) {
+	o := other.(*logLinearHistogram)
+	switch {
+	case o.total() == 0:
+		// Other histogram is empty.
+	case h.counts == nil && o.counts == nil && (h.valueCount == 0 || h.value == o.value):
+		h.value = o.value
+		h.valueCount += o.valueCount
+	default:
+		h.allocateCounts()
+		if o.counts == nil {
+			h.counts[o.value] += o.valueCount
+		} else {
+			for i, n := range o.counts {
+				h.counts[i] += n
+			}
+		}
+	}
+
+	h.sum += o.sum
+	h.sumOfSquares += o.sumOfSquares
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// Clear resets the histogram to an empty state, removing all observed values.
+func (h *logLinearHistogram) Clear() {
+	h.sum = 0
+	h.sumOfSquares = 0
+	h.max = 0
+	h.counts = nil
+	h.value = 0
+	h.valueCount = 0
+}
+
+// CopyFrom copies from other, which must be a *logLinearHistogram, into h.
+func (h *logLinearHistogram) CopyFrom(other timeseries.Observable) {
+	o := other.(*logLinearHistogram)
+	h.Clear()
+	h.sum = o.sum
+	h.sumOfSquares = o.sumOfSquares
+	h.max = o.max
+	h.value = o.value
+	h.valueCount = o.valueCount
+	if o.counts != nil {
+		h.counts = make(map[int]int64, len(o.counts))
+		for i, n := range o.counts {
+			h.counts[i] = n
+		}
+	}
+}
+
+// Multiply scales the histogram by the specified ratio.
+func (h *logLinearHistogram) Multiply(ratio float64) {
+	if h.counts == nil {
+		h.valueCount = int64(float64(h.valueCount) * ratio)
+	} else {
+		for i, n := range h.counts {
+			h.counts[i] = int64(float64(n) * ratio)
+		}
+	}
+	h.sum = int64(float64(h.sum) * ratio)
+	h.sumOfSquares = h.sumOfSquares * ratio
+}
+
+func (h *logLinearHistogram) String() string {
+	return fmt.Sprintf("%d, %f, %d, %d, %d, %v",
+		h.sum, h.sumOfSquares, h.max, h.value, h.valueCount, h.counts)
+}
+
+func (h *logLinearHistogram) html() template.HTML {
+	return histogramHTML(h)
+}
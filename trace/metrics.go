@@ -0,0 +1,199 @@
+package trace
+
+// This file implements the Prometheus and OpenMetrics exposition of
+// the trace and event log statistics.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Content types for the metrics exposition formats.
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// labelEscaper escapes label values in the exposition formats.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a sample value or bucket bound.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsWriter writes metrics in either the Prometheus text format
+// or the OpenMetrics text format.
+type metricsWriter struct {
+	buf         *bytes.Buffer
+	openMetrics bool
+}
+
+// header writes the HELP and TYPE lines for a metric family. In
+// OpenMetrics, a counter's family name omits the _total suffix.
+func (mw *metricsWriter) header(name, typ, help string) {
+	if mw.openMetrics && typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(mw.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(mw.buf, "# TYPE %s %s\n", name, typ)
+}
+
+// sample writes a sample; labels alternate between names and values.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(mw.buf, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.buf.WriteByte('}')
+	}
+	fmt.Fprintf(mw.buf, " %s\n", formatFloat(value))
+}
+
+// familyMetrics is a snapshot of a trace family's statistics.
+type familyMetrics struct {
+	name      string
+	completed int64
+	errors    int64
+	active    int
+	counts    []int64 // observations in each latency bucket
+	total     int64   // total observations
+	sum       int64   // total latency in microseconds
+}
+
+// collectFamilyMetrics returns a snapshot of each trace family's
+// statistics, sorted by name.
+func collectFamilyMetrics() []*familyMetrics {
+	completedMu.RLock()
+	names := make([]string, 0, len(completedTraces))
+	for name := range completedTraces {
+		names = append(names, name)
+	}
+	completedMu.RUnlock()
+	sort.Strings(names)
+
+	fms := make([]*familyMetrics, 0, len(names))
+	for _, name := range names {
+		f := getFamily(name, false)
+		if f == nil {
+			continue
+		}
+
+		fm := &familyMetrics{
+			name:      name,
+			completed: atomic.LoadInt64(&f.completed),
+			errors:    atomic.LoadInt64(&f.errors),
+		}
+
+		if s := getActiveSet(name); s != nil {
+			fm.active = s.Len()
+		}
+
+		f.LatencyMu.Lock()
+		h := f.Latency.Total().(latencyHistogram)
+		fm.counts = h.log2Counts()
+		fm.total = h.total()
+		fm.sum = h.sumValue()
+		f.LatencyMu.Unlock()
+
+		fms = append(fms, fm)
+	}
+	return fms
+}
+
+// writeLatency writes the latency histogram for a family. The
+// histogram's log2 buckets are in microseconds; they are exposed in
+// seconds, with every bucket present so that the series are stable.
+func (mw *metricsWriter) writeLatency(fm *familyMetrics) {
+	var cumulative int64
+	for i := 0; i < bucketCount-1; i++ {
+		cumulative += fm.counts[i]
+		le := float64(bucketBoundary(uint8(i+1))) / 1e6
+		mw.sample("trace_request_duration_seconds_bucket", float64(cumulative),
+			"family", fm.name, "le", formatFloat(le))
+	}
+
+	cumulative += fm.counts[bucketCount-1]
+	mw.sample("trace_request_duration_seconds_bucket", float64(cumulative),
+		"family", fm.name, "le", "+Inf")
+	mw.sample("trace_request_duration_seconds_sum", float64(fm.sum)/1e6, "family", fm.name)
+	mw.sample("trace_request_duration_seconds_count", float64(fm.total), "family", fm.name)
+}
+
+// RenderMetrics writes the trace and event log statistics in the
+// Prometheus text format, or in the OpenMetrics text format if
+// openMetrics is true. Like Render, it does not do any auth checking.
+func RenderMetrics(w io.Writer, openMetrics bool) error {
+	mw := &metricsWriter{
+		buf:         new(bytes.Buffer),
+		openMetrics: openMetrics,
+	}
+
+	fms := collectFamilyMetrics()
+
+	mw.header("trace_requests_total", "counter", "Completed traces.")
+	for _, fm := range fms {
+		mw.sample("trace_requests_total", float64(fm.completed), "family", fm.name)
+	}
+
+	mw.header("trace_request_errors_total", "counter", "Completed traces that resulted in an error.")
+	for _, fm := range fms {
+		mw.sample("trace_request_errors_total", float64(fm.errors), "family", fm.name)
+	}
+
+	mw.header("trace_active_requests", "gauge", "Active traces.")
+	for _, fm := range fms {
+		mw.sample("trace_active_requests", float64(fm.active), "family", fm.name)
+	}
+
+	mw.header("trace_request_duration_seconds", "histogram", "Latency of completed traces.")
+	for _, fm := range fms {
+		mw.writeLatency(fm)
+	}
+
+	now := time.Now()
+	mw.header("trace_event_logs", "gauge", "Active event logs, by the age of their most recent error.")
+	for _, name := range eventFamilyNames("") {
+		for _, c := range getEventFamily(name).counts(now) {
+			mw.sample("trace_event_logs", float64(c.Count), "family", name, "bucket", c.Bucket)
+		}
+	}
+
+	names, stats := exportStats()
+	mw.header("trace_exported_spans_total", "counter", "Completed traces exported.")
+	for _, name := range names {
+		mw.sample("trace_exported_spans_total", float64(stats[name].Exported), "exporter", name)
+	}
+
+	mw.header("trace_export_failed_spans_total", "counter", "Completed traces in batches that failed to export.")
+	for _, name := range names {
+		mw.sample("trace_export_failed_spans_total", float64(stats[name].Failed), "exporter", name)
+	}
+
+	mw.header("trace_export_dropped_spans_total", "counter", "Completed traces dropped because an export queue was full.")
+	for _, name := range names {
+		mw.sample("trace_export_dropped_spans_total", float64(stats[name].Dropped), "exporter", name)
+	}
+
+	if openMetrics {
+		mw.buf.WriteString("# EOF\n")
+	}
+
+	_, err := mw.buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,152 @@
+package trace
+
+// This file implements HTTP server middleware that traces each
+// request.
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kisom/httpdebug/internal/response"
+)
+
+// DefaultMiddlewareFamily is the family of the traces created by
+// MiddlewareWithOptions unless an option names them otherwise.
+const DefaultMiddlewareFamily = "http"
+
+// middleware traces the requests to a handler.
+type middleware struct {
+	h       http.Handler
+	family  func(*http.Request) string
+	sampler func(*http.Request) bool
+}
+
+// A MiddlewareOption configures a handler returned by
+// MiddlewareWithOptions.
+type MiddlewareOption func(*middleware)
+
+// WithFamily puts every trace in the given family.
+func WithFamily(family string) MiddlewareOption {
+	return func(m *middleware) {
+		m.family = func(*http.Request) string {
+			return family
+		}
+	}
+}
+
+// WithMethodFamily puts each trace in a family named for the request
+// method, e.g. "http GET".
+func WithMethodFamily() MiddlewareOption {
+	return func(m *middleware) {
+		m.family = func(req *http.Request) string {
+			return DefaultMiddlewareFamily + " " + req.Method
+		}
+	}
+}
+
+// WithRouteFamily puts each trace in a family named for the pattern
+// in mux that matches the request, e.g. "/users/". Requests that don't
+// match any pattern go in the default family.
+func WithRouteFamily(mux *http.ServeMux) MiddlewareOption {
+	return func(m *middleware) {
+		m.family = func(req *http.Request) string {
+			if _, pattern := mux.Handler(req); pattern != "" {
+				return pattern
+			}
+			return DefaultMiddlewareFamily
+		}
+	}
+}
+
+// WithFamilyFunc names each trace's family with f.
+func WithFamilyFunc(f func(*http.Request) string) MiddlewareOption {
+	return func(m *middleware) {
+		m.family = f
+	}
+}
+
+// WithSampler traces only the requests for which sampled returns
+// true. Requests continuing a sampled trace from a traceparent header
+// are always traced.
+func WithSampler(sampled func(*http.Request) bool) MiddlewareOption {
+	return func(m *middleware) {
+		m.sampler = sampled
+	}
+}
+
+// WithSampleRate traces the given fraction of requests, chosen at
+// random, as for WithSampler.
+func WithSampleRate(rate float64) MiddlewareOption {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return WithSampler(func(*http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64() < rate
+	})
+}
+
+// Middleware returns a handler that traces each request to h in the
+// given family; see MiddlewareWithOptions.
+func Middleware(family string, h http.Handler) http.Handler {
+	return MiddlewareWithOptions(h, WithFamily(family))
+}
+
+// MiddlewareWithOptions returns a handler that traces each request to
+// h, titled by the request's method and path. The trace records the
+// response's status and size, and is marked as an error if the status
+// is 5xx or h panics. It is a child of the span in the request's
+// traceparent header, if any, and is bound to the request's context
+// with NewContext, so that handlers may log to it and start child
+// spans with StartSpan. Its span context is returned to the client in
+// the traceresponse header.
+func MiddlewareWithOptions(h http.Handler, opts ...MiddlewareOption) http.Handler {
+	m := &middleware{h: h}
+	WithFamily(DefaultMiddlewareFamily)(m)
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *middleware) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	parent, ok := Extract(req.Header)
+	if ok {
+		ctx = ContextWithRemoteSpan(ctx, parent)
+	}
+
+	if m.sampler != nil && !parent.Sampled && !m.sampler(req) {
+		m.h.ServeHTTP(w, req.WithContext(ctx))
+		return
+	}
+
+	tr, ctx := StartSpan(ctx, m.family(req), req.Method+" "+req.URL.Path)
+	tr.SetAttrs(String("http.method", req.Method), String("http.path", req.URL.Path))
+	w.Header().Set(TraceresponseHeader, tr.SpanContext().Traceparent())
+
+	resp, w := response.Record(w)
+	defer func() {
+		if r := recover(); r != nil {
+			tr.LazyPrintf("panic: %v", r)
+			tr.SetError()
+			tr.Finish()
+			panic(r)
+		}
+
+		status := resp.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		tr.SetAttrs(Int("http.status_code", int64(status)), Int("http.response_size", resp.Bytes()))
+		tr.LazyPrintf("%d %s, %d bytes", status, http.StatusText(status), resp.Bytes())
+		if status >= 500 {
+			tr.SetError()
+		}
+		tr.Finish()
+	}()
+
+	m.h.ServeHTTP(w, req.WithContext(ctx))
+}
@@ -0,0 +1,311 @@
+package trace
+
+// This file implements gRPC-style interceptors that trace each RPC.
+// They are defined against their own function types, which mirror
+// grpc-go's, so that the package doesn't depend on gRPC. A service
+// adapts them to grpc-go with the interceptors below, installed with
+// grpc.UnaryInterceptor, grpc.StreamInterceptor,
+// grpc.WithUnaryInterceptor, and grpc.WithStreamInterceptor. The
+// streams passed to grpc-go wrap the traced streams, so that the
+// handler and client see the traced Context, SendMsg, and RecvMsg
+// along with the rest of grpc.ServerStream and grpc.ClientStream.
+// The trace context is propagated in the traceparent metadata.
+//
+//	type serverStream struct {
+//		grpc.ServerStream
+//		traced trace.ServerStream
+//	}
+//
+//	func (s serverStream) Context() context.Context     { return s.traced.Context() }
+//	func (s serverStream) SendMsg(m interface{}) error { return s.traced.SendMsg(m) }
+//	func (s serverStream) RecvMsg(m interface{}) error { return s.traced.RecvMsg(m) }
+//
+//	type clientStream struct {
+//		grpc.ClientStream
+//		traced trace.ClientStream
+//	}
+//
+//	func (s clientStream) Context() context.Context     { return s.traced.Context() }
+//	func (s clientStream) SendMsg(m interface{}) error { return s.traced.SendMsg(m) }
+//	func (s clientStream) RecvMsg(m interface{}) error { return s.traced.RecvMsg(m) }
+//	func (s clientStream) CloseSend() error            { return s.traced.CloseSend() }
+//
+//	func unaryServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+//		handler grpc.UnaryHandler) (interface{}, error) {
+//		md, _ := metadata.FromIncomingContext(ctx)
+//		return trace.UnaryServerInterceptor(ctx, md, req, info.FullMethod, trace.UnaryHandler(handler))
+//	}
+//
+//	func streamServer(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+//		handler grpc.StreamHandler) error {
+//		md, _ := metadata.FromIncomingContext(ss.Context())
+//		return trace.StreamServerInterceptor(srv, ss, md, info.FullMethod,
+//			func(srv interface{}, traced trace.ServerStream) error {
+//				return handler(srv, serverStream{ss, traced})
+//			})
+//	}
+//
+//	func unaryClient(ctx context.Context, method string, req, reply interface{},
+//		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+//		return trace.UnaryClientInterceptor(ctx, method, req, reply,
+//			func(ctx context.Context, method string, req, reply interface{}) error {
+//				ctx = metadata.AppendToOutgoingContext(ctx, trace.OutgoingMetadata(ctx)...)
+//				return invoker(ctx, method, req, reply, cc, opts...)
+//			})
+//	}
+//
+//	func streamClient(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+//		method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+//		var stream grpc.ClientStream
+//		traced, err := trace.StreamClientInterceptor(ctx, method,
+//			func(ctx context.Context, method string) (trace.ClientStream, error) {
+//				ctx = metadata.AppendToOutgoingContext(ctx, trace.OutgoingMetadata(ctx)...)
+//				var err error
+//				stream, err = streamer(ctx, desc, cc, method, opts...)
+//				return stream, err
+//			})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return clientStream{stream, traced}, nil
+//	}
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// UnaryHandler handles a unary RPC, as grpc.UnaryHandler.
+type UnaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// UnaryInvoker makes a unary RPC, as grpc.UnaryInvoker with the
+// connection and call options bound.
+type UnaryInvoker func(ctx context.Context, method string, req, reply interface{}) error
+
+// ServerStream is the part of grpc.ServerStream that the stream
+// interceptors use.
+type ServerStream interface {
+	Context() context.Context
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+// StreamHandler handles a streaming RPC, as grpc.StreamHandler. The
+// stream's Context, SendMsg, and RecvMsg methods must be used in place
+// of the underlying stream's, so that the messages are traced; with
+// grpc-go, the handler passes a grpc.ServerStream wrapping both
+// streams, as the serverStream at the top of rpc.go does.
+type StreamHandler func(srv interface{}, stream ServerStream) error
+
+// ClientStream is the part of grpc.ClientStream that the stream
+// interceptors use.
+type ClientStream interface {
+	Context() context.Context
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+	CloseSend() error
+}
+
+// Streamer opens a client stream, as grpc.Streamer with the stream
+// description, connection, and call options bound.
+type Streamer func(ctx context.Context, method string) (ClientStream, error)
+
+// traceparentMetadata is the metadata key that propagates a span
+// context in an RPC. gRPC metadata keys are lower case.
+const traceparentMetadata = "traceparent"
+
+// OutgoingMetadata returns the metadata key/value pairs that propagate
+// the span context bound to ctx to the server of an RPC, as for
+// metadata.AppendToOutgoingContext, or nil if ctx has no span context.
+func OutgoingMetadata(ctx context.Context) []string {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return []string{traceparentMetadata, sc.Traceparent()}
+}
+
+// contextWithMetadata returns ctx associated with the remote span
+// propagated in the incoming metadata md, if any.
+func contextWithMetadata(ctx context.Context, md map[string][]string) context.Context {
+	values := md[traceparentMetadata]
+	if len(values) == 0 {
+		return ctx
+	}
+	sc, err := ParseTraceparent(values[0])
+	if err != nil {
+		return ctx
+	}
+	return ContextWithRemoteSpan(ctx, sc)
+}
+
+// rpcMessage is a message logged to an RPC's trace.
+type rpcMessage struct {
+	sent bool
+	msg  interface{}
+}
+
+func (m rpcMessage) String() string {
+	if m.sent {
+		return fmt.Sprintf("sent: %v", m.msg)
+	}
+	return fmt.Sprintf("recv: %v", m.msg)
+}
+
+// startRPC starts the trace of an RPC in the family for its direction
+// and method, logging its deadline.
+func startRPC(ctx context.Context, direction, method string) (Trace, context.Context) {
+	tr, ctx := StartSpan(ctx, "grpc."+direction+"."+method, method)
+	if deadline, ok := ctx.Deadline(); ok {
+		tr.LazyPrintf("deadline: %v", deadline.Sub(time.Now()))
+	}
+	return tr, ctx
+}
+
+// finishRPC records the RPC's error, if any, and finishes its trace.
+func finishRPC(tr Trace, err error) {
+	if err != nil {
+		tr.LazyPrintf("error: %v", err)
+		tr.SetError()
+	}
+	tr.Finish()
+}
+
+// UnaryServerInterceptor traces a unary RPC served by handler in the
+// family "grpc.Recv.<method>", as a child of the span propagated in
+// the incoming metadata md, which may be nil. The request and
+// response are logged as sensitive events.
+func UnaryServerInterceptor(ctx context.Context, md map[string][]string, req interface{}, method string, handler UnaryHandler) (interface{}, error) {
+	tr, ctx := startRPC(contextWithMetadata(ctx, md), "Recv", method)
+	tr.LazyLog(rpcMessage{msg: req}, true)
+
+	resp, err := handler(ctx, req)
+	if err == nil {
+		tr.LazyLog(rpcMessage{sent: true, msg: resp}, true)
+	}
+	finishRPC(tr, err)
+	return resp, err
+}
+
+// UnaryClientInterceptor traces a unary RPC made by invoker in the
+// family "grpc.Sent.<method>", as a child of the Trace bound to ctx.
+// The request and reply are logged as sensitive events. The invoker
+// should add OutgoingMetadata(ctx) to the RPC's metadata.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, invoker UnaryInvoker) error {
+	tr, ctx := startRPC(ctx, "Sent", method)
+	tr.LazyLog(rpcMessage{sent: true, msg: req}, true)
+
+	err := invoker(ctx, method, req, reply)
+	if err == nil {
+		tr.LazyLog(rpcMessage{msg: reply}, true)
+	}
+	finishRPC(tr, err)
+	return err
+}
+
+// tracedServerStream logs the messages of a server stream.
+type tracedServerStream struct {
+	ServerStream
+	ctx context.Context
+	tr  Trace
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *tracedServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.tr.LazyLog(rpcMessage{sent: true, msg: m}, true)
+	}
+	return err
+}
+
+func (s *tracedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.tr.LazyLog(rpcMessage{msg: m}, true)
+	}
+	return err
+}
+
+// StreamServerInterceptor traces a streaming RPC served by handler in
+// the family "grpc.Recv.<method>", as a child of the span propagated
+// in the incoming metadata md, which may be nil, logging the messages
+// as sensitive events.
+func StreamServerInterceptor(srv interface{}, ss ServerStream, md map[string][]string, method string, handler StreamHandler) error {
+	tr, ctx := startRPC(contextWithMetadata(ss.Context(), md), "Recv", method)
+	err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx, tr: tr})
+	finishRPC(tr, err)
+	return err
+}
+
+// tracedClientStream logs the messages of a client stream, and
+// finishes its trace when the stream ends.
+type tracedClientStream struct {
+	ClientStream
+	ctx context.Context
+	tr  Trace
+
+	// SendMsg and RecvMsg may be called concurrently, so mu
+	// guards logging to the trace and finishing it, which RecvMsg
+	// does when it returns an error.
+	mu   sync.Mutex
+	done bool
+}
+
+func (s *tracedClientStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *tracedClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil && !s.done {
+		s.tr.LazyLog(rpcMessage{sent: true, msg: m}, true)
+	}
+	return err
+}
+
+func (s *tracedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return err
+	}
+
+	switch err {
+	case nil:
+		s.tr.LazyLog(rpcMessage{msg: m}, true)
+	case io.EOF:
+		s.done = true
+		finishRPC(s.tr, nil)
+	default:
+		s.done = true
+		finishRPC(s.tr, err)
+	}
+	return err
+}
+
+// StreamClientInterceptor traces a streaming RPC opened by streamer in
+// the family "grpc.Sent.<method>", as a child of the Trace bound to
+// ctx, logging the messages as sensitive events. As with grpc-go, the
+// stream must be read until RecvMsg returns an error, which finishes
+// the trace; io.EOF ends it successfully. The streamer should add
+// OutgoingMetadata(ctx) to the stream's metadata.
+func StreamClientInterceptor(ctx context.Context, method string, streamer Streamer) (ClientStream, error) {
+	tr, ctx := startRPC(ctx, "Sent", method)
+	cs, err := streamer(ctx, method)
+	if err != nil {
+		finishRPC(tr, err)
+		return nil, err
+	}
+	return &tracedClientStream{ClientStream: cs, ctx: ctx, tr: tr}, nil
+}
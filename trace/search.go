@@ -0,0 +1,337 @@
+package trace
+
+// This file implements searching the traces on /debug/requests.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSearchLimit is the number of traces returned by a search
+// unless the limit parameter is given.
+const defaultSearchLimit = 100
+
+// A Filter selects traces in a search. Zero fields match every
+// trace.
+type Filter struct {
+	// Family restricts the search to one family.
+	Family string
+
+	// Title matches traces whose title contains it.
+	Title string
+
+	// TitleRegexp matches traces whose title matches it.
+	TitleRegexp *regexp.Regexp
+
+	// MinElapsed and MaxElapsed bound the duration of the trace;
+	// active traces are measured up to the time of the search.
+	MinElapsed, MaxElapsed time.Duration
+
+	// ErrorsOnly matches traces that resulted in an error.
+	ErrorsOnly bool
+
+	// Since and Until bound the start of the trace.
+	Since, Until time.Time
+
+	// Event matches traces with an event whose text contains it.
+	// Sensitive events are only searched if the searcher may
+	// see them.
+	Event string
+
+	// Attrs matches traces that have, or have an event with, an
+	// attribute for each key whose value formats as the given
+	// value; an empty value matches any value. Sensitive
+	// attributes are only searched if the searcher may see them.
+	Attrs map[string]string
+
+	// TraceID matches the spans of a distributed trace.
+	TraceID TraceID
+
+	// Limit is the maximum number of traces returned, newest
+	// first; zero means the default of 100.
+	Limit int
+}
+
+// parseTime parses a time window bound, which is either an RFC 3339
+// time or a duration before now (e.g. "5m").
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ParseFilter parses the search parameters of a request: fam, q
+// (a title substring), re (a title regular expression), min and max
+// (durations), errors, since and until (RFC 3339 times or durations
+// before now), event (an event text substring), attr (key=value or
+// key, which may be repeated), trace (a distributed trace ID), and
+// limit. It returns false if the request doesn't have a search
+// parameter.
+func ParseFilter(req *http.Request) (*Filter, bool, error) {
+	if req == nil || req.FormValue("search") == "" {
+		return nil, false, nil
+	}
+
+	f := &Filter{
+		Family: req.FormValue("fam"),
+		Title:  req.FormValue("q"),
+		Event:  req.FormValue("event"),
+	}
+
+	var err error
+	if re := req.FormValue("re"); re != "" {
+		if f.TitleRegexp, err = regexp.Compile(re); err != nil {
+			return nil, true, fmt.Errorf("trace: invalid title regexp: %v", err)
+		}
+	}
+
+	durations := []struct {
+		param string
+		d     *time.Duration
+	}{
+		{"min", &f.MinElapsed},
+		{"max", &f.MaxElapsed},
+	}
+	for _, p := range durations {
+		if v := req.FormValue(p.param); v != "" {
+			if *p.d, err = time.ParseDuration(v); err != nil {
+				return nil, true, fmt.Errorf("trace: invalid %s duration: %v", p.param, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	times := []struct {
+		param string
+		t     *time.Time
+	}{
+		{"since", &f.Since},
+		{"until", &f.Until},
+	}
+	for _, p := range times {
+		if v := req.FormValue(p.param); v != "" {
+			if *p.t, err = parseTime(v, now); err != nil {
+				return nil, true, fmt.Errorf("trace: invalid %s time: %v", p.param, err)
+			}
+		}
+	}
+
+	if v := req.FormValue("errors"); v != "" {
+		if f.ErrorsOnly, err = strconv.ParseBool(v); err != nil {
+			return nil, true, errors.New("trace: invalid errors parameter")
+		}
+	}
+
+	for _, v := range req.Form["attr"] {
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if kv[0] == "" {
+			return nil, true, errors.New("trace: invalid attr parameter")
+		}
+		if f.Attrs == nil {
+			f.Attrs = map[string]string{}
+		}
+		if len(kv) == 2 {
+			f.Attrs[kv[0]] = kv[1]
+		} else {
+			f.Attrs[kv[0]] = ""
+		}
+	}
+
+	if v := req.FormValue("trace"); v != "" {
+		if f.TraceID, err = ParseTraceID(v); err != nil {
+			return nil, true, err
+		}
+	}
+
+	if v := req.FormValue("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return nil, true, errors.New("trace: invalid limit")
+		}
+	}
+
+	return f, true, nil
+}
+
+// elapsedAt returns the duration of the trace, or of an active trace
+// up to now.
+func (tr *trace) elapsedAt(now time.Time) time.Duration {
+	if tr.Elapsed == 0 {
+		return now.Sub(tr.Start)
+	}
+	return tr.Elapsed
+}
+
+// match returns true if the trace matches the filter. Sensitive
+// events are only matched if sensitive is true.
+func (f *Filter) match(tr *trace, now time.Time, sensitive bool) bool {
+	if f.TraceID.IsValid() && tr.traceID != f.TraceID {
+		return false
+	}
+
+	if f.ErrorsOnly && !tr.IsError {
+		return false
+	}
+
+	if f.Title != "" && !strings.Contains(tr.Title, f.Title) {
+		return false
+	}
+
+	if f.TitleRegexp != nil && !f.TitleRegexp.MatchString(tr.Title) {
+		return false
+	}
+
+	elapsed := tr.elapsedAt(now)
+	if elapsed < f.MinElapsed || (f.MaxElapsed > 0 && elapsed > f.MaxElapsed) {
+		return false
+	}
+
+	if !f.Since.IsZero() && tr.Start.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && tr.Start.After(f.Until) {
+		return false
+	}
+
+	if f.Event == "" && len(f.Attrs) == 0 {
+		return true
+	}
+
+	events := tr.Events()
+	if f.Event != "" && !matchEvent(events, f.Event, sensitive) {
+		return false
+	}
+
+	attrs := tr.Attrs()
+	for key, value := range f.Attrs {
+		if matchAttr(attrs, key, value, sensitive) {
+			continue
+		}
+
+		found := false
+		for _, e := range events {
+			if e.Sensitive && !sensitive {
+				continue
+			}
+			if matchAttr(e.Attrs, key, value, sensitive) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEvent returns true if the text of one of the events contains
+// s. Sensitive events are only matched if sensitive is true.
+func matchEvent(events []event, s string, sensitive bool) bool {
+	for _, e := range events {
+		if e.Sensitive && !sensitive {
+			continue
+		}
+		if strings.Contains(fmt.Sprint(e.What), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns copies of the traces in the set matching the filter.
+func (ts *traceSet) Filter(match func(*trace) bool) traceList {
+	var trl traceList
+	ts.each(func(tr *trace) {
+		if match(tr) {
+			trl = append(trl, tr.clone())
+		}
+	})
+	return trl
+}
+
+// search returns the active and completed traces matching the
+// filter, newest first. As a completed trace is copied to every
+// bucket whose condition it meets, and may finish while the search
+// runs, duplicates are removed by their numbers in the active set.
+func (f *Filter) search(sensitive bool) traceList {
+	now := time.Now()
+	match := func(tr *trace) bool {
+		return f.match(tr, now, sensitive)
+	}
+
+	// A family's completed traces are allocated asynchronously,
+	// so families with only active traces may not have them yet.
+	var names []string
+	if f.Family != "" {
+		names = []string{f.Family}
+	} else {
+		known := map[string]bool{}
+		completedMu.RLock()
+		for name := range completedTraces {
+			known[name] = true
+		}
+		completedMu.RUnlock()
+
+		activeTraces.Range(func(name, _ interface{}) bool {
+			known[name.(string)] = true
+			return true
+		})
+
+		for name := range known {
+			names = append(names, name)
+		}
+	}
+
+	var trl traceList
+	for _, name := range names {
+		seen := map[uint64]bool{}
+		if s := getActiveSet(name); s != nil {
+			for _, tr := range s.Filter(match) {
+				seen[tr.seq] = true
+				trl = append(trl, tr)
+			}
+		}
+
+		fam := getFamily(name, false)
+		if fam == nil {
+			continue
+		}
+
+		for _, b := range fam.Buckets {
+			for _, tr := range b.Filter(match) {
+				if !seen[tr.seq] {
+					seen[tr.seq] = true
+					trl = append(trl, tr)
+				}
+			}
+		}
+	}
+
+	sort.Sort(trl)
+	limit := f.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if len(trl) > limit {
+		trl = trl[:limit]
+	}
+	return trl
+}
+
+// Search returns the JSON representation of the active and completed
+// traces matching the filter, newest first. Sensitive events are
+// redacted, and not searched, unless sensitive is true.
+func Search(f *Filter, sensitive bool) []*TraceRecord {
+	return newTraceRecords(f.search(sensitive), sensitive)
+}
@@ -0,0 +1,439 @@
+package trace
+
+// This file implements snapshots of the trace pages, which can be
+// downloaded during an incident and rendered offline later.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Snapshot is the state of the /debug/requests and /debug/events
+// pages at a point in time: every trace family's buckets, active
+// traces, and latency histograms, and every event log.
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Requests *Requests `json:"requests"`
+	Events   *Events   `json:"events"`
+}
+
+// TakeSnapshot returns a snapshot of the trace pages. Sensitive events
+// and attributes are redacted unless sensitive is true.
+func TakeSnapshot(sensitive bool) *Snapshot {
+	return &Snapshot{
+		Time:     time.Now(),
+		Requests: CollectRequests("", sensitive),
+		Events:   CollectEvents("", 0),
+	}
+}
+
+// WriteSnapshot writes a snapshot of the trace pages to w as gzipped
+// JSON. Sensitive events and attributes are redacted unless sensitive
+// is true.
+func WriteSnapshot(w io.Writer, sensitive bool) error {
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(TakeSnapshot(sensitive)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot, or the same
+// JSON uncompressed.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	// Numbers are kept as written, so that attribute values
+	// aren't reformatted as floating point.
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+	snap := new(Snapshot)
+	if err := dec.Decode(snap); err != nil {
+		return nil, fmt.Errorf("trace: invalid snapshot: %v", err)
+	}
+	if snap.Requests == nil {
+		snap.Requests = &Requests{}
+	}
+	if snap.Events == nil {
+		snap.Events = &Events{}
+	}
+	return snap, nil
+}
+
+// snapshotFilename returns the name of a snapshot file taken at t.
+func snapshotFilename(t time.Time) string {
+	return "trace-snapshot-" + t.UTC().Format("20060102T150405Z") + ".json.gz"
+}
+
+// RenderSnapshot renders a snapshot with the templates of the trace
+// pages: the /debug/events page if req's path ends in "/events", and
+// the /debug/requests page otherwise. As with Render and RenderEvents,
+// req selects the family and bucket, search, or distributed trace
+// shown; it may be nil. Sensitive events are shown if the snapshot
+// includes them.
+func RenderSnapshot(w io.Writer, req *http.Request, snap *Snapshot) {
+	if req != nil && req.URL != nil && strings.HasSuffix(req.URL.Path, "/events") {
+		renderSnapshotEvents(w, req, snap)
+		return
+	}
+	renderSnapshotRequests(w, req, snap)
+}
+
+// SnapshotViewer returns a handler that renders the snapshot with
+// RenderSnapshot, so that it can be browsed as the live pages are.
+func SnapshotViewer(snap *Snapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		RenderSnapshot(w, req, snap)
+	})
+}
+
+// The LatencyHistogram methods render it with distTmpl, as the live
+// histograms are.
+
+func (lh *LatencyHistogram) total() int64               { return lh.Count }
+func (lh *LatencyHistogram) average() float64           { return lh.Mean }
+func (lh *LatencyHistogram) standardDeviation() float64 { return lh.StandardDeviation }
+func (lh *LatencyHistogram) maxValue() int64            { return lh.Max }
+
+func (lh *LatencyHistogram) nonEmptyBuckets() []*HistogramBucket {
+	return lh.Buckets
+}
+
+func (lh *LatencyHistogram) percentile(fraction float64) int64 {
+	switch fraction {
+	case 0.9:
+		return lh.P90
+	case 0.95:
+		return lh.P95
+	case 0.99:
+		return lh.P99
+	case 0.999:
+		return lh.P999
+	default:
+		return lh.P50
+	}
+}
+
+// snapshotCond is a bucket condition restored from a snapshot, which
+// only records its description.
+type snapshotCond string
+
+func (c snapshotCond) match(*trace) bool { return false }
+func (c snapshotCond) String() string    { return string(c) }
+
+// redacted replaces the values of redacted events and attributes in
+// restored traces.
+const redacted = "[redacted]"
+
+func restoreAttrs(recs []*AttrRecord) []Attr {
+	var attrs []Attr
+	for _, rec := range recs {
+		a := Attr{Key: rec.Key, Value: rec.Value, Sensitive: rec.Sensitive}
+		if rec.Redacted {
+			a.Value = redacted
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// traceKey identifies a trace in a snapshot, where a completed trace
+// may appear in several buckets.
+type traceKey struct {
+	family, title string
+	start         int64
+	span          SpanID
+}
+
+// restoredTraces restores the traces of a snapshot. The traces aren't
+// in the active sets or the families, and the snapshot's buckets are
+// sized to hold them all, so they are never evicted into tracePool.
+type restoredTraces struct {
+	m   map[traceKey]*trace
+	all traceList
+}
+
+func (rt *restoredTraces) restore(rec *TraceRecord) *trace {
+	var span SpanID
+	parseID(span[:], rec.SpanID)
+	key := traceKey{rec.Family, rec.Title, rec.Start.UnixNano(), span}
+	if tr, ok := rt.m[key]; ok {
+		return tr
+	}
+
+	tr := &trace{
+		Family:  rec.Family,
+		Title:   rec.Title,
+		Start:   rec.Start,
+		Elapsed: rec.Elapsed,
+		IsError: rec.IsError,
+		spanID:  span,
+		attrs:   restoreAttrs(rec.Attrs),
+	}
+	parseID(tr.traceID[:], rec.TraceID)
+	parseID(tr.parentID[:], rec.ParentID)
+
+	prev := rec.Start
+	for _, te := range rec.Events {
+		e := event{
+			When:      te.When,
+			Elapsed:   te.Elapsed,
+			NewDay:    prev.Day() != te.When.Day(),
+			Sensitive: te.Sensitive,
+			What:      te.What,
+			Attrs:     restoreAttrs(te.Attrs),
+		}
+		if te.Redacted {
+			e.What = redacted
+		}
+		tr.events = append(tr.events, e)
+		prev = te.When
+	}
+	tr.maxEvents = len(tr.events)
+
+	rt.m[key] = tr
+	rt.all = append(rt.all, tr)
+	return tr
+}
+
+func (rt *restoredTraces) restoreList(recs []*TraceRecord) traceList {
+	trl := make(traceList, 0, len(recs))
+	for _, rec := range recs {
+		trl = append(trl, rt.restore(rec))
+	}
+	return trl
+}
+
+// renderSnapshotRequests renders the /debug/requests page of a
+// snapshot.
+func renderSnapshotRequests(w io.Writer, req *http.Request, snap *Snapshot) {
+	data := &pageData{
+		Path:             "/debug/requests",
+		CompletedTraces:  map[string]*family{},
+		ActiveTraceCount: map[string]int{},
+		Snapshot:         snap.Time,
+	}
+	filter, traceID := data.parseRequest(req, true)
+
+	rt := &restoredTraces{m: map[traceKey]*trace{}}
+	active := map[string]traceList{}
+	latency := map[string]map[string]*LatencyHistogram{}
+	for _, rf := range snap.Requests.Families {
+		f := &family{}
+		for _, rb := range rf.Buckets {
+			size := len(rb.Traces)
+			if size == 0 {
+				size = 1
+			}
+			b := newTraceBucket(snapshotCond(rb.Cond), size)
+			// The bucket holds its traces oldest first.
+			for i := len(rb.Traces) - 1; i >= 0; i-- {
+				b.Add(rt.restore(rb.Traces[i]))
+			}
+			f.Buckets = append(f.Buckets, b)
+		}
+
+		data.Families = append(data.Families, rf.Family)
+		data.CompletedTraces[rf.Family] = f
+		data.ActiveTraceCount[rf.Family] = rf.Active
+		if len(f.Buckets) > data.MaxBuckets {
+			data.MaxBuckets = len(f.Buckets)
+		}
+		active[rf.Family] = rt.restoreList(rf.ActiveTraces)
+		latency[rf.Family] = rf.Latency
+	}
+	sort.Strings(data.Families)
+
+	if filter != nil {
+		for _, tr := range rt.all {
+			if filter.match(tr, snap.Time, data.ShowSensitive) {
+				data.Results = append(data.Results, tr)
+			}
+		}
+		sort.Sort(data.Results)
+		limit := filter.Limit
+		if limit == 0 {
+			limit = defaultSearchLimit
+		}
+		if len(data.Results) > limit {
+			data.Results = data.Results[:limit]
+		}
+	}
+
+	if traceID.IsValid() {
+		var spans traceList
+		for _, tr := range rt.all {
+			if tr.traceID == traceID {
+				spans = append(spans, tr)
+			}
+		}
+		data.Waterfall = buildWaterfall(traceID, spans, snap.Time)
+	}
+
+	var ok bool
+	data.Family, data.Bucket, ok = parseArgs(req)
+	f := data.CompletedTraces[data.Family]
+	switch {
+	case !ok || f == nil:
+		// No-op
+	case data.Bucket == -1:
+		data.Active = true
+		data.Traces = active[data.Family]
+		if n := data.ActiveTraceCount[data.Family]; len(data.Traces) < n {
+			data.Total = n
+		}
+	case data.Bucket < len(f.Buckets):
+		data.Traces = f.Buckets[data.Bucket].Copy(data.Traced)
+	default:
+		windows := []struct {
+			key, name string
+		}{
+			{"minute", "last minute"},
+			{"hour", "last hour"},
+			{"total", "all time"},
+		}
+		if o := data.Bucket - len(f.Buckets); o < len(windows) {
+			if lh := latency[data.Family][windows[o].key]; lh != nil {
+				data.Histogram = histogramHTML(lh)
+				data.HistogramWindow = windows[o].name
+			}
+		}
+	}
+	sort.Sort(data.Traces)
+
+	if err := pageTmpl.ExecuteTemplate(w, "Page", data); err != nil {
+		log.Printf("net/trace: Failed executing template: %v", err)
+	}
+}
+
+// snapshotEventLog is an event log restored from a snapshot, with
+// the methods used by the /debug/events template.
+type snapshotEventLog struct {
+	Title string
+
+	rec *EventLogRecord
+	now time.Time // when the snapshot was taken
+}
+
+func (el *snapshotEventLog) When() string {
+	return el.rec.Start.Format("2006/01/02 15:04:05.000000")
+}
+
+func (el *snapshotEventLog) ElapsedTime() string {
+	return fmt.Sprintf("%.6f", el.now.Sub(el.rec.Start).Seconds())
+}
+
+func (el *snapshotEventLog) Stack() string {
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 1, 8, 1, '\t', 0)
+	for _, f := range el.rec.Stack {
+		fmt.Fprintf(tw, "#   %s\t%s:%d\n", f.Function, f.File, f.Line)
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+func (el *snapshotEventLog) Events() []logEntry {
+	entries := make([]logEntry, 0, len(el.rec.Events))
+	prev := el.rec.Start
+	for _, e := range el.rec.Events {
+		entries = append(entries, logEntry{
+			When:    e.When,
+			Elapsed: e.Elapsed,
+			NewDay:  prev.Day() != e.When.Day(),
+			What:    e.What,
+			IsErr:   e.IsError,
+		})
+		prev = e.When
+	}
+	return entries
+}
+
+// hasRecentError is as for eventLog, at the time of the snapshot.
+func (el *snapshotEventLog) hasRecentError(maxErrAge time.Duration) bool {
+	if maxErrAge == 0 {
+		return true
+	}
+	return el.rec.LastErrorTime != nil && el.now.Sub(*el.rec.LastErrorTime) < maxErrAge
+}
+
+// renderSnapshotEvents renders the /debug/events page of a snapshot.
+func renderSnapshotEvents(w io.Writer, req *http.Request, snap *Snapshot) {
+	data := &struct {
+		Path     string
+		Families []string
+		Buckets  []bucket
+		Counts   [][]int
+
+		Family    string
+		Bucket    int
+		EventLogs []*snapshotEventLog
+		Expanded  bool
+
+		Snapshot time.Time
+	}{
+		Path:     "/debug/events",
+		Buckets:  buckets,
+		Snapshot: snap.Time,
+	}
+
+	if req != nil && req.URL != nil && req.URL.Path != "" {
+		data.Path = req.URL.Path
+	}
+
+	var fam, b string
+	if req != nil {
+		fam, b = req.FormValue("fam"), req.FormValue("b")
+		if exp, err := strconv.ParseBool(req.FormValue("exp")); err == nil {
+			data.Expanded = exp
+		}
+	}
+
+	for _, ef := range snap.Events.Families {
+		data.Families = append(data.Families, ef.Family)
+		counts := make([]int, len(buckets))
+		for j := range counts {
+			if j < len(ef.Counts) {
+				counts[j] = ef.Counts[j].Count
+			}
+		}
+		data.Counts = append(data.Counts, counts)
+
+		i, err := strconv.Atoi(b)
+		if ef.Family != fam || err != nil || i < 0 || i >= len(buckets) {
+			continue
+		}
+		data.Family, data.Bucket = fam, i
+		for _, rec := range ef.EventLogs {
+			el := &snapshotEventLog{Title: rec.Title, rec: rec, now: snap.Time}
+			if el.hasRecentError(buckets[i].MaxErrAge) {
+				data.EventLogs = append(data.EventLogs, el)
+			}
+		}
+	}
+
+	if err := eventsTmpl.Execute(w, data); err != nil {
+		log.Printf("net/trace: Failed executing template: %v", err)
+	}
+}
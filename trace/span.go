@@ -0,0 +1,223 @@
+package trace
+
+// This file implements distributed trace IDs, parent/child spans, and
+// propagation of W3C Trace Context (https://www.w3.org/TR/trace-context/)
+// traceparent headers.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// TraceparentHeader is the header that propagates a span
+	// context to a server.
+	TraceparentHeader = "Traceparent"
+
+	// TraceresponseHeader is the header in which a server returns
+	// the span context of its trace to the client.
+	TraceresponseHeader = "Traceresponse"
+)
+
+// A TraceID identifies a distributed trace, which is a tree of
+// spans. The zero TraceID is invalid.
+type TraceID [16]byte
+
+// IsValid returns true if the trace ID isn't zero.
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// String returns the trace ID in hex.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// A SpanID identifies a span in a distributed trace. The zero SpanID
+// is invalid.
+type SpanID [8]byte
+
+// IsValid returns true if the span ID isn't zero.
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// String returns the span ID in hex.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// parseID decodes exactly len(id) bytes of lower case hex into id.
+func parseID(id []byte, s string) error {
+	if len(s) != 2*len(id) {
+		return errors.New("trace: invalid ID length")
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return errors.New("trace: invalid ID")
+		}
+	}
+	_, err := hex.Decode(id, []byte(s))
+	return err
+}
+
+// ParseTraceID parses a trace ID in hex.
+func ParseTraceID(s string) (TraceID, error) {
+	var id TraceID
+	if err := parseID(id[:], s); err != nil {
+		return TraceID{}, err
+	}
+	if !id.IsValid() {
+		return TraceID{}, errors.New("trace: zero trace ID")
+	}
+	return id, nil
+}
+
+// A SpanContext identifies a span in a distributed trace, whether a
+// trace in this process or one propagated by a client.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if both the trace and span IDs are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the span context as a version 00 traceparent
+// header value.
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Values with a
+// version later than 00 are parsed as version 00, ignoring any
+// trailing fields, as the specification requires.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	invalid := errors.New("trace: invalid traceparent")
+
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, invalid
+	}
+
+	var version, flags [1]byte
+	if parseID(version[:], s[:2]) != nil || version[0] == 0xff {
+		return sc, invalid
+	}
+	if version[0] == 0 && len(s) != 55 {
+		return sc, invalid
+	}
+	if len(s) > 55 && s[55] != '-' {
+		return sc, invalid
+	}
+
+	if parseID(sc.TraceID[:], s[3:35]) != nil || parseID(sc.SpanID[:], s[36:52]) != nil {
+		return sc, invalid
+	}
+	if parseID(flags[:], s[53:55]) != nil {
+		return sc, invalid
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return SpanContext{}, invalid
+	}
+	return sc, nil
+}
+
+// Extract returns the span context in the traceparent header of h, if
+// it has a valid one.
+func Extract(h http.Header) (SpanContext, bool) {
+	v := h.Get(TraceparentHeader)
+	if v == "" {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(v)
+	return sc, err == nil
+}
+
+// Inject sets the traceparent header of h to the span context, if it
+// is valid.
+func Inject(h http.Header, sc SpanContext) {
+	if sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+var remoteKey = contextKeyT("github.com/kisom/httpdebug/trace.SpanContext")
+
+// ContextWithRemoteSpan returns a copy of the parent context
+// associated with a span context propagated from another process,
+// which StartSpan will use as the parent of a new trace if the
+// context doesn't have a Trace.
+func ContextWithRemoteSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// SpanContextFromContext returns the span context of the Trace bound
+// to the context, if it is a SpanTrace, or, failing that, the remote
+// span context associated with it.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if tr, ok := FromContext(ctx); ok {
+		if st, ok := tr.(SpanTrace); ok {
+			sc := st.SpanContext()
+			return sc, sc.IsValid()
+		}
+	}
+	sc, ok := ctx.Value(remoteKey).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// randomID fills id from crypto/rand; IDs are sent to other services,
+// so they mustn't be predictable.
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		panic("trace: failed to generate a random ID: " + err.Error())
+	}
+}
+
+// newSpanContext returns the span context for a new span: a child of
+// parent if it is valid, or the root of a new, sampled trace.
+func newSpanContext(parent SpanContext) SpanContext {
+	sc := parent
+	if !parent.IsValid() {
+		sc.Sampled = true
+	}
+
+	for !sc.TraceID.IsValid() {
+		randomID(sc.TraceID[:])
+	}
+	sc.SpanID = SpanID{}
+	for !sc.SpanID.IsValid() {
+		randomID(sc.SpanID[:])
+	}
+	return sc
+}
+
+// StartSpan returns a new trace and a copy of ctx bound to it. The
+// trace is a child of the Trace bound to ctx, or of a remote span
+// associated with it by ContextWithRemoteSpan; otherwise it is the
+// root of a new distributed trace. The trace's family and title are
+// as for New.
+func StartSpan(ctx context.Context, family, title string) (SpanTrace, context.Context) {
+	parent, _ := SpanContextFromContext(ctx)
+	tr := newActiveTrace(family, title, newSpanContext(parent), parent.SpanID)
+	return tr, NewContext(ctx, tr)
+}
+
+func (tr *trace) SpanContext() SpanContext {
+	return SpanContext{TraceID: tr.traceID, SpanID: tr.spanID, Sampled: tr.sampled}
+}
@@ -21,6 +21,11 @@ A request handler might be implemented like this:
 		}
 	}
 
+Alternatively, MiddlewareWithOptions wraps a handler so that each request
+is traced, and the handler can find its trace with FromContext:
+
+	http.Handle("/foo/", trace.MiddlewareWithOptions(fooHandler, trace.WithMethodFamily()))
+
 The /debug/requests HTTP endpoint organizes the traces by family,
 errors, and duration.  It also provides histogram of request duration
 for each family.
@@ -64,18 +69,22 @@ package trace
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/kisom/httpdebug/trace/timeseries"
 	"golang.org/x/net/context"
@@ -110,70 +119,129 @@ var AuthRequest = func(req *http.Request) (any, sensitive bool) {
 	}
 }
 
+// pageData is the data of the /debug/requests page.
+type pageData struct {
+	Path             string // the path at which the page is served
+	Families         []string
+	ActiveTraceCount map[string]int
+	CompletedTraces  map[string]*family
+	MaxBuckets       int // the most buckets in any family
+
+	// Set when a bucket has been selected.
+	Traces        traceList
+	Family        string
+	Bucket        int
+	Expanded      bool
+	Traced        bool
+	Active        bool
+	ShowSensitive bool // whether to show sensitive events
+
+	Histogram       template.HTML
+	HistogramWindow string // e.g. "last minute", "last hour", "all time"
+
+	// If non-zero, the set of traces is a partial set,
+	// and this is the total number.
+	Total int
+
+	// Set when a search has been requested.
+	Searched    bool
+	SearchError string
+	Results     traceList
+	Form        url.Values // the search parameters
+
+	// Set when a distributed trace has been selected.
+	Waterfall  *waterfall
+	TraceError string
+
+	// Set when rendering a snapshot.
+	Snapshot time.Time
+}
+
+// parseRequest sets the page's options from the request, which may be
+// nil, returning the search filter or distributed trace ID selected,
+// if any.
+func (data *pageData) parseRequest(req *http.Request, sensitive bool) (*Filter, TraceID) {
+	data.ShowSensitive = sensitive
+	if req == nil {
+		return nil, TraceID{}
+	}
+
+	if req.URL != nil && req.URL.Path != "" {
+		data.Path = req.URL.Path
+	}
+
+	// Allow show_sensitive=0 to force hiding of sensitive data for testing.
+	// This only goes one way; you can't use show_sensitive=1 to see things.
+	if req.FormValue("show_sensitive") == "0" {
+		data.ShowSensitive = false
+	}
+
+	if exp, err := strconv.ParseBool(req.FormValue("exp")); err == nil {
+		data.Expanded = exp
+	}
+	if exp, err := strconv.ParseBool(req.FormValue("rtraced")); err == nil {
+		data.Traced = exp
+	}
+
+	filter, ok, err := ParseFilter(req)
+	data.Searched = ok
+	data.Form = req.Form
+	switch {
+	case err != nil:
+		data.SearchError = err.Error()
+	case ok:
+		return filter, TraceID{}
+	case req.FormValue("trace") != "":
+		id, err := ParseTraceID(req.FormValue("trace"))
+		if err != nil {
+			data.TraceError = err.Error()
+		}
+		return nil, id
+	}
+	return nil, TraceID{}
+}
+
 // Render renders the HTML page typically served at /debug/requests.
 // It does not do any auth checking; see AuthRequest for the default auth check
 // used by the handler registered on http.DefaultServeMux.
 // req may be nil.
 func Render(w io.Writer, req *http.Request, sensitive bool) {
-	data := &struct {
-		Families         []string
-		ActiveTraceCount map[string]int
-		CompletedTraces  map[string]*family
-
-		// Set when a bucket has been selected.
-		Traces        traceList
-		Family        string
-		Bucket        int
-		Expanded      bool
-		Traced        bool
-		Active        bool
-		ShowSensitive bool // whether to show sensitive events
-
-		Histogram       template.HTML
-		HistogramWindow string // e.g. "last minute", "last hour", "all time"
-
-		// If non-zero, the set of traces is a partial set,
-		// and this is the total number.
-		Total int
-	}{
+	data := &pageData{
+		Path:            "/debug/requests",
 		CompletedTraces: completedTraces,
 	}
 
-	data.ShowSensitive = sensitive
-	if req != nil {
-		// Allow show_sensitive=0 to force hiding of sensitive data for testing.
-		// This only goes one way; you can't use show_sensitive=1 to see things.
-		if req.FormValue("show_sensitive") == "0" {
-			data.ShowSensitive = false
-		}
-
-		if exp, err := strconv.ParseBool(req.FormValue("exp")); err == nil {
-			data.Expanded = exp
-		}
-		if exp, err := strconv.ParseBool(req.FormValue("rtraced")); err == nil {
-			data.Traced = exp
-		}
+	filter, traceID := data.parseRequest(req, sensitive)
+	if filter != nil {
+		data.Results = filter.search(data.ShowSensitive)
+	}
+	if traceID.IsValid() {
+		data.Waterfall = newWaterfall(traceID)
 	}
 
 	completedMu.RLock()
 	data.Families = make([]string, 0, len(completedTraces))
-	for fam := range completedTraces {
+	for fam, f := range completedTraces {
 		data.Families = append(data.Families, fam)
+		if len(f.Buckets) > data.MaxBuckets {
+			data.MaxBuckets = len(f.Buckets)
+		}
 	}
 	completedMu.RUnlock()
 	sort.Strings(data.Families)
 
-	// We are careful here to minimize the time spent locking activeMu,
-	// since that lock is required every time an RPC starts and finishes.
 	data.ActiveTraceCount = make(map[string]int, len(data.Families))
-	activeMu.RLock()
-	for fam, s := range activeTraces {
-		data.ActiveTraceCount[fam] = s.Len()
-	}
-	activeMu.RUnlock()
+	activeTraces.Range(func(fam, s interface{}) bool {
+		data.ActiveTraceCount[fam.(string)] = s.(*traceSet).Len()
+		return true
+	})
 
 	var ok bool
 	data.Family, data.Bucket, ok = parseArgs(req)
+	var nb int // the number of buckets in the selected family
+	if f := getFamily(data.Family, false); ok && f != nil {
+		nb = len(f.Buckets)
+	}
 	switch {
 	case !ok:
 		// No-op
@@ -184,15 +252,17 @@ func Render(w io.Writer, req *http.Request, sensitive bool) {
 		if len(data.Traces) < n {
 			data.Total = n
 		}
-	case data.Bucket < bucketsPerFamily:
+	case data.Bucket < nb:
 		if b := lookupBucket(data.Family, data.Bucket); b != nil {
 			data.Traces = b.Copy(data.Traced)
 		}
 	default:
 		if f := getFamily(data.Family, false); f != nil {
 			var obs timeseries.Observable
-			f.LatencyMu.RLock()
-			switch o := data.Bucket - bucketsPerFamily; o {
+			// Reading the time series merges its pending
+			// updates, so the write lock is required.
+			f.LatencyMu.Lock()
+			switch o := data.Bucket - len(f.Buckets); o {
 			case 0:
 				obs = f.Latency.Minute()
 				data.HistogramWindow = "last minute"
@@ -203,15 +273,14 @@ func Render(w io.Writer, req *http.Request, sensitive bool) {
 				obs = f.Latency.Total()
 				data.HistogramWindow = "all time"
 			}
-			f.LatencyMu.RUnlock()
 			if obs != nil {
-				data.Histogram = obs.(*histogram).html()
+				data.Histogram = obs.(latencyHistogram).html()
 			}
+			f.LatencyMu.Unlock()
 		}
 	}
 
 	if data.Traces != nil {
-		defer data.Traces.Free()
 		sort.Sort(data.Traces)
 	}
 
@@ -280,11 +349,12 @@ type Trace interface {
 	// SetRecycler sets a recycler for the trace.
 	// f will be called for each event passed to LazyLog at a time when
 	// it is no longer required, whether while the trace is still active
-	// and the event is discarded, or when a completed trace is discarded.
+	// and the event is discarded, or when the trace finishes. Completed
+	// traces keep the text of their recyclable events as it was then.
 	SetRecycler(f func(interface{}))
 
-	// SetTraceInfo sets the trace info for the trace.
-	// This is currently unused.
+	// SetTraceInfo sets the trace info for the trace. The trace ID
+	// fills the low 64 bits of the trace's TraceID.
 	SetTraceInfo(traceID, spanID uint64)
 
 	// SetMaxEvents sets the maximum number of events that will be stored
@@ -297,6 +367,31 @@ type Trace interface {
 	Finish()
 }
 
+// A SpanTrace is a Trace that carries structured attributes and is a
+// span in a distributed trace. Every Trace created by this package is
+// a SpanTrace; callers holding a Trace assert to SpanTrace to use
+// these methods, which aren't part of Trace so that other
+// implementations of Trace needn't provide them.
+type SpanTrace interface {
+	Trace
+
+	// LazyLogAttrs is like LazyLog, but also attaches attributes
+	// to the event.
+	LazyLogAttrs(x fmt.Stringer, sensitive bool, attrs ...Attr)
+
+	// SetAttr sets an attribute of the trace, such as a user ID
+	// or route, replacing any attribute with the same key.
+	SetAttr(key string, value interface{})
+
+	// SetAttrs sets attributes of the trace, which may be
+	// sensitive, replacing any attributes with the same keys.
+	SetAttrs(attrs ...Attr)
+
+	// SpanContext returns the trace's distributed trace and span
+	// IDs, which are set by StartSpan or SetTraceInfo.
+	SpanContext() SpanContext
+}
+
 type lazySprintf struct {
 	format string
 	a      []interface{}
@@ -308,91 +403,266 @@ func (l *lazySprintf) String() string {
 
 // New returns a new Trace with the specified family and title.
 func New(family, title string) Trace {
+	return newActiveTrace(family, title, SpanContext{}, SpanID{})
+}
+
+// newActiveTrace returns a new active trace with the given span
+// context and parent span, which are set before the trace is visible
+// to the trace pages.
+func newActiveTrace(family, title string, sc SpanContext, parent SpanID) *trace {
 	tr := newTrace()
-	tr.ref()
 	tr.Family, tr.Title = family, title
+	tr.traceID, tr.spanID, tr.sampled = sc.TraceID, sc.SpanID, sc.Sampled
+	tr.parentID = parent
 	tr.Start = time.Now()
-	tr.maxEvents = maxEventsPerTrace
+	tr.maxEvents = getFamilyConfig(family).MaxEvents
 	tr.events = tr.eventsBuf[:0]
 
-	activeMu.RLock()
-	s := activeTraces[tr.Family]
-	activeMu.RUnlock()
-	if s == nil {
-		activeMu.Lock()
-		s = activeTraces[tr.Family] // check again
-		if s == nil {
-			s = new(traceSet)
-			activeTraces[tr.Family] = s
+	s, ok := activeTraces.Load(tr.Family)
+	if !ok {
+		var loaded bool
+		s, loaded = activeTraces.LoadOrStore(tr.Family, new(traceSet))
+		if !loaded {
+			// Trigger allocation of the completed trace structure for
+			// this family. This will cause the family to be present in
+			// the request page during the first trace of this family. We
+			// don't care about the return value, nor is there any need
+			// for this to run inline, so we execute it in its own
+			// goroutine, but only for the family's first trace.
+			completedMu.RLock()
+			if _, ok := completedTraces[tr.Family]; !ok {
+				go allocFamily(tr.Family)
+			}
+			completedMu.RUnlock()
 		}
-		activeMu.Unlock()
 	}
-	s.Add(tr)
-
-	// Trigger allocation of the completed trace structure for this family.
-	// This will cause the family to be present in the request page during
-	// the first trace of this family. We don't care about the return value,
-	// nor is there any need for this to run inline, so we execute it in its
-	// own goroutine, but only if the family isn't allocated yet.
-	completedMu.RLock()
-	if _, ok := completedTraces[tr.Family]; !ok {
-		go allocFamily(tr.Family)
-	}
-	completedMu.RUnlock()
+	tr.active = s.(*traceSet)
+	tr.active.Add(tr)
 
 	return tr
 }
 
 func (tr *trace) Finish() {
-	tr.Elapsed = time.Now().Sub(tr.Start)
+	elapsed := time.Now().Sub(tr.Start)
+	var finishStack []byte
 	if DebugUseAfterFinish {
 		buf := make([]byte, 4<<10) // 4 KB should be enough
 		n := runtime.Stack(buf, false)
-		tr.finishStack = buf[:n]
+		finishStack = buf[:n]
 	}
 
-	activeMu.RLock()
-	m := activeTraces[tr.Family]
-	activeMu.RUnlock()
-	m.Remove(tr)
+	// Once tr is out of its active set, no page can read it until
+	// it is added to a bucket.
+	tr.active.Remove(tr)
+	tr.Elapsed = elapsed
+	tr.finishStack = finishStack
+	tr.recycle()
 
 	f := getFamily(tr.Family, true)
-	for _, b := range f.Buckets {
-		if b.Cond.match(tr) {
-			b.Add(tr)
-		}
+	atomic.AddInt64(&f.completed, 1)
+	if tr.IsError {
+		atomic.AddInt64(&f.errors, 1)
 	}
 	// Add a sample of elapsed time as microseconds to the family's timeseries
-	h := new(histogram)
+	h := f.newHistogram()
 	h.addMeasurement(tr.Elapsed.Nanoseconds() / 1e3)
 	f.LatencyMu.Lock()
 	f.Latency.Add(h)
 	f.LatencyMu.Unlock()
 
-	tr.unref() // matches ref in New
+	exportTrace(tr)
+
+	// The first bucket tr belongs in takes it, and the others take
+	// copies. The copies are made first, as once tr is in a bucket,
+	// it may be evicted and reused at any time.
+	var owner *traceBucket
+	for _, b := range f.Buckets {
+		if !b.Cond.match(tr) {
+			continue
+		}
+		if owner == nil {
+			owner = b
+			continue
+		}
+		c := newTrace()
+		tr.copyTo(c)
+		b.Add(c)
+	}
+	if owner != nil {
+		owner.Add(tr)
+	} else {
+		freeTrace(tr)
+	}
+}
+
+// recycle passes the values of tr's recyclable events to its
+// recycler, replacing them with their text so that the completed
+// trace can still be shown.
+// L < tr.mu
+func (tr *trace) recycle() {
+	if tr.recycler == nil {
+		return
+	}
+
+	var whats []interface{}
+	tr.mu.Lock()
+	for i := range tr.events {
+		if e := &tr.events[i]; e.Recyclable {
+			whats = append(whats, e.What)
+			e.What = fmt.Sprint(e.What)
+		}
+	}
+	tr.mu.Unlock()
+
+	go func(f func(interface{})) {
+		for _, what := range whats {
+			f(what)
+		}
+	}(tr.recycler)
+	tr.recycler = nil
 }
 
 const (
-	bucketsPerFamily    = 9
 	tracesPerBucket     = 10
 	maxActiveTraces     = 20 // Maximum number of active traces to show.
 	maxEventsPerTrace   = 10
 	numHistogramBuckets = 38
 )
 
+// defaultThresholds are the minimum durations of the traces kept in
+// each of a family's buckets, unless configured otherwise.
+var defaultThresholds = []time.Duration{
+	0,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	10 * time.Second,
+	100 * time.Second,
+}
+
+// FamilyConfig configures how a family of traces is retained and
+// displayed. Zero fields take their default values.
+type FamilyConfig struct {
+	// Thresholds are the minimum durations of the completed
+	// traces kept in each of the family's buckets, in increasing
+	// order. A trace is kept in every bucket whose threshold it
+	// meets; an additional bucket keeps the traces that resulted
+	// in an error. The default thresholds are 0, 50ms, 100ms,
+	// 200ms, 500ms, 1s, 10s and 100s.
+	Thresholds []time.Duration
+
+	// TracesPerBucket is the number of completed traces kept in
+	// each bucket. It defaults to 10.
+	TracesPerBucket int
+
+	// MaxEvents is the number of events kept in each trace,
+	// unless changed with SetMaxEvents. It defaults to 10.
+	MaxEvents int
+
+	// MaxActive is the number of active traces displayed. It
+	// defaults to 20.
+	MaxActive int
+
+	// HighResolution records the family's latency in log-linear
+	// histograms; see HighResolutionLatency.
+	HighResolution bool
+}
+
+// withDefaults returns the config with its zero fields set to their
+// defaults.
+func (cfg FamilyConfig) withDefaults() FamilyConfig {
+	if len(cfg.Thresholds) == 0 {
+		cfg.Thresholds = defaultThresholds
+	}
+	if cfg.TracesPerBucket <= 0 {
+		cfg.TracesPerBucket = tracesPerBucket
+	}
+	if cfg.MaxEvents <= 0 {
+		cfg.MaxEvents = maxEventsPerTrace
+	}
+	if cfg.MaxActive <= 0 {
+		cfg.MaxActive = maxActiveTraces
+	}
+	return cfg
+}
+
+var (
+	// Configuration for families registered with RegisterFamily.
+	configMu      sync.RWMutex
+	familyConfigs = make(map[string]FamilyConfig) // family -> config
+	errThresholds = errors.New("trace: bucket thresholds must be non-negative and increasing")
+	defaultConfig = FamilyConfig{}.withDefaults()
+)
+
+// RegisterFamily configures the named family of traces. It should be
+// called before any traces in the family are created: if the family
+// already has completed traces, they are discarded along with its
+// latency history, and active traces keep their previous maximum
+// number of events.
+func RegisterFamily(name string, cfg FamilyConfig) error {
+	for i, t := range cfg.Thresholds {
+		if t < 0 || (i > 0 && t <= cfg.Thresholds[i-1]) {
+			return errThresholds
+		}
+	}
+
+	cfg = cfg.withDefaults()
+	cfg.Thresholds = append([]time.Duration(nil), cfg.Thresholds...)
+
+	configMu.Lock()
+	familyConfigs[name] = cfg
+	configMu.Unlock()
+
+	completedMu.Lock()
+	old := completedTraces[name]
+	if old != nil {
+		completedTraces[name] = newFamily(cfg)
+	}
+	completedMu.Unlock()
+
+	if old != nil {
+		for _, b := range old.Buckets {
+			b.Clear()
+		}
+	}
+	return nil
+}
+
+// getFamilyConfig returns the configuration for the named family.
+func getFamilyConfig(fam string) FamilyConfig {
+	configMu.RLock()
+	cfg, ok := familyConfigs[fam]
+	configMu.RUnlock()
+	if !ok {
+		return defaultConfig
+	}
+	return cfg
+}
+
 var (
-	// The active traces.
-	activeMu     sync.RWMutex
-	activeTraces = make(map[string]*traceSet) // family -> traces
+	// The active traces, by family. Sets are added on a family's
+	// first trace and never removed, so New only loads from the map.
+	activeTraces sync.Map // family -> *traceSet
 
 	// Families of completed traces.
 	completedMu     sync.RWMutex
 	completedTraces = make(map[string]*family) // family -> traces
 )
 
+// activeShards is the number of shards in a traceSet.
+const (
+	activeShardBits = 5
+	activeShards    = 1 << activeShardBits
+)
+
+// A traceSet is the set of a family's active traces. Every trace is
+// added when it starts and removed when it finishes, so the set is
+// split into shards, each with its own lock, to keep concurrent
+// requests in the same family from contending.
 type traceSet struct {
-	mu sync.RWMutex
-	m  map[*trace]bool
+	shards [activeShards]traceShard
 
 	// We could avoid the entire map scan in FirstN by having a slice of all the traces
 	// ordered by start time, and an index into that from the trace struct, with a periodic
@@ -401,84 +671,131 @@ type traceSet struct {
 	// which is probably the wrong trade-off.
 }
 
+type traceShard struct {
+	mu  sync.RWMutex
+	m   map[*trace]bool
+	seq uint64 // the number of traces added to the shard
+
+	// Keep the shards' locks on separate cache lines.
+	_ [64 - (unsafe.Sizeof(sync.RWMutex{})+unsafe.Sizeof(map[*trace]bool(nil))+8)%64]byte
+}
+
+// shard returns the index of the shard holding tr, chosen by a
+// Fibonacci hash of its address.
+//
+// The hash only spreads traces across the shards: each shard's map
+// is still keyed by the trace itself. It is stable because the
+// garbage collector doesn't move heap objects, so Add and Remove pick
+// the same shard for a trace, and a trace is removed in Finish before
+// it is returned to tracePool.
+func (ts *traceSet) shard(tr *trace) int {
+	h := uint64(uintptr(unsafe.Pointer(tr))) * 0x9e3779b97f4a7c15
+	return int(h >> (64 - activeShardBits))
+}
+
 func (ts *traceSet) Len() int {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-	return len(ts.m)
+	n := 0
+	for i := range ts.shards {
+		sh := &ts.shards[i]
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
 }
 
+// Add adds tr to the set, numbering it so that its copies can be
+// told apart from those of other traces in the family.
 func (ts *traceSet) Add(tr *trace) {
-	ts.mu.Lock()
-	if ts.m == nil {
-		ts.m = make(map[*trace]bool)
+	i := ts.shard(tr)
+	sh := &ts.shards[i]
+	sh.mu.Lock()
+	if sh.m == nil {
+		sh.m = make(map[*trace]bool)
 	}
-	ts.m[tr] = true
-	ts.mu.Unlock()
+	sh.m[tr] = true
+	sh.seq++
+	tr.seq = sh.seq<<activeShardBits | uint64(i)
+	sh.mu.Unlock()
 }
 
 func (ts *traceSet) Remove(tr *trace) {
-	ts.mu.Lock()
-	delete(ts.m, tr)
-	ts.mu.Unlock()
+	sh := &ts.shards[ts.shard(tr)]
+	sh.mu.Lock()
+	delete(sh.m, tr)
+	sh.mu.Unlock()
 }
 
-// FirstN returns the first n traces ordered by time.
-func (ts *traceSet) FirstN(n int) traceList {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
+// each calls f for every trace in the set, holding the lock of its
+// shard.
+func (ts *traceSet) each(f func(tr *trace)) {
+	for i := range ts.shards {
+		sh := &ts.shards[i]
+		sh.mu.RLock()
+		for tr := range sh.m {
+			f(tr)
+		}
+		sh.mu.RUnlock()
+	}
+}
 
-	if n > len(ts.m) {
-		n = len(ts.m)
+// FirstN returns copies of the first n traces ordered by time.
+func (ts *traceSet) FirstN(n int) traceList {
+	if l := ts.Len(); n > l {
+		n = l
 	}
 	trl := make(traceList, 0, n)
-
-	// Fast path for when no selectivity is needed.
-	if n == len(ts.m) {
-		for tr := range ts.m {
-			tr.ref()
-			trl = append(trl, tr)
-		}
-		sort.Sort(trl)
+	if n <= 0 {
 		return trl
 	}
 
 	// Pick the oldest n traces.
 	// This is inefficient. See the comment in the traceSet struct.
-	for tr := range ts.m {
+	ts.each(func(tr *trace) {
 		// Put the first n traces into trl in the order they occur.
 		// When we have n, sort trl, and thereafter maintain its order.
 		if len(trl) < n {
-			tr.ref()
-			trl = append(trl, tr)
+			trl = append(trl, tr.clone())
 			if len(trl) == n {
-				// This is guaranteed to happen exactly once during this loop.
 				sort.Sort(trl)
 			}
-			continue
+			return
 		}
 		if tr.Start.After(trl[n-1].Start) {
-			continue
+			return
 		}
 
-		// Find where to insert this one.
-		tr.ref()
+		// Find where to insert this one, reusing the copy it displaces.
 		i := sort.Search(n, func(i int) bool { return trl[i].Start.After(tr.Start) })
-		trl[n-1].unref()
+		c := trl[n-1]
 		copy(trl[i+1:], trl[i:])
-		trl[i] = tr
-	}
+		tr.copyTo(c)
+		trl[i] = c
+	})
 
+	// Traces may have finished since the set was counted.
+	if len(trl) < n {
+		sort.Sort(trl)
+	}
 	return trl
 }
 
+// getActiveSet returns the active set of the named family, or nil if
+// the family has had no traces.
+func getActiveSet(fam string) *traceSet {
+	s, ok := activeTraces.Load(fam)
+	if !ok {
+		return nil
+	}
+	return s.(*traceSet)
+}
+
 func getActiveTraces(fam string) traceList {
-	activeMu.RLock()
-	s := activeTraces[fam]
-	activeMu.RUnlock()
+	s := getActiveSet(fam)
 	if s == nil {
 		return nil
 	}
-	return s.FirstN(maxActiveTraces)
+	return s.FirstN(getFamilyConfig(fam).MaxActive)
 }
 
 func getFamily(fam string, allocNew bool) *family {
@@ -496,7 +813,7 @@ func allocFamily(fam string) *family {
 	defer completedMu.Unlock()
 	f := completedTraces[fam]
 	if f == nil {
-		f = newFamily()
+		f = newFamily(getFamilyConfig(fam))
 		completedTraces[fam] = f
 	}
 	return f
@@ -504,84 +821,125 @@ func allocFamily(fam string) *family {
 
 // family represents a set of trace buckets and associated latency information.
 type family struct {
+	// Counts of completed traces, and of those that resulted in
+	// an error; accessed atomically. These are first to ensure
+	// 64-bit alignment.
+	completed int64
+	errors    int64
+
 	// traces may occur in multiple buckets.
-	Buckets [bucketsPerFamily]*traceBucket
+	Buckets []*traceBucket
 
 	// latency time series
 	LatencyMu sync.RWMutex
 	Latency   *timeseries.MinuteHourSeries
+
+	// newHistogram creates the histograms in the latency time
+	// series.
+	newHistogram func() latencyHistogram
 }
 
-func newFamily() *family {
+func newFamily(cfg FamilyConfig) *family {
+	newHistogram := newLog2Histogram
+	if cfg.HighResolution || HighResolutionLatency {
+		newHistogram = newLogLinearHistogram
+	}
+
+	buckets := make([]*traceBucket, 0, len(cfg.Thresholds)+1)
+	for _, t := range cfg.Thresholds {
+		buckets = append(buckets, newTraceBucket(minCond(t), cfg.TracesPerBucket))
+	}
+	buckets = append(buckets, newTraceBucket(errorCond{}, cfg.TracesPerBucket))
+
 	return &family{
-		Buckets: [bucketsPerFamily]*traceBucket{
-			{Cond: minCond(0)},
-			{Cond: minCond(50 * time.Millisecond)},
-			{Cond: minCond(100 * time.Millisecond)},
-			{Cond: minCond(200 * time.Millisecond)},
-			{Cond: minCond(500 * time.Millisecond)},
-			{Cond: minCond(1 * time.Second)},
-			{Cond: minCond(10 * time.Second)},
-			{Cond: minCond(100 * time.Second)},
-			{Cond: errorCond{}},
-		},
-		Latency: timeseries.NewMinuteHourSeries(func() timeseries.Observable { return new(histogram) }),
+		Buckets:      buckets,
+		Latency:      timeseries.NewMinuteHourSeries(func() timeseries.Observable { return newHistogram() }),
+		newHistogram: newHistogram,
 	}
 }
 
 // traceBucket represents a size-capped bucket of historic traces,
 // along with a condition for a trace to belong to the bucket.
+//
+// A bucket owns its traces: each trace is in one bucket, or one
+// export queue, and pages only see copies of it. A trace evicted from
+// a bucket is returned to tracePool at once, as nothing else holds it.
 type traceBucket struct {
 	Cond cond
 
 	// Ring buffer implementation of a fixed-size FIFO queue.
 	mu     sync.RWMutex
-	buf    [tracesPerBucket]*trace
-	start  int // < tracesPerBucket
-	length int // <= tracesPerBucket
+	buf    []*trace
+	start  int // < len(buf)
+	length int // <= len(buf)
+}
+
+func newTraceBucket(c cond, size int) *traceBucket {
+	return &traceBucket{Cond: c, buf: make([]*trace, size)}
 }
 
+// Add adds tr to the bucket, which then owns it.
 func (b *traceBucket) Add(tr *trace) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	size := len(b.buf)
 	i := b.start + b.length
-	if i >= tracesPerBucket {
-		i -= tracesPerBucket
+	if i >= size {
+		i -= size
 	}
-	if b.length == tracesPerBucket {
+	if b.length == size {
 		// "Remove" an element from the bucket.
-		b.buf[i].unref()
+		freeTrace(b.buf[i])
 		b.start++
-		if b.start == tracesPerBucket {
+		if b.start == size {
 			b.start = 0
 		}
 	}
 	b.buf[i] = tr
-	if b.length < tracesPerBucket {
+	if b.length < size {
 		b.length++
 	}
-	tr.ref()
+}
+
+// Clear removes the traces from the bucket.
+func (b *traceBucket) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, x := 0, b.start; i < b.length; i++ {
+		freeTrace(b.buf[x])
+		b.buf[x] = nil
+		x++
+		if x == len(b.buf) {
+			x = 0
+		}
+	}
+	b.start, b.length = 0, 0
 }
 
 // Copy returns a copy of the traces in the bucket.
 // If tracedOnly is true, only the traces with trace information will be returned.
-// The logs will be ref'd before returning; the caller should call
-// the Free method when it is done with them.
 // TODO(dsymonds): keep track of traced requests in separate buckets.
 func (b *traceBucket) Copy(tracedOnly bool) traceList {
+	return b.Filter(func(tr *trace) bool {
+		return !tracedOnly || tr.spanID.IsValid()
+	})
+}
+
+// Filter returns copies of the traces in the bucket for which match
+// returns true.
+func (b *traceBucket) Filter(match func(*trace) bool) traceList {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
 	trl := make(traceList, 0, b.length)
 	for i, x := 0, b.start; i < b.length; i++ {
-		tr := b.buf[x]
-		if !tracedOnly || tr.spanID != 0 {
-			tr.ref()
-			trl = append(trl, tr)
+		if tr := b.buf[x]; match(tr) {
+			trl = append(trl, tr.clone())
 		}
 		x++
-		if x == b.length {
+		if x == len(b.buf) {
 			x = 0
 		}
 	}
@@ -612,13 +970,6 @@ func (e errorCond) String() string      { return "errors" }
 
 type traceList []*trace
 
-// Free calls unref on each element of the list.
-func (trl traceList) Free() {
-	for _, t := range trl {
-		t.unref()
-	}
-}
-
 // traceList may be sorted in reverse chronological order.
 func (trl traceList) Len() int           { return len(trl) }
 func (trl traceList) Less(i, j int) bool { return trl[i].Start.After(trl[j].Start) }
@@ -632,6 +983,7 @@ type event struct {
 	Recyclable bool          // whether this event was passed via LazyLog
 	Sensitive  bool          // whether this event contains sensitive information
 	What       interface{}   // string or fmt.Stringer
+	Attrs      []Attr        // attributes of the event
 }
 
 // WhenString returns a string representation of the elapsed time of the event.
@@ -665,8 +1017,10 @@ type trace struct {
 	Elapsed time.Duration // zero while active
 
 	// Trace information if non-zero.
-	traceID uint64
-	spanID  uint64
+	traceID  TraceID
+	spanID   SpanID
+	parentID SpanID
+	sampled  bool
 
 	// Whether this trace resulted in an error.
 	IsError bool
@@ -675,8 +1029,10 @@ type trace struct {
 	mu        sync.RWMutex
 	events    []event
 	maxEvents int
+	attrs     []Attr // guarded by mu
 
-	refs     int32 // how many buckets this is in
+	seq      uint64    // numbers the trace in its active set; kept by copies
+	active   *traceSet // the active set this is in until it finishes
 	recycler func(interface{})
 	disc     discarded // scratch space to avoid allocation
 
@@ -691,12 +1047,16 @@ func (tr *trace) reset() {
 	tr.Title = ""
 	tr.Start = time.Time{}
 	tr.Elapsed = 0
-	tr.traceID = 0
-	tr.spanID = 0
+	tr.traceID = TraceID{}
+	tr.spanID = SpanID{}
+	tr.parentID = SpanID{}
+	tr.sampled = false
 	tr.IsError = false
 	tr.maxEvents = 0
 	tr.events = nil
-	tr.refs = 0
+	tr.attrs = nil
+	tr.seq = 0
+	tr.active = nil
 	tr.recycler = nil
 	tr.disc = 0
 	tr.finishStack = nil
@@ -716,7 +1076,7 @@ func (tr *trace) delta(t time.Time) (time.Duration, bool) {
 	return t.Sub(prev), prev.Day() != t.Day()
 }
 
-func (tr *trace) addEvent(x interface{}, recyclable, sensitive bool) {
+func (tr *trace) addEvent(x interface{}, recyclable, sensitive bool, attrs ...Attr) {
 	if DebugUseAfterFinish && tr.finishStack != nil {
 		buf := make([]byte, 4<<10) // 4 KB should be enough
 		n := runtime.Stack(buf, false)
@@ -737,7 +1097,7 @@ func (tr *trace) addEvent(x interface{}, recyclable, sensitive bool) {
 		since it makes this package much less efficient.
 	*/
 
-	e := event{When: time.Now(), What: x, Recyclable: recyclable, Sensitive: sensitive}
+	e := event{When: time.Now(), What: x, Recyclable: recyclable, Sensitive: sensitive, Attrs: attrs}
 	tr.mu.Lock()
 	e.Elapsed, e.NewDay = tr.delta(e.When)
 	if len(tr.events) < tr.maxEvents {
@@ -755,6 +1115,7 @@ func (tr *trace) addEvent(x interface{}, recyclable, sensitive bool) {
 				go tr.recycler(tr.events[di].What)
 			}
 			tr.events[di].What = &tr.disc
+			tr.events[di].Attrs = nil
 		}
 		// The timestamp of the discarded meta-event should be
 		// the time of the last event it is representing.
@@ -784,7 +1145,8 @@ func (tr *trace) SetRecycler(f func(interface{})) {
 }
 
 func (tr *trace) SetTraceInfo(traceID, spanID uint64) {
-	tr.traceID, tr.spanID = traceID, spanID
+	binary.BigEndian.PutUint64(tr.traceID[8:], traceID)
+	binary.BigEndian.PutUint64(tr.spanID[:], spanID)
 }
 
 func (tr *trace) SetMaxEvents(m int) {
@@ -794,27 +1156,45 @@ func (tr *trace) SetMaxEvents(m int) {
 	}
 }
 
-func (tr *trace) ref() {
-	atomic.AddInt32(&tr.refs, 1)
-}
+// copyTo copies tr to dst, reusing dst's events. Recyclable events
+// are formatted if tr has a recycler, since their values are recycled
+// when tr finishes.
+func (tr *trace) copyTo(dst *trace) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
 
-func (tr *trace) unref() {
-	if atomic.AddInt32(&tr.refs, -1) == 0 {
-		if tr.recycler != nil {
-			// freeTrace clears tr, so we hold tr.recycler and tr.events here.
-			go func(f func(interface{}), es []event) {
-				for _, e := range es {
-					if e.Recyclable {
-						f(e.What)
-					}
-				}
-			}(tr.recycler, tr.events)
+	dst.Family, dst.Title = tr.Family, tr.Title
+	dst.Start, dst.Elapsed = tr.Start, tr.Elapsed
+	dst.traceID, dst.spanID, dst.parentID = tr.traceID, tr.spanID, tr.parentID
+	dst.sampled = tr.sampled
+	dst.IsError = tr.IsError
+	dst.maxEvents = tr.maxEvents
+	dst.attrs = append(dst.attrs[:0], tr.attrs...)
+	dst.seq = tr.seq
+	dst.disc = tr.disc
+
+	if dst.events == nil {
+		dst.events = dst.eventsBuf[:0]
+	}
+	dst.events = append(dst.events[:0], tr.events...)
+	for i := range dst.events {
+		e := &dst.events[i]
+		switch {
+		case e.What == &tr.disc:
+			e.What = &dst.disc
+		case e.Recyclable && tr.recycler != nil:
+			e.What = fmt.Sprint(e.What)
 		}
-
-		freeTrace(tr)
 	}
 }
 
+// clone returns a copy of tr for a page or search to read.
+func (tr *trace) clone() *trace {
+	c := new(trace)
+	tr.copyTo(c)
+	return c
+}
+
 func (tr *trace) When() string {
 	return tr.Start.Format("2006/01/02 15:04:05.000000")
 }
@@ -834,29 +1214,25 @@ func (tr *trace) Events() []event {
 	return tr.events
 }
 
-var traceFreeList = make(chan *trace, 1000) // TODO(dsymonds): Use sync.Pool?
+// tracePool holds freed traces for reuse. Unlike a fixed-size free
+// list, it grows with the request rate and is emptied by the garbage
+// collector when traces are no longer being created.
+var tracePool = sync.Pool{
+	New: func() interface{} { return new(trace) },
+}
 
 // newTrace returns a trace ready to use.
 func newTrace() *trace {
-	select {
-	case tr := <-traceFreeList:
-		return tr
-	default:
-		return new(trace)
-	}
+	return tracePool.Get().(*trace)
 }
 
-// freeTrace adds tr to traceFreeList if there's room.
-// This is non-blocking.
+// freeTrace returns tr to tracePool once nothing holds it.
 func freeTrace(tr *trace) {
 	if DebugUseAfterFinish {
 		return // never reuse
 	}
 	tr.reset()
-	select {
-	case traceFreeList <- tr:
-	default:
-	}
+	tracePool.Put(tr)
 }
 
 func elapsed(d time.Duration) string {
@@ -884,17 +1260,28 @@ func elapsed(d time.Duration) string {
 var pageTmpl = template.Must(template.New("Page").Funcs(template.FuncMap{
 	"elapsed": elapsed,
 	"add":     func(a, b int) int { return a + b },
+	"attrs":   formatAttrs,
+	// pad returns a slice with an element for each of the n-m
+	// cells needed to align a row of m cells with the longest.
+	"pad": func(m, n int) []struct{} {
+		if m >= n {
+			return nil
+		}
+		return make([]struct{}, n-m)
+	},
 }).Parse(pageHTML))
 
 const pageHTML = `
 {{template "Prolog" .}}
 {{template "StatusTable" .}}
+{{template "Search" .}}
+{{template "Waterfall" .}}
 {{template "Epilog" .}}
 
 {{define "Prolog"}}
 <html>
 	<head>
-	<title>/debug/requests</title>
+	<title>{{$.Path}}</title>
 	<style type="text/css">
 		body {
 			font-family: sans-serif;
@@ -930,6 +1317,25 @@ const pageHTML = `
 			white-space: pre;
 			width: 10em;
 		}
+		table#waterfall {
+			margin-top: 1em;
+			width: 100%;
+		}
+		table#waterfall td {
+			font-family: monospace;
+			white-space: nowrap;
+		}
+		table#waterfall td.timeline {
+			width: 50%;
+		}
+		table#waterfall div.bar {
+			background-color: #79b;
+			height: 1em;
+			min-width: 1px;
+		}
+		table#waterfall div.bar.error {
+			background-color: #c66;
+		}
 		address {
 			font-size: smaller;
 			margin-top: 5em;
@@ -938,7 +1344,8 @@ const pageHTML = `
 	</head>
 	<body>
 
-<h1>/debug/requests</h1>
+<h1>{{$.Path}}</h1>
+{{if not $.Snapshot.IsZero}}<p><em>Snapshot taken at {{$.Snapshot}}.</em></p>{{end}}
 {{end}} {{/* end of Prolog */}}
 
 {{define "StatusTable"}}
@@ -965,6 +1372,7 @@ const pageHTML = `
 		{{end}}
 
 		{{$nb := len $f.Buckets}}
+		{{range pad $nb $.MaxBuckets}}<td></td>{{end}}
 		<td class="latency-first">
 		<a href="?fam={{$fam}}&b={{$nb}}">[minute]</a>
 		</td>
@@ -980,6 +1388,86 @@ const pageHTML = `
 </table>
 {{end}} {{/* end of StatusTable */}}
 
+{{define "Search"}}
+<form id="search" method="get">
+	<input type="hidden" name="search" value="1" />
+	<label>Family <input type="text" name="fam" size="12" value="{{if $.Searched}}{{$.Form.Get "fam"}}{{end}}" /></label>
+	<label>Title <input type="text" name="q" size="12" value="{{$.Form.Get "q"}}" /></label>
+	<label>Regexp <input type="text" name="re" size="12" value="{{$.Form.Get "re"}}" /></label>
+	<label>Elapsed &ge; <input type="text" name="min" size="5" value="{{$.Form.Get "min"}}" /></label>
+	<label>&le; <input type="text" name="max" size="5" value="{{$.Form.Get "max"}}" /></label>
+	<label>Since <input type="text" name="since" size="8" value="{{$.Form.Get "since"}}" /></label>
+	<label>Until <input type="text" name="until" size="8" value="{{$.Form.Get "until"}}" /></label>
+	<label>Event <input type="text" name="event" size="12" value="{{$.Form.Get "event"}}" /></label>
+	<label>Attr <input type="text" name="attr" size="12" placeholder="key=value" value="{{$.Form.Get "attr"}}" /></label>
+	<label><input type="checkbox" name="errors" value="1" {{if $.Form.Get "errors"}}checked{{end}} /> Errors</label>
+	<label><input type="checkbox" name="exp" value="1" {{if $.Expanded}}checked{{end}} /> Expanded</label>
+	<input type="submit" value="Search" />
+</form>
+
+{{if $.SearchError}}
+<p><em>{{$.SearchError}}</em></p>
+{{else if $.Searched}}
+<hr />
+<table id="reqs">
+	<caption>
+		Search Results ({{len $.Results}})
+	</caption>
+	<tr><th>When</th><th>Elapsed&nbsp;(s)</th></tr>
+	{{range $tr := $.Results}}
+	<tr class="first">
+		<td class="when">{{$tr.When}}</td>
+		<td class="elapsed">{{$tr.ElapsedTime}}</td>
+		<td>{{$tr.Family}}: {{$tr.Title}}{{if $tr.IsError}} <em>(error)</em>{{end}}{{if not $tr.Elapsed}} <em>(active)</em>{{end}}{{template "TraceLink" $tr}}</td>
+	</tr>
+	{{if $.Expanded}}
+	{{with $tr.Attrs}}
+	<tr>
+		<td class="when"></td>
+		<td class="elapsed"></td>
+		<td>{{attrs . $.ShowSensitive}}</td>
+	</tr>
+	{{end}}
+	{{range $tr.Events}}
+	<tr>
+		<td class="when">{{.WhenString}}</td>
+		<td class="elapsed">{{elapsed .Elapsed}}</td>
+		<td>{{if or $.ShowSensitive (not .Sensitive)}}... {{.What}}{{with .Attrs}} [{{attrs . $.ShowSensitive}}]{{end}}{{else}}<em>[redacted]</em>{{end}}</td>
+	</tr>
+	{{end}}
+	{{end}}
+	{{end}}
+</table>
+{{end}}
+{{end}} {{/* end of Search */}}
+
+{{define "TraceLink"}}{{with .SpanContext}}{{if .IsValid}} <a href="?trace={{.TraceID}}">[trace {{.TraceID}}]</a>{{end}}{{end}}{{end}}
+
+{{define "Waterfall"}}
+{{if $.TraceError}}
+<p><em>{{$.TraceError}}</em></p>
+{{end}}
+{{with $.Waterfall}}
+<hr />
+<h3>Trace {{.TraceID}}</h3>
+{{if .Spans}}
+<table id="waterfall">
+	<tr><th>When</th><th>Elapsed&nbsp;(s)</th><th>Span</th><th class="timeline">{{.Elapsed}}</th></tr>
+	{{range .Spans}}
+	<tr>
+		<td class="when">{{.When}}</td>
+		<td class="elapsed">{{.ElapsedTime}}</td>
+		<td class="span" style="padding-left: {{.Depth}}em"><a href="?fam={{.Family}}&b=-1&exp=1">{{.Family}}</a>: {{.Title}}{{if .IsError}} <em>(error)</em>{{end}}{{if not .Elapsed}} <em>(active)</em>{{end}}</td>
+		<td class="timeline"><div class="bar{{if .IsError}} error{{end}}" style="margin-left: {{.Left}}%; width: {{.Width}}%"></div></td>
+	</tr>
+	{{end}}
+</table>
+{{else}}
+<p><em>No spans of this trace are held.</em></p>
+{{end}}
+{{end}}
+{{end}} {{/* end of Waterfall */}}
+
 {{define "Epilog"}}
 {{if $.Traces}}
 <hr />
@@ -1023,15 +1511,21 @@ const pageHTML = `
 	<tr class="first">
 		<td class="when">{{$tr.When}}</td>
 		<td class="elapsed">{{$tr.ElapsedTime}}</td>
-		<td>{{$tr.Title}}</td>
-		{{/* TODO: include traceID/spanID */}}
+		<td>{{$tr.Title}}{{template "TraceLink" $tr}}</td>
 	</tr>
 	{{if $.Expanded}}
+	{{with $tr.Attrs}}
+	<tr>
+		<td class="when"></td>
+		<td class="elapsed"></td>
+		<td>{{attrs . $.ShowSensitive}}</td>
+	</tr>
+	{{end}}
 	{{range $tr.Events}}
 	<tr>
 		<td class="when">{{.WhenString}}</td>
 		<td class="elapsed">{{elapsed .Elapsed}}</td>
-		<td>{{if or $.ShowSensitive (not .Sensitive)}}... {{.What}}{{else}}<em>[redacted]</em>{{end}}</td>
+		<td>{{if or $.ShowSensitive (not .Sensitive)}}... {{.What}}{{with .Attrs}} [{{attrs . $.ShowSensitive}}]{{end}}{{else}}<em>[redacted]</em>{{end}}</td>
 	</tr>
 	{{end}}
 	{{end}}
@@ -5,9 +5,21 @@
 package trace
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type s struct{}
@@ -30,6 +42,38 @@ func TestReset(t *testing.T) {
 	if !reflect.DeepEqual(tr, new(trace)) {
 		t.Errorf("reset didn't clear all fields: %+v", tr)
 	}
+
+	// Drop the reset trace from the family's bucket, which owns it
+	// and would otherwise show it to later tests.
+	if err := RegisterFamily("foo", FamilyConfig{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+// recyclable is an event that is cleared when it is recycled.
+type recyclable struct{ s string }
+
+func (r *recyclable) String() string { return r.s }
+
+// TestRecycler checks that a completed trace keeps the text of its
+// recyclable events after they are recycled.
+func TestRecycler(t *testing.T) {
+	recycled := make(chan interface{}, 1)
+	tr := New("recycler.Family", "recycled")
+	tr.SetRecycler(func(x interface{}) {
+		x.(*recyclable).s = ""
+		recycled <- x
+	})
+	tr.LazyLog(&recyclable{"recycled event"}, false)
+	tr.Finish()
+	<-recycled
+
+	req := httptest.NewRequest("GET", "/debug/requests?fam=recycler.Family&b=0&exp=1", nil)
+	buf := new(bytes.Buffer)
+	Render(buf, req, true)
+	if !strings.Contains(buf.String(), "recycled event") {
+		t.Fatal("the completed trace lost its recycled event")
+	}
 }
 
 // TestResetLog checks whether all the fields are zeroed after reset.
@@ -70,6 +114,967 @@ func TestAuthRequest(t *testing.T) {
 	}
 }
 
+// TestRenderJSON checks the JSON representation of the traces.
+func TestRenderJSON(t *testing.T) {
+	tr := New("json.Finished", "finished")
+	tr.LazyPrintf("public %d", 1)
+	tr.LazyLog(s{}, true)
+	tr.SetError()
+	tr.Finish()
+
+	active := New("json.Finished", "active")
+	defer active.Finish()
+
+	req := httptest.NewRequest("GET", "/debug/requests?fam=json.Finished", nil)
+	buf := new(bytes.Buffer)
+	RenderJSON(buf, req, false)
+
+	var reqs Requests
+	if err := json.Unmarshal(buf.Bytes(), &reqs); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(reqs.Families) != 1 {
+		t.Fatalf("expected one family, got %d", len(reqs.Families))
+	}
+
+	fam := reqs.Families[0]
+	if fam.Active != 1 || len(fam.ActiveTraces) != 1 || !fam.ActiveTraces[0].Active {
+		t.Fatalf("expected one active trace, got %+v", fam.ActiveTraces)
+	}
+
+	if fam.Latency["total"].Count != 1 {
+		t.Fatalf("expected one latency observation, got %d", fam.Latency["total"].Count)
+	}
+
+	errs := fam.Buckets[len(fam.Buckets)-1]
+	if errs.Cond != "errors" || len(errs.Traces) != 1 {
+		t.Fatalf("expected one trace in the error bucket, got %+v", errs)
+	}
+
+	rec := errs.Traces[0]
+	if rec.Title != "finished" || !rec.IsError || len(rec.Events) != 2 {
+		t.Fatalf("unexpected trace %+v", rec)
+	}
+
+	if rec.Events[0].What != "public 1" {
+		t.Errorf("expected the first event to be public, got %+v", rec.Events[0])
+	}
+
+	if !rec.Events[1].Redacted || rec.Events[1].What != "" {
+		t.Errorf("expected the sensitive event to be redacted, got %+v", rec.Events[1])
+	}
+
+	buf.Reset()
+	RenderJSON(buf, req, true)
+	if !bytes.Contains(buf.Bytes(), []byte("lazy string")) {
+		t.Errorf("expected the sensitive event to be shown:\n%s", buf.Bytes())
+	}
+}
+
+// TestRenderEventsJSON checks the JSON representation of the event
+// logs.
+func TestRenderEventsJSON(t *testing.T) {
+	el := NewEventLog("json.Events", "conn")
+	defer el.Finish()
+	el.Printf("connected")
+	el.Errorf("failed: %d", 42)
+
+	healthy := NewEventLog("json.Events", "healthy")
+	defer healthy.Finish()
+
+	// b=1 selects the event logs with an error in the last ten
+	// seconds.
+	req := httptest.NewRequest("GET", "/debug/events?fam=json.Events&b=1", nil)
+	buf := new(bytes.Buffer)
+	RenderEventsJSON(buf, req)
+
+	var evs Events
+	if err := json.Unmarshal(buf.Bytes(), &evs); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(evs.Families) != 1 {
+		t.Fatalf("expected one family, got %d", len(evs.Families))
+	}
+
+	fam := evs.Families[0]
+	if fam.Counts[0].Count != 2 || fam.Counts[1].Count != 1 {
+		t.Fatalf("unexpected counts %+v %+v", fam.Counts[0], fam.Counts[1])
+	}
+
+	if len(fam.EventLogs) != 1 {
+		t.Fatalf("expected one event log, got %d", len(fam.EventLogs))
+	}
+
+	rec := fam.EventLogs[0]
+	if rec.Title != "conn" || rec.LastErrorTime == nil || len(rec.Events) != 2 || len(rec.Stack) == 0 {
+		t.Fatalf("unexpected event log %+v", rec)
+	}
+
+	if !rec.Events[1].IsError || rec.Events[1].What != "failed: 42" {
+		t.Errorf("unexpected event %+v", rec.Events[1])
+	}
+}
+
+// TestRenderMetrics checks the metrics exposition.
+func TestRenderMetrics(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		tr := New("metrics.Family", "title")
+		if i == 0 {
+			tr.SetError()
+		}
+		tr.Finish()
+	}
+
+	active := New("metrics.Family", "active")
+	defer active.Finish()
+
+	el := NewEventLog("metrics.Events", "conn")
+	defer el.Finish()
+	el.Errorf("failed")
+
+	buf := new(bytes.Buffer)
+	if err := RenderMetrics(buf, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := []string{
+		"# TYPE trace_requests_total counter\n",
+		`trace_requests_total{family="metrics.Family"} 3` + "\n",
+		`trace_request_errors_total{family="metrics.Family"} 1` + "\n",
+		`trace_active_requests{family="metrics.Family"} 1` + "\n",
+		`trace_request_duration_seconds_bucket{family="metrics.Family",le="+Inf"} 3` + "\n",
+		`trace_request_duration_seconds_count{family="metrics.Family"} 3` + "\n",
+		`trace_event_logs{family="metrics.Events",bucket="errs<10s"} 1` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("expected %q in the metrics:\n%s", line, buf)
+		}
+	}
+
+	if strings.Contains(buf.String(), "# EOF") {
+		t.Fatal("the Prometheus text format shouldn't have an EOF marker")
+	}
+
+	buf.Reset()
+	if err := RenderMetrics(buf, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(buf.String(), "# TYPE trace_requests counter\n") || !strings.HasSuffix(buf.String(), "# EOF\n") {
+		t.Fatalf("malformed OpenMetrics exposition:\n%s", buf)
+	}
+}
+
+// TestRegisterFamily checks that families may be configured.
+func TestRegisterFamily(t *testing.T) {
+	err := RegisterFamily("config.Bad", FamilyConfig{Thresholds: []time.Duration{0, time.Second, time.Second}})
+	if err == nil {
+		t.Fatal("expected an error for thresholds that don't increase")
+	}
+
+	err = RegisterFamily("config.Family", FamilyConfig{
+		Thresholds:      []time.Duration{0, time.Hour},
+		TracesPerBucket: 2,
+		MaxEvents:       4,
+		MaxActive:       1,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		New("config.Family", "done").Finish()
+	}
+
+	for i := 0; i < 2; i++ {
+		tr := New("config.Family", "active")
+		defer tr.Finish()
+
+		if tr.(*trace).maxEvents != 4 {
+			t.Fatalf("expected traces to keep 4 events, but they keep %d", tr.(*trace).maxEvents)
+		}
+	}
+
+	f := getFamily("config.Family", false)
+	if len(f.Buckets) != 3 {
+		t.Fatalf("expected 2 buckets plus errors, got %d", len(f.Buckets))
+	}
+
+	if trl := f.Buckets[0].Copy(false); len(trl) != 2 {
+		t.Fatalf("expected 2 traces in the bucket, got %d", len(trl))
+	}
+
+	if trl := getActiveTraces("config.Family"); len(trl) != 1 {
+		t.Fatalf("expected 1 active trace to be shown, got %d", len(trl))
+	}
+
+	// The histogram links follow the family's buckets.
+	req := httptest.NewRequest("GET", "/debug/requests?fam=config.Family&b=5", nil)
+	buf := new(bytes.Buffer)
+	Render(buf, req, true)
+	if !strings.Contains(buf.String(), "over all time") {
+		t.Fatalf("expected the all-time histogram:\n%s", buf)
+	}
+}
+
+// TestSearch checks that traces may be searched.
+func TestSearch(t *testing.T) {
+	users := New("search.Family", "GET /users/1")
+	users.LazyPrintf("cache miss")
+	users.Finish()
+
+	orders := New("search.Family", "GET /orders/2")
+	orders.LazyLog(s{}, true)
+	orders.SetError()
+	orders.Finish()
+
+	active := New("search.Other", "GET /users/3")
+	defer active.Finish()
+
+	testCases := []struct {
+		query     string
+		sensitive bool
+		titles    []string
+	}{
+		{"q=/users/", false, []string{"GET /users/3", "GET /users/1"}},
+		{"q=/users/&fam=search.Family", false, []string{"GET /users/1"}},
+		{"re=^GET+/orders/[0-9]%2B$", false, []string{"GET /orders/2"}},
+		// The error trace is in two buckets, but is only
+		// returned once.
+		{"errors=1&fam=search.Family", false, []string{"GET /orders/2"}},
+		{"event=cache&fam=search.Family", false, []string{"GET /users/1"}},
+		// Sensitive events aren't searched unless they may be
+		// seen.
+		{"event=lazy&fam=search.Family", false, nil},
+		{"event=lazy&fam=search.Family", true, []string{"GET /orders/2"}},
+		{"min=1h&fam=search.Family", false, nil},
+		{"since=1h&limit=1&fam=search.Family", false, []string{"GET /orders/2"}},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/debug/requests?search=1&"+tc.query, nil)
+		filter, ok, err := ParseFilter(req)
+		if !ok || err != nil {
+			t.Fatalf("%s: failed to parse the filter: %v", tc.query, err)
+		}
+
+		var titles []string
+		for _, rec := range Search(filter, tc.sensitive) {
+			titles = append(titles, rec.Title)
+		}
+
+		if !reflect.DeepEqual(titles, tc.titles) {
+			t.Errorf("%s: got %q, want %q", tc.query, titles, tc.titles)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/debug/requests?search=1&min=soon", nil)
+	if _, ok, err := ParseFilter(req); !ok || err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+
+	req = httptest.NewRequest("GET", "/debug/requests?search=1&q=/orders/", nil)
+	buf := new(bytes.Buffer)
+	Render(buf, req, true)
+	if !strings.Contains(buf.String(), "Search Results (1)") {
+		t.Fatalf("expected one search result:\n%s", buf)
+	}
+}
+
+func TestAttrs(t *testing.T) {
+	tr := New("attrs.Family", "GET /users/1").(SpanTrace)
+	tr.SetAttr("route", "/users/:id")
+	tr.SetAttrs(Int("status", 404), Sensitive(String("user", "alice")))
+	tr.SetAttr("status", 200)
+	tr.LazyLogAttrs(s{}, false, Duration("wait", time.Millisecond), Sensitive(Bool("cached", true)))
+	tr.Finish()
+
+	rec := Search(&Filter{Family: "attrs.Family"}, false)
+	if len(rec) != 1 {
+		t.Fatalf("expected one trace, got %d", len(rec))
+	}
+
+	want := []*AttrRecord{
+		{Key: "route", Value: "/users/:id"},
+		{Key: "status", Value: 200},
+		{Key: "user", Sensitive: true, Redacted: true},
+	}
+	if !reflect.DeepEqual(rec[0].Attrs, want) {
+		t.Fatalf("unexpected trace attributes: %+v", rec[0].Attrs)
+	}
+
+	want = []*AttrRecord{
+		{Key: "wait", Value: int64(time.Millisecond)},
+		{Key: "cached", Sensitive: true, Redacted: true},
+	}
+	if !reflect.DeepEqual(rec[0].Events[0].Attrs, want) {
+		t.Fatalf("unexpected event attributes: %+v", rec[0].Events[0].Attrs)
+	}
+
+	testCases := []struct {
+		query     string
+		sensitive bool
+		found     bool
+	}{
+		{"attr=route=/users/:id", false, true},
+		{"attr=status=200&attr=route", false, true},
+		{"attr=status=404", false, false},
+		{"attr=wait=1ms", false, true},
+		{"attr=user=alice", false, false},
+		{"attr=user=alice", true, true},
+		{"attr=cached", false, false},
+		{"attr=cached=true", true, true},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/debug/requests?search=1&fam=attrs.Family&"+tc.query, nil)
+		filter, _, err := ParseFilter(req)
+		if err != nil {
+			t.Fatalf("%s: failed to parse the filter: %v", tc.query, err)
+		}
+
+		if found := len(Search(filter, tc.sensitive)) > 0; found != tc.found {
+			t.Errorf("%s: found %v, want %v", tc.query, found, tc.found)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/debug/requests?search=1&fam=attrs.Family&exp=1", nil)
+	buf := new(bytes.Buffer)
+	Render(buf, req, false)
+	if !strings.Contains(buf.String(), "route=/users/:id status=200 user=[redacted]") {
+		t.Fatalf("expected the trace attributes:\n%s", buf)
+	}
+	if strings.Contains(buf.String(), "alice") {
+		t.Fatal("sensitive attribute shown")
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("unexpected span context: %+v", sc)
+	}
+	if sc.Traceparent() != tp {
+		t.Fatalf("got %s, want %s", sc.Traceparent(), tp)
+	}
+
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); err != nil {
+		t.Fatalf("failed to parse a later version: %s", err)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",
+	}
+	for _, v := range invalid {
+		if _, err := ParseTraceparent(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	// Every bit of the IDs is random.
+	var high [3]bool
+	for i := 0; i < 64; i++ {
+		sc := newSpanContext(SpanContext{})
+		high[0] = high[0] || sc.TraceID[0]&0x80 != 0
+		high[1] = high[1] || sc.TraceID[8]&0x80 != 0
+		high[2] = high[2] || sc.SpanID[0]&0x80 != 0
+	}
+	if high != [3]bool{true, true, true} {
+		t.Fatalf("the high bits of the IDs are never set: %v", high)
+	}
+
+	root, ctx := StartSpan(context.Background(), "spans.Root", "GET /checkout")
+	defer root.Finish()
+	child, cctx := StartSpan(ctx, "spans.Child", "charge card")
+	rsc, csc := root.SpanContext(), child.SpanContext()
+	grandchild, _ := StartSpan(cctx, "spans.Child", "POST /charge")
+	grandchild.SetError()
+	grandchild.Finish()
+	child.Finish()
+	sibling, _ := StartSpan(ctx, "spans.Child", "send receipt")
+	sibling.Finish()
+
+	if !rsc.IsValid() || !rsc.Sampled {
+		t.Fatalf("invalid root span context: %+v", rsc)
+	}
+	if csc.TraceID != rsc.TraceID || csc.SpanID == rsc.SpanID {
+		t.Fatalf("child span context %+v doesn't belong to %+v", csc, rsc)
+	}
+
+	wf := CollectWaterfall(rsc.TraceID, false)
+	var got []string
+	for _, span := range wf.Spans {
+		got = append(got, strings.Repeat(" ", span.Depth)+span.Title)
+	}
+	want := []string{"GET /checkout", " charge card", "  POST /charge", " send receipt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got waterfall %q, want %q", got, want)
+	}
+	if wf.Spans[1].ParentID != rsc.SpanID.String() || !wf.Spans[0].Active {
+		t.Fatalf("unexpected spans: %+v, %+v", wf.Spans[0].TraceRecord, wf.Spans[1].TraceRecord)
+	}
+
+	req := httptest.NewRequest("GET", "/debug/requests?trace="+rsc.TraceID.String(), nil)
+	buf := new(bytes.Buffer)
+	Render(buf, req, true)
+	if !strings.Contains(buf.String(), "Trace "+rsc.TraceID.String()) || !strings.Contains(buf.String(), "margin-left: 0%") {
+		t.Fatalf("expected a waterfall:\n%s", buf)
+	}
+
+	// Remote parents are used when the context has no trace.
+	remote := SpanContext{TraceID: rsc.TraceID, SpanID: SpanID{1}}
+	tr, _ := StartSpan(ContextWithRemoteSpan(context.Background(), remote), "spans.Child", "remote")
+	defer tr.Finish()
+	if sc := tr.SpanContext(); sc.TraceID != remote.TraceID || sc.Sampled {
+		t.Fatalf("span context %+v isn't a child of %+v", sc, remote)
+	}
+
+	// Other implementations of Trace needn't be SpanTraces; the
+	// remote span is used instead.
+	ctx = NewContext(ContextWithRemoteSpan(context.Background(), remote), otherTrace{})
+	if sc, ok := SpanContextFromContext(ctx); !ok || sc != remote {
+		t.Fatalf("expected the remote span context %+v, but have %+v", remote, sc)
+	}
+}
+
+// otherTrace implements Trace, but not SpanTrace.
+type otherTrace struct {
+	Trace
+}
+
+func TestMiddleware(t *testing.T) {
+	var sc SpanContext
+	h := Middleware("middleware.Family", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sc, _ = SpanContextFromContext(req.Context())
+	}))
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set(TraceparentHeader, parent)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Fatalf("the handler's span %+v isn't a child of %s", sc, parent)
+	}
+	if got := w.Header().Get(TraceresponseHeader); got != sc.Traceparent() {
+		t.Fatalf("got traceresponse %q, want %q", got, sc.Traceparent())
+	}
+
+	outgoing := http.Header{}
+	Inject(outgoing, sc)
+	if got, ok := Extract(outgoing); !ok || got != sc {
+		t.Fatalf("got %+v, want %+v", got, sc)
+	}
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	var traced bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, req *http.Request) {
+		_, traced = FromContext(req.Context())
+		w.Write([]byte("alice"))
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	serve := func(h http.Handler, method, path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	}
+
+	serve(MiddlewareWithOptions(mux, WithRouteFamily(mux)), "GET", "/users/1")
+	if !traced {
+		t.Fatal("no trace in the request context")
+	}
+	recs := Search(&Filter{Family: "/users/"}, false)
+	if len(recs) != 1 || recs[0].Title != "GET /users/1" || recs[0].IsError {
+		t.Fatalf("unexpected traces: %+v", recs)
+	}
+	want := []*AttrRecord{
+		{Key: "http.method", Value: "GET"},
+		{Key: "http.path", Value: "/users/1"},
+		{Key: "http.status_code", Value: int64(200)},
+		{Key: "http.response_size", Value: int64(5)},
+	}
+	if !reflect.DeepEqual(recs[0].Attrs, want) {
+		t.Fatalf("unexpected attributes: %+v", recs[0].Attrs)
+	}
+
+	serve(MiddlewareWithOptions(mux, WithMethodFamily()), "POST", "/fail")
+	recs = Search(&Filter{Family: "http POST"}, false)
+	if len(recs) != 1 || !recs[0].IsError {
+		t.Fatalf("expected an error trace: %+v", recs)
+	}
+
+	family := WithFamilyFunc(func(req *http.Request) string { return "middleware.Sampled" })
+	unsampled := MiddlewareWithOptions(mux, family, WithSampleRate(0))
+	serve(unsampled, "GET", "/users/2")
+	if traced {
+		t.Fatal("unexpected trace in the request context")
+	}
+	if recs = Search(&Filter{Family: "middleware.Sampled"}, false); len(recs) != 0 {
+		t.Fatalf("expected no traces: %+v", recs)
+	}
+
+	req := httptest.NewRequest("GET", "/users/3", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	unsampled.ServeHTTP(httptest.NewRecorder(), req)
+	if recs = Search(&Filter{Family: "middleware.Sampled"}, false); len(recs) != 1 {
+		t.Fatalf("expected the sampled parent to be traced: %+v", recs)
+	}
+
+	panics := MiddlewareWithOptions(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("oops")
+	}), WithFamily("middleware.Panic"))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic wasn't propagated")
+			}
+		}()
+		serve(panics, "GET", "/")
+	}()
+	if recs = Search(&Filter{Family: "middleware.Panic"}, false); len(recs) != 1 || !recs[0].IsError {
+		t.Fatalf("expected an error trace: %+v", recs)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(Middleware("transport.Server", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte("hello"))
+	})))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{Family: "transport.Client"}}
+	root, ctx := StartSpan(context.Background(), "transport.Root", "fetch")
+	defer root.Finish()
+
+	for _, path := range []string{"/ok", "/fail"} {
+		req, err := http.NewRequest("GET", srv.URL+path+"?token=secret", nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp.Body.Close()
+	}
+
+	recs := Search(&Filter{Family: "transport.Client"}, false)
+	if len(recs) != 2 {
+		t.Fatalf("expected two client traces, got %d", len(recs))
+	}
+	fail, ok := recs[0], recs[1]
+	if !fail.IsError || ok.IsError || strings.Contains(ok.Title, "secret") {
+		t.Fatalf("unexpected client traces: %+v, %+v", fail, ok)
+	}
+	if ok.TraceID != root.SpanContext().TraceID.String() || ok.ParentID != root.SpanContext().SpanID.String() {
+		t.Fatalf("the client trace %+v isn't a child of %+v", ok, root.SpanContext())
+	}
+
+	var events []string
+	for _, e := range ok.Events {
+		events = append(events, e.What)
+	}
+	for _, want := range []string{"connected to tcp", "got the first response byte", "200 OK"} {
+		if !strings.Contains(strings.Join(events, "\n"), want) {
+			t.Errorf("expected an event containing %q: %q", want, events)
+		}
+	}
+
+	// The server continues the client's trace.
+	srecs := Search(&Filter{Family: "transport.Server"}, false)
+	if len(srecs) != 2 || srecs[1].ParentID != ok.SpanID || srecs[1].TraceID != ok.TraceID {
+		t.Fatalf("the server traces %+v don't continue the client's", srecs)
+	}
+
+	srv.Close()
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Fatal("expected an error from a closed server")
+	}
+	recs = Search(&Filter{Family: "transport.Client", ErrorsOnly: true, Event: "request failed"}, false)
+	if len(recs) != 1 {
+		t.Fatalf("expected a failed client trace, got %d", len(recs))
+	}
+}
+
+// testMsg is a message with a String method, as protobuf messages
+// have.
+type testMsg struct{ s string }
+
+func (m *testMsg) String() string { return m.s }
+
+// fakeStream is a server and client stream that receives its
+// messages and records those sent.
+type fakeStream struct {
+	ctx  context.Context
+	recv []string
+	sent []string
+}
+
+func (s *fakeStream) Context() context.Context { return s.ctx }
+func (s *fakeStream) CloseSend() error         { return nil }
+
+func (s *fakeStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m.(*testMsg).s)
+	return nil
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if len(s.recv) == 0 {
+		return io.EOF
+	}
+	m.(*testMsg).s, s.recv = s.recv[0], s.recv[1:]
+	return nil
+}
+
+func TestRPCInterceptors(t *testing.T) {
+	echo := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, ok := FromContext(ctx); !ok {
+			t.Error("no trace in the handler's context")
+		}
+		if req == "fail" {
+			return nil, errors.New("failed")
+		}
+		return req, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, req := range []string{"hello", "fail"} {
+		UnaryServerInterceptor(ctx, nil, req, "/test.Echo/Unary", echo)
+	}
+
+	recs := Search(&Filter{Family: "grpc.Recv./test.Echo/Unary"}, true)
+	if len(recs) != 2 || !recs[0].IsError || recs[1].IsError {
+		t.Fatalf("unexpected server traces: %+v", recs)
+	}
+	if e := recs[1].Events; len(e) != 3 || !strings.HasPrefix(e[0].What, "deadline: ") || e[1].What != "recv: hello" || e[2].What != "sent: hello" || !e[1].Sensitive {
+		t.Fatalf("unexpected server events: %+v", e)
+	}
+
+	root, rctx := StartSpan(context.Background(), "rpc.Root", "call")
+	defer root.Finish()
+	err := UnaryClientInterceptor(rctx, "/test.Echo/Unary", "hi", new(testMsg), func(ctx context.Context, method string, req, reply interface{}) error {
+		reply.(*testMsg).s = req.(string)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	recs = Search(&Filter{Family: "grpc.Sent./test.Echo/Unary"}, true)
+	if len(recs) != 1 || recs[0].ParentID != root.SpanContext().SpanID.String() || recs[0].Events[1].What != "recv: hi" {
+		t.Fatalf("unexpected client traces: %+v", recs)
+	}
+
+	ss := &fakeStream{ctx: context.Background(), recv: []string{"a", "b"}}
+	err = StreamServerInterceptor(nil, ss, nil, "/test.Echo/Stream", func(srv interface{}, stream ServerStream) error {
+		for {
+			m := new(testMsg)
+			if err := stream.RecvMsg(m); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			stream.SendMsg(m)
+		}
+	})
+	if err != nil || !reflect.DeepEqual(ss.sent, []string{"a", "b"}) {
+		t.Fatalf("unexpected stream result: %v, %q", err, ss.sent)
+	}
+
+	cs, err := StreamClientInterceptor(rctx, "/test.Echo/Stream", func(ctx context.Context, method string) (ClientStream, error) {
+		return &fakeStream{ctx: ctx, recv: []string{"x"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	cs.SendMsg(&testMsg{"y"})
+	cs.CloseSend()
+	for cs.RecvMsg(new(testMsg)) == nil {
+	}
+
+	var events []string
+	for _, rec := range Search(&Filter{Family: "grpc.Sent./test.Echo/Stream"}, true) {
+		for _, e := range rec.Events {
+			events = append(events, e.What)
+		}
+	}
+	for _, rec := range Search(&Filter{Family: "grpc.Recv./test.Echo/Stream"}, true) {
+		for _, e := range rec.Events {
+			events = append(events, e.What)
+		}
+	}
+	want := []string{"sent: y", "recv: x", "recv: a", "sent: a", "recv: b", "sent: b"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got stream events %q, want %q", events, want)
+	}
+
+	// The trace is propagated in the metadata.
+	var md map[string][]string
+	UnaryClientInterceptor(rctx, "/test.Echo/Propagated", "hi", new(testMsg), func(ctx context.Context, method string, req, reply interface{}) error {
+		kv := OutgoingMetadata(ctx)
+		md = map[string][]string{kv[0]: {kv[1]}}
+		return nil
+	})
+	UnaryServerInterceptor(context.Background(), md, "hi", "/test.Echo/Propagated", echo)
+	client := Search(&Filter{Family: "grpc.Sent./test.Echo/Propagated"}, true)
+	server := Search(&Filter{Family: "grpc.Recv./test.Echo/Propagated"}, true)
+	if len(client) != 1 || len(server) != 1 || server[0].ParentID != client[0].SpanID || server[0].TraceID != client[0].TraceID {
+		t.Fatalf("trace not propagated: client %+v, server %+v", client, server)
+	}
+	if OutgoingMetadata(context.Background()) != nil {
+		t.Fatal("metadata propagated without a span")
+	}
+}
+
+// blockingExporter signals each batch it receives, then waits to be
+// released.
+type blockingExporter struct {
+	received chan int
+	release  chan struct{}
+}
+
+func (be *blockingExporter) ExportSpans(spans []*TraceRecord) error {
+	be.received <- len(spans)
+	<-be.release
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	buf := new(bytes.Buffer)
+	otlp := RegisterExporter(NewOTLPExporter(buf, "test"), ExportConfig{})
+	defer otlp.Close(context.Background())
+
+	var zipkin [][]map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&spans); err != nil {
+			t.Errorf("%s", err)
+		}
+		zipkin = append(zipkin, spans)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+	zq := RegisterExporter(NewZipkinHTTPExporter(collector.URL, "test", nil), ExportConfig{Name: "zipkin"})
+	defer zq.Close(context.Background())
+
+	root, ctx := StartSpan(context.Background(), "export.Family", "GET /users/1")
+	root.SetAttrs(Int("status", 500), Sensitive(String("user", "alice")))
+	child, _ := StartSpan(ctx, "export.Family", "query")
+	child.LazyPrintf("rows: %d", 3)
+	child.Finish()
+	root.SetError()
+	root.Finish()
+	untraced := New("export.Family", "untraced")
+	untraced.Finish()
+
+	otlp.Flush()
+	zq.Flush()
+	if s := otlp.Stats(); s.Exported < 3 || s.Dropped != 0 || s.Failed != 0 {
+		t.Fatalf("unexpected OTLP export stats: %+v", s)
+	}
+
+	var spans []*otlpSpan
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if name := *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != "test" {
+			t.Fatalf("unexpected service name %q", name)
+		}
+		spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	if len(spans) < 3 {
+		t.Fatalf("expected at least three spans, got %d", len(spans))
+	}
+	cspan, rspan, uspan := spans[len(spans)-3], spans[len(spans)-2], spans[len(spans)-1]
+	if cspan.ParentSpanID != rspan.SpanID || cspan.TraceID != rspan.TraceID || cspan.Events[0].Name != "rows: 3" {
+		t.Fatalf("unexpected child span: %+v", cspan)
+	}
+	if rspan.Status.Code != otlpStatusError || len(rspan.Attributes) != 2 || *rspan.Attributes[1].Value.IntValue != "500" {
+		t.Fatalf("unexpected root span: %+v", rspan)
+	}
+	if uspan.Name != "untraced" || uspan.TraceID == "" || uspan.SpanID == "" {
+		t.Fatalf("unexpected untraced span: %+v", uspan)
+	}
+
+	var zspans []map[string]interface{}
+	for _, batch := range zipkin {
+		zspans = append(zspans, batch...)
+	}
+	zroot := zspans[len(zspans)-2]
+	tags := zroot["tags"].(map[string]interface{})
+	if zroot["id"] != rspan.SpanID || tags["error"] != "true" || tags["status"] != "500" || tags["user"] != nil {
+		t.Fatalf("unexpected Zipkin span: %+v", zroot)
+	}
+
+	// Unsampled distributed traces aren't exported.
+	remote := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{1}}
+	unsampled, _ := StartSpan(ContextWithRemoteSpan(context.Background(), remote), "export.Family", "unsampled")
+	unsampled.Finish()
+	otlp.Flush()
+	if strings.Contains(buf.String(), "unsampled") {
+		t.Fatal("unsampled trace exported")
+	}
+
+	metrics := new(bytes.Buffer)
+	if err := RenderMetrics(metrics, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !strings.Contains(metrics.String(), "trace_export_dropped_spans_total{exporter=\"zipkin\"} 0\n") {
+		t.Fatalf("expected the export metrics:\n%s", metrics)
+	}
+}
+
+func TestExportDrops(t *testing.T) {
+	be := &blockingExporter{received: make(chan int, 1), release: make(chan struct{})}
+	q := RegisterExporter(be, ExportConfig{QueueSize: 1, BatchSize: 1})
+
+	New("export.Drops", "first").Finish()
+	<-be.received // the first trace is being exported
+	New("export.Drops", "second").Finish()
+	New("export.Drops", "third").Finish()
+
+	close(be.release)
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if s := q.Stats(); s.Exported != 2 || s.Dropped != 1 {
+		t.Fatalf("unexpected export stats: %+v", s)
+	}
+
+	New("export.Drops", "after").Finish()
+	if s := q.Stats(); s.Exported != 2 {
+		t.Fatal("trace exported after the queue was closed")
+	}
+}
+
+// countingStringer counts its evaluations.
+type countingStringer struct {
+	n int32
+}
+
+func (cs *countingStringer) String() string {
+	atomic.AddInt32(&cs.n, 1)
+	return "counted"
+}
+
+// TestExportAsync checks that traces are recorded for export in the
+// background, and that Close gives up at its deadline.
+func TestExportAsync(t *testing.T) {
+	be := &blockingExporter{received: make(chan int, 1), release: make(chan struct{})}
+	q := RegisterExporter(be, ExportConfig{BatchSize: 1})
+
+	New("export.Async", "first").Finish()
+	<-be.received // the first trace is being exported
+
+	cs := &countingStringer{}
+	tr := New("export.Async", "lazy")
+	tr.LazyLog(cs, false)
+	tr.Finish()
+	if n := atomic.LoadInt32(&cs.n); n != 0 {
+		t.Fatalf("lazy event evaluated %d times by Finish", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected Close to time out, got %v", err)
+	}
+
+	close(be.release)
+	q.Close(context.Background())
+	if s := q.Stats(); s.Exported != 1 || s.Dropped != 1 {
+		t.Fatalf("unexpected export stats: %+v", s)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// One threshold and the error bucket; the histograms follow.
+	RegisterFamily("snapshot.Family", FamilyConfig{Thresholds: []time.Duration{0}})
+	root, ctx := StartSpan(context.Background(), "snapshot.Family", "root")
+	root.LazyLog(s{}, true)
+	root.SetAttrs(Sensitive(String("user", "gopher")))
+	child, _ := StartSpan(ctx, "snapshot.Family", "child")
+	traceID := root.SpanContext().TraceID
+	child.Finish()
+	root.Finish()
+	active := New("snapshot.Family", "active")
+	defer active.Finish()
+
+	el := NewEventLog("snapshot.Events", "log")
+	el.Errorf("failed")
+	defer el.Finish()
+
+	buf := new(bytes.Buffer)
+	if err := WriteSnapshot(buf, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+	snap, err := ReadSnapshot(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"/debug/requests", []string{"Snapshot taken at", "snapshot.Family"}},
+		{"/debug/requests?fam=snapshot.Family&b=0&exp=1", []string{"root", "child", redacted}},
+		{"/debug/requests?fam=snapshot.Family&b=-1", []string{"active"}},
+		{"/debug/requests?fam=snapshot.Family&b=4", []string{"Count: 2"}},
+		{"/debug/requests?search=1&q=chi", []string{"child"}},
+		{"/debug/requests?trace=" + traceID.String(), []string{"root", "child"}},
+		{"/debug/events?fam=snapshot.Events&b=0&exp=1", []string{"Snapshot taken at", "log", "failed"}},
+	}
+	for _, tc := range tests {
+		out := new(bytes.Buffer)
+		RenderSnapshot(out, httptest.NewRequest("GET", tc.url, nil), snap)
+		for _, want := range tc.want {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("%s: expected %q in the snapshot page:\n%s", tc.url, want, out)
+			}
+		}
+		if strings.Contains(out.String(), "lazy string") || strings.Contains(out.String(), "gopher") {
+			t.Fatalf("%s: sensitive event shown in the snapshot page", tc.url)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	SnapshotHandler(func(*http.Request) (bool, bool) { return true, false }).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/snapshot", nil))
+	if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+		t.Fatalf("unexpected Content-Disposition %q", cd)
+	}
+	if _, err := ReadSnapshot(rec.Body); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
 func benchmarkTrace(b *testing.B, maxEvents, numEvents int) {
 	numSpans := (b.N + numEvents + 1) / numEvents
 
@@ -162,3 +1167,79 @@ func BenchmarkTrace_1000_1000(b *testing.B) {
 func BenchmarkTrace_1000_10000(b *testing.B) {
 	benchmarkTrace(b, 1000, 10000)
 }
+
+// benchmarkTraceParallel measures traces created and finished
+// concurrently, spread across the given number of families.
+func benchmarkTraceParallel(b *testing.B, numFamilies int) {
+	families := make([]string, numFamilies)
+	for i := range families {
+		families[i] = fmt.Sprintf("parallel.%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			tr := New(families[i%numFamilies], "test")
+			tr.LazyPrintf("%d", i)
+			tr.LazyPrintf("%d", i+1)
+			tr.Finish()
+			i++
+		}
+	})
+}
+
+func BenchmarkTraceParallel_1(b *testing.B) {
+	benchmarkTraceParallel(b, 1)
+}
+
+func BenchmarkTraceParallel_16(b *testing.B) {
+	benchmarkTraceParallel(b, 16)
+}
+
+func BenchmarkEventLogParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			el := NewEventLog("parallel.Events", "test")
+			el.Printf("event")
+			el.Finish()
+		}
+	})
+}
+
+// benchmarkRender measures rendering the requests page for url with
+// numActive active traces in the family.
+func benchmarkRender(b *testing.B, url string, numActive int) {
+	for i := 0; i < numActive; i++ {
+		tr := New("render.Family", "active")
+		defer tr.Finish()
+	}
+	for i := 0; i < 100; i++ {
+		New("render.Family", "done").Finish()
+	}
+
+	req := httptest.NewRequest("GET", url, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Render(ioutil.Discard, req, true)
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	benchmarkRender(b, "/debug/requests", 1000)
+}
+
+func BenchmarkRender_Active(b *testing.B) {
+	benchmarkRender(b, "/debug/requests?fam=render.Family&b=-1", 1000)
+}
+
+func BenchmarkRender_Bucket(b *testing.B) {
+	benchmarkRender(b, "/debug/requests?fam=render.Family&b=0&exp=1", 1000)
+}
+
+func BenchmarkRender_Search(b *testing.B) {
+	benchmarkRender(b, "/debug/requests?search=1&fam=render.Family&q=done", 1000)
+}
@@ -0,0 +1,236 @@
+package trace
+
+// This file implements an http.RoundTripper that traces outbound
+// requests.
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// DefaultTransportFamily is the family of the traces created by a
+// Transport without a Family.
+const DefaultTransportFamily = "http.Client"
+
+// Transport is an http.RoundTripper that traces each request, as a
+// child of the Trace bound to the request's context if there is one.
+// The trace logs the DNS lookup, connection, TLS handshake, and first
+// response byte as events, and records the response's status or the
+// error; it finishes when the response body is read to the end or
+// closed. The trace's span context is propagated to the server in the
+// traceparent header.
+type Transport struct {
+	// Base is the RoundTripper that makes the requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// Family is the family of the traces. If empty,
+	// DefaultTransportFamily is used.
+	Family string
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) family() string {
+	if t.Family != "" {
+		return t.Family
+	}
+	return DefaultTransportFamily
+}
+
+// clientTrace logs the httptrace events of a request to its trace.
+// The events may arrive concurrently, or after the request has failed,
+// so they are ignored once the trace is finished.
+type clientTrace struct {
+	mu       sync.Mutex
+	tr       SpanTrace
+	done     bool
+	dnsStart time.Time
+	tlsStart time.Time
+	dials    map[string]time.Time // connection start times by address
+}
+
+func (ct *clientTrace) printf(format string, a ...interface{}) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if !ct.done {
+		ct.tr.LazyPrintf(format, a...)
+	}
+}
+
+// finish finishes the trace, if it isn't already.
+func (ct *clientTrace) finish() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if !ct.done {
+		ct.done = true
+		ct.tr.Finish()
+	}
+}
+
+// since returns the time since *start, which is set under ct.mu.
+func (ct *clientTrace) since(start *time.Time) time.Duration {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return time.Since(*start)
+}
+
+func (ct *clientTrace) set(start *time.Time) {
+	ct.mu.Lock()
+	*start = time.Now()
+	ct.mu.Unlock()
+}
+
+func (ct *clientTrace) httptrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			ct.set(&ct.dnsStart)
+			ct.printf("DNS lookup of %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			d := ct.since(&ct.dnsStart)
+			if info.Err != nil {
+				ct.printf("DNS lookup failed after %v: %v", d, info.Err)
+				return
+			}
+			ct.printf("DNS lookup done in %v: %v", d, info.Addrs)
+		},
+		ConnectStart: func(network, addr string) {
+			ct.mu.Lock()
+			ct.dials[network+" "+addr] = time.Now()
+			ct.mu.Unlock()
+			ct.printf("connecting to %s %s", network, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			ct.mu.Lock()
+			d := time.Since(ct.dials[network+" "+addr])
+			ct.mu.Unlock()
+			if err != nil {
+				ct.printf("connection to %s %s failed after %v: %v", network, addr, d, err)
+				return
+			}
+			ct.printf("connected to %s %s in %v", network, addr, d)
+		},
+		TLSHandshakeStart: func() {
+			ct.set(&ct.tlsStart)
+			ct.printf("TLS handshake")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			d := ct.since(&ct.tlsStart)
+			if err != nil {
+				ct.printf("TLS handshake failed after %v: %v", d, err)
+				return
+			}
+			ct.printf("TLS handshake done in %v (%s)", d, state.NegotiatedProtocol)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				ct.printf("reusing connection to %v, idle for %v", info.Conn.RemoteAddr(), info.IdleTime)
+				return
+			}
+			ct.printf("got connection to %v", info.Conn.RemoteAddr())
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				ct.printf("writing the request failed: %v", info.Err)
+				return
+			}
+			ct.printf("wrote the request")
+		},
+		GotFirstResponseByte: func() {
+			ct.printf("got the first response byte")
+		},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The query is left out of the title, as it may hold secrets.
+	title := req.Method + " " + req.URL.Host + req.URL.Path
+	tr, ctx := StartSpan(req.Context(), t.family(), title)
+	tr.SetAttrs(String("http.method", req.Method), String("http.host", req.URL.Host), String("http.path", req.URL.Path))
+
+	ct := &clientTrace{tr: tr, dials: map[string]time.Time{}}
+	ctx = httptrace.WithClientTrace(ctx, ct.httptrace())
+
+	// A RoundTripper mustn't modify the request, so the headers
+	// are copied before the span context is added.
+	out := req.WithContext(ctx)
+	out.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		out.Header[k] = v
+	}
+	Inject(out.Header, tr.SpanContext())
+
+	resp, err := t.base().RoundTrip(out)
+	if err != nil {
+		ct.mu.Lock()
+		tr.LazyPrintf("request failed: %v", err)
+		tr.SetError()
+		ct.mu.Unlock()
+		ct.finish()
+		return nil, err
+	}
+
+	ct.mu.Lock()
+	tr.SetAttrs(Int("http.status_code", int64(resp.StatusCode)))
+	tr.LazyPrintf("%s", resp.Status)
+	if resp.StatusCode >= 500 {
+		tr.SetError()
+	}
+	ct.mu.Unlock()
+
+	if resp.Body == nil {
+		ct.finish()
+		return resp, nil
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, ct: ct}
+	return resp, nil
+}
+
+// tracedBody finishes a request's trace when the response body is
+// read to the end or closed.
+type tracedBody struct {
+	io.ReadCloser
+	ct    *clientTrace
+	bytes int64
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err != nil {
+		b.end(err)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end(nil)
+	return err
+}
+
+// end records the size of the response, and the error reading it if
+// it isn't io.EOF, and finishes the trace.
+func (b *tracedBody) end(err error) {
+	b.ct.mu.Lock()
+	if !b.ct.done {
+		b.ct.tr.SetAttrs(Int("http.response_size", b.bytes))
+		if err != nil && err != io.EOF {
+			b.ct.tr.LazyPrintf("reading the response failed: %v", err)
+			b.ct.tr.SetError()
+		}
+	}
+	b.ct.mu.Unlock()
+	b.ct.finish()
+}
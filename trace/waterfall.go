@@ -0,0 +1,135 @@
+package trace
+
+// This file implements the waterfall view of a distributed trace on
+// /debug/requests.
+
+import (
+	"sort"
+	"time"
+)
+
+// maxWaterfallSpans is the most spans shown in a waterfall.
+const maxWaterfallSpans = 1000
+
+// A waterfallSpan is a trace positioned in the waterfall of its
+// distributed trace.
+type waterfallSpan struct {
+	*trace
+	Depth  int           // the number of ancestors in the waterfall
+	Offset time.Duration // since the start of the waterfall
+
+	// Left and Width position the span's bar, as percentages of
+	// the waterfall's duration.
+	Left, Width float64
+}
+
+// A waterfall is the active and completed traces of a distributed
+// trace, in depth-first order with children ordered by start time.
+type waterfall struct {
+	TraceID TraceID
+	Start   time.Time
+	Elapsed time.Duration
+	Spans   []*waterfallSpan
+}
+
+// newWaterfall collects the spans of the distributed trace id.
+func newWaterfall(id TraceID) *waterfall {
+	f := &Filter{TraceID: id, Limit: maxWaterfallSpans}
+	return buildWaterfall(id, f.search(false), time.Now())
+}
+
+// buildWaterfall arranges the spans of the distributed trace id,
+// measuring active spans up to now.
+func buildWaterfall(id TraceID, trl traceList, now time.Time) *waterfall {
+	wf := &waterfall{TraceID: id}
+	if len(trl) == 0 {
+		return wf
+	}
+
+	spans := make(traceList, len(trl))
+	copy(spans, trl)
+	sort.Sort(sort.Reverse(spans)) // oldest first
+
+	wf.Start = spans[0].Start
+	present := make(map[SpanID]bool, len(spans))
+	for _, tr := range spans {
+		present[tr.spanID] = true
+		if end := tr.Start.Add(tr.elapsedAt(now)).Sub(wf.Start); end > wf.Elapsed {
+			wf.Elapsed = end
+		}
+	}
+
+	// Spans whose parent isn't present, whether because it is in
+	// another process or has been discarded, are shown as roots.
+	var roots []*trace
+	children := map[SpanID][]*trace{}
+	for _, tr := range spans {
+		if tr.parentID.IsValid() && present[tr.parentID] && tr.parentID != tr.spanID {
+			children[tr.parentID] = append(children[tr.parentID], tr)
+		} else {
+			roots = append(roots, tr)
+		}
+	}
+
+	var visit func(tr *trace, depth int)
+	visit = func(tr *trace, depth int) {
+		span := &waterfallSpan{
+			trace:  tr,
+			Depth:  depth,
+			Offset: tr.Start.Sub(wf.Start),
+		}
+		if wf.Elapsed > 0 {
+			span.Left = 100 * float64(span.Offset) / float64(wf.Elapsed)
+			span.Width = 100 * float64(tr.elapsedAt(now)) / float64(wf.Elapsed)
+		}
+		wf.Spans = append(wf.Spans, span)
+
+		kids := children[tr.spanID]
+		delete(children, tr.spanID) // guard against cycles
+		for _, child := range kids {
+			visit(child, depth+1)
+		}
+	}
+	for _, tr := range roots {
+		visit(tr, 0)
+	}
+	return wf
+}
+
+// Waterfall is the JSON representation of a distributed trace's
+// spans, in depth-first order with children ordered by start time.
+type Waterfall struct {
+	TraceID string           `json:"trace_id"`
+	Start   time.Time        `json:"start"`
+	Elapsed time.Duration    `json:"elapsed_ns"`
+	Spans   []*WaterfallSpan `json:"spans"`
+}
+
+// WaterfallSpan is the JSON representation of a span in a waterfall.
+type WaterfallSpan struct {
+	Depth  int           `json:"depth"`
+	Offset time.Duration `json:"offset_ns"` // since the start of the waterfall
+	*TraceRecord
+}
+
+// CollectWaterfall returns the JSON representation of the active and
+// completed spans of the distributed trace id. Sensitive events are
+// redacted unless sensitive is true.
+func CollectWaterfall(id TraceID, sensitive bool) *Waterfall {
+	wf := newWaterfall(id)
+
+	jwf := &Waterfall{
+		TraceID: id.String(),
+		Start:   wf.Start,
+		Elapsed: wf.Elapsed,
+		Spans:   make([]*WaterfallSpan, 0, len(wf.Spans)),
+	}
+	for _, span := range wf.Spans {
+		jwf.Spans = append(jwf.Spans, &WaterfallSpan{
+			Depth:       span.Depth,
+			Offset:      span.Offset,
+			TraceRecord: newTraceRecord(span.trace, sensitive),
+		})
+	}
+	return jwf
+}
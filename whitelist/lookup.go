@@ -50,6 +50,7 @@ type Handler struct {
 	allowHandler http.Handler
 	denyHandler  http.Handler
 	whitelist    ACL
+	lookup       LookupFunc
 }
 
 // NewHandler returns a new whitelisting-wrapped HTTP handler. The
@@ -57,6 +58,13 @@ type Handler struct {
 // request is whitelisted; the deny handler should contain a handler
 // that will be called in the request is not whitelisted.
 func NewHandler(allow, deny http.Handler, acl ACL) (http.Handler, error) {
+	return NewHandlerWithLookup(allow, deny, acl, HTTPRequestLookup)
+}
+
+// NewHandlerWithLookup is like NewHandler, but uses lookup to
+// determine the client address (e.g. a ProxyLookup's Lookup method).
+// If lookup is nil, HTTPRequestLookup is used.
+func NewHandlerWithLookup(allow, deny http.Handler, acl ACL, lookup LookupFunc) (http.Handler, error) {
 	if allow == nil {
 		return nil, errors.New("whitelist: allow cannot be nil")
 	}
@@ -65,16 +73,21 @@ func NewHandler(allow, deny http.Handler, acl ACL) (http.Handler, error) {
 		return nil, errors.New("whitelist: ACL cannot be nil")
 	}
 
+	if lookup == nil {
+		lookup = HTTPRequestLookup
+	}
+
 	return &Handler{
 		allowHandler: allow,
 		denyHandler:  deny,
 		whitelist:    acl,
+		lookup:       lookup,
 	}, nil
 }
 
 // ServeHTTP wraps the request in a whitelist check.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ip, err := HTTPRequestLookup(req)
+	ip, err := h.lookup(req)
 	if err != nil {
 		log.Printf("failed to lookup request address: %v", err)
 		status := http.StatusInternalServerError
@@ -101,10 +114,18 @@ type HandlerFunc struct {
 	allow     func(http.ResponseWriter, *http.Request)
 	deny      func(http.ResponseWriter, *http.Request)
 	whitelist ACL
+	lookup    LookupFunc
 }
 
 // NewHandlerFunc returns a new basic whitelisting handler.
 func NewHandlerFunc(allow, deny func(http.ResponseWriter, *http.Request), acl ACL) (*HandlerFunc, error) {
+	return NewHandlerFuncWithLookup(allow, deny, acl, HTTPRequestLookup)
+}
+
+// NewHandlerFuncWithLookup is like NewHandlerFunc, but uses lookup to
+// determine the client address. If lookup is nil, HTTPRequestLookup
+// is used.
+func NewHandlerFuncWithLookup(allow, deny func(http.ResponseWriter, *http.Request), acl ACL, lookup LookupFunc) (*HandlerFunc, error) {
 	if allow == nil {
 		return nil, errors.New("whitelist: allow cannot be nil")
 	}
@@ -113,17 +134,22 @@ func NewHandlerFunc(allow, deny func(http.ResponseWriter, *http.Request), acl AC
 		return nil, errors.New("whitelist: ACL cannot be nil")
 	}
 
+	if lookup == nil {
+		lookup = HTTPRequestLookup
+	}
+
 	return &HandlerFunc{
 		allow:     allow,
 		deny:      deny,
 		whitelist: acl,
+		lookup:    lookup,
 	}, nil
 }
 
 // ServeHTTP checks the incoming request to see whether it is permitted,
 // and calls the appropriate handle function.
 func (h *HandlerFunc) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ip, err := HTTPRequestLookup(req)
+	ip, err := h.lookup(req)
 	if err != nil {
 		log.Printf("failed to lookup request address: %v", err)
 		status := http.StatusInternalServerError
@@ -0,0 +1,142 @@
+package whitelist
+
+// This file contains support for resolving the client address of
+// requests that have passed through trusted reverse proxies.
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A LookupFunc extracts the client IP address from an HTTP request.
+// HTTPRequestLookup is the default LookupFunc.
+type LookupFunc func(*http.Request) (net.IP, error)
+
+// The forwarding headers commonly set by reverse proxies.
+const (
+	HeaderForwarded     = "Forwarded" // RFC 7239
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// A ProxyLookup resolves the address of the client that originated a
+// request, honouring a single forwarding header only when the
+// immediate peer is a trusted proxy.
+//
+// Only the header that the proxies set should be configured: a proxy
+// passes the other headers through from the client unchanged, so
+// reading them would let any client choose its own address. The
+// Forwarded header is parsed as in RFC 7239; any other header is read
+// as a comma-separated list of addresses, as X-Forwarded-For and
+// X-Real-IP are.
+//
+// The forwarding chain is walked from right to left (i.e. starting
+// with the hop closest to this server); the first address that is not
+// a trusted proxy is the client address. If every address in the
+// chain is trusted, the leftmost address is used.
+type ProxyLookup struct {
+	trusted ACL
+	header  string
+}
+
+// NewProxyLookup returns a ProxyLookup that trusts the given
+// forwarding header (e.g. HeaderXForwardedFor) when it is set by the
+// proxies in the given whitelist, which will usually be a NetACL. If
+// header is empty, no forwarding header is trusted.
+func NewProxyLookup(trusted ACL, header string) *ProxyLookup {
+	if header != "" {
+		header = http.CanonicalHeaderKey(header)
+	}
+	return &ProxyLookup{trusted: trusted, header: header}
+}
+
+var errInvalidForwarded = errors.New("whitelist: invalid forwarded address")
+
+// Lookup returns the client address for the request. It may be used
+// as a LookupFunc.
+func (pl *ProxyLookup) Lookup(req *http.Request) (net.IP, error) {
+	peer, err := HTTPRequestLookup(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if pl.header == "" || pl.trusted == nil || !pl.trusted.Permitted(peer) {
+		return peer, nil
+	}
+
+	hops := forwardedHops(req.Header, pl.header)
+	if len(hops) == 0 {
+		return peer, nil
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedAddr(hops[i])
+		if ip == nil {
+			return nil, errInvalidForwarded
+		}
+
+		if !pl.trusted.Permitted(ip) || i == 0 {
+			return ip, nil
+		}
+	}
+
+	// Not reached: the loop always returns on the leftmost hop.
+	return peer, nil
+}
+
+// forwardedHops returns the forwarding chain from the named request
+// header, which must be in canonical form, ordered from the
+// originating client to the last proxy.
+func forwardedHops(h http.Header, header string) []string {
+	values := h[header]
+	if header == HeaderForwarded {
+		return parseForwarded(values)
+	}
+
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwarded extracts the for= parameter from each element of the
+// Forwarded headers. Elements without a for= parameter are returned
+// as empty strings, which will not parse as an address.
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop string
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				hop = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address from a forwarding header,
+// which may be a bare IP, an IP with a port, or a bracketed IPv6
+// address with an optional port. Obfuscated identifiers and "unknown"
+// return nil.
+func parseForwardedAddr(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+}
@@ -0,0 +1,150 @@
+package whitelist
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testProxyACL(t *testing.T) *BasicNet {
+	acl := NewBasicNet()
+	for _, cidr := range []string{"127.0.0.0/8", "10.0.0.0/8"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		acl.Add(n)
+	}
+	return acl
+}
+
+func TestProxyLookup(t *testing.T) {
+	acl := testProxyACL(t)
+
+	testCases := []struct {
+		header  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		// Untrusted peers can't spoof their address.
+		{HeaderXForwardedFor, "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "192.0.2.1"},
+		{HeaderXForwardedFor, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{HeaderXRealIP, "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{HeaderForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db8::17]:4711";proto=https`}, "2001:db8::17"},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": "for=1.2.3.4:80;by=10.0.0.1"}, "1.2.3.4"},
+
+		// Headers other than the configured one are passed
+		// through from the client by the proxy, and are ignored.
+		{HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"Forwarded": "for=127.0.0.1", "X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{HeaderXRealIP, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{HeaderForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}, "10.0.0.1"},
+		{"", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}, "10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		req := &http.Request{RemoteAddr: tc.remote, Header: http.Header{}}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+
+		ip, err := NewProxyLookup(acl, tc.header).Lookup(req)
+		if err != nil {
+			t.Fatalf("lookup of %s with %v failed: %v", tc.remote, tc.headers, err)
+		}
+
+		if !ip.Equal(net.ParseIP(tc.want)) {
+			t.Fatalf("lookup of %s using %q with %v returned %s, want %s", tc.remote, tc.header, tc.headers, ip, tc.want)
+		}
+	}
+}
+
+func TestProxyLookupFailures(t *testing.T) {
+	lookup := NewProxyLookup(testProxyACL(t), HeaderForwarded)
+
+	_, err := lookup.Lookup(nil)
+	if err == nil {
+		t.Fatal("lookup of a nil request should fail")
+	}
+
+	for _, forwarded := range []string{"for=unknown", "for=_hidden", "proto=http"} {
+		req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+		req.Header.Set("Forwarded", forwarded)
+		_, err = lookup.Lookup(req)
+		if err == nil {
+			t.Fatalf("lookup with Forwarded: %s should fail", forwarded)
+		}
+	}
+
+	// A nil ACL trusts no proxies.
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	ip, err := NewProxyLookup(nil, HeaderXForwardedFor).Lookup(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("untrusted lookup returned %s", ip)
+	}
+}
+
+func testForwardedResponse(url, forwarded string, t *testing.T) string {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	return string(body)
+}
+
+func TestProxyHandler(t *testing.T) {
+	acl := NewBasic()
+	acl.Add(net.ParseIP("1.2.3.4"))
+
+	lookup := NewProxyLookup(testProxyACL(t), HeaderXForwardedFor)
+	h, err := NewHandlerWithLookup(testAllowHandler, testDenyHandler, acl, lookup.Lookup)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	hf, err := NewHandlerFuncWithLookup(testAllowHandler.ServeHTTP, testDenyHandler.ServeHTTP, acl, lookup.Lookup)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, handler := range []http.Handler{h, hf} {
+		srv := httptest.NewServer(handler)
+
+		response := testForwardedResponse(srv.URL, "", t)
+		if response != "NO" {
+			t.Fatalf("Expected NO, but got %s", response)
+		}
+
+		response = testForwardedResponse(srv.URL, "1.2.3.4", t)
+		if response != "OK" {
+			t.Fatalf("Expected OK, but got %s", response)
+		}
+
+		srv.Close()
+	}
+}